@@ -5,13 +5,67 @@ type AppSettings struct {
 	ReplicaAddress string
 	Dir            string
 	DBFileName     string
-	IsSlave        bool
-	RedisMap       map[string]ICache
+	RequirePass    string
+	//? Save points, the dataset is saved in the background once one is reached
+	SaveParams []SaveParam
+	//? Keyspace event classes to publish, see notify-keyspace-events
+	NotifyKeyspaceEvents int
+	IsSlave              bool
+	//? A read only replica refuses writes from its clients
+	ReplicaReadOnly bool
+	//? Bytes of replication stream kept for partial resyncs
+	ReplBacklogSize int
+	//? Send full syncs straight to the replica sockets, after waiting the
+	//? delay in seconds for more replicas to share the snapshot
+	ReplDisklessSync      bool
+	ReplDisklessSyncDelay int
+	//? Seconds without news from the other side of a replication link
+	//? before it is considered dead
+	ReplTimeout int
+	//? Replicas whose pending output exceeds it are disconnected
+	ReplicaOutputBufferLimit OutputBufferLimit
+	//? Log every write to the AOF, in AppendDirname in Dir, fsynced always,
+	//? everysec or never (no). A truncated tail is dropped at startup when
+	//? AOFLoadTruncated, refused otherwise.
+	AppendOnly       bool
+	AppendFsync      string
+	AppendFilename   string
+	AppendDirname    string
+	AOFLoadTruncated bool
+	//? Rewrites write the base as an RDB rather than commands, and start on
+	//? their own once the AOF grew by the percentage over its size after the
+	//? last rewrite, when it is at least the min size in bytes
+	AOFUseRDBPreamble        bool
+	AutoAOFRewritePercentage int
+	AutoAOFRewriteMinSize    int
+	//? Sentinel mode: the process monitors masters instead of holding data.
+	//? Milliseconds before an unresponsive instance is down, and before a
+	//? failover is given up.
+	Sentinel                bool
+	SentinelDownAfter       int
+	SentinelFailoverTimeout int
+	RedisMap                map[string]ICache
+}
+
+// SaveParam saves the dataset once Changes writes happened within Seconds
+type SaveParam struct {
+	Seconds int
+	Changes int
+}
+
+// OutputBufferLimit disconnects a client once its pending output is over Hard
+// bytes, or stays over Soft bytes for more than SoftSeconds. Zero disables.
+type OutputBufferLimit struct {
+	Hard        int
+	Soft        int
+	SoftSeconds int
 }
 
 type RESPValue struct {
 	Type  byte
 	Value interface{}
+	//? RESP3 attribute map sent right before the value, as flat key/value pairs
+	Attributes []RESPValue
 }
 
 type TSession struct {
@@ -21,7 +75,9 @@ type TSession struct {
 
 type TransactionSettings struct {
 	InvokedTx bool
-	Session   []TSession
+	//? Set when a command failed to queue, EXEC then discards the transaction
+	Aborted bool
+	Session []TSession
 }
 
 type ICache struct {
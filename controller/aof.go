@@ -0,0 +1,556 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	configuration "github.com/oussamasf/yuji/config"
+	"github.com/oussamasf/yuji/utils"
+)
+
+// appendOnlyFile logs every write the server propagates, in RESP, so that a
+// restart replays them and loses at most what the fsync policy allows
+type appendOnlyFile struct {
+	config *configuration.AppSettings
+	//? Files of the AOF, writes go to the last incremental one
+	manifest *aofManifest
+	file     *os.File
+	//? appendfsync: always, everysec or no
+	fsync string
+	//? Bytes written, and how many of them are known to be on disk
+	writtenOffset int64
+	fsyncedOffset int64
+	//? Replication offset the dataset had at the last write and the last
+	//? fsync, a replica reports the latter to WAITAOF with REPLCONF ACK FACK
+	writtenReplOffset int64
+	fsyncedReplOffset int64
+	lastWriteErr      error
+	//? What the last failed write left out, written again before anything
+	//? else, and the replication offset it brings the dataset to
+	unwritten           []byte
+	unwrittenReplOffset int64
+	//? Size of the AOF after the last rewrite and now, for
+	//? auto-aof-rewrite-percentage
+	rewriteBaseSize int64
+	currentSize     int64
+	//? Set while BGREWRITEAOF writes the new base
+	rewriting bool
+	stop      chan struct{}
+}
+
+// aofMu guards aof, it is taken after keyspaceMu and replicationMu
+var aofMu sync.Mutex
+
+// aof is nil while appendonly is off
+var aof *appendOnlyFile
+
+// datasetLoaded is set once LoadDataset ran, CONFIG SET appendonly only
+// opens the AOF from then on. Guarded by keyspaceMu.
+var datasetLoaded bool
+
+// LoadDataset fills the keyspace at startup, from the AOF when appendonly is
+// on and there is one, since it is the most up to date, from the RDB
+// otherwise. The AOF is then opened for writing.
+func LoadDataset(config *configuration.AppSettings) error {
+	//? Saves interrupted by a crash never replaced the files they were for
+	for _, name := range utils.RemoveTempRDBFiles(config.Dir) {
+		log.Printf("Removed temporary file %s left by an interrupted save", name)
+	}
+
+	aofLoaded := false
+	if config.AppendOnly {
+		if err := upgradeLegacyAppendOnlyFile(config); err != nil {
+			return err
+		}
+		loaded, err := loadAppendOnlyFiles(config)
+		if err != nil {
+			return err
+		}
+		aofLoaded = loaded
+	}
+	if !aofLoaded {
+		path := filepath.Join(config.Dir, config.DBFileName)
+		if _, err := os.Stat(path); err == nil {
+			if err := loadRDBFile(config, path); err != nil {
+				return err
+			}
+			log.Printf("DB loaded from disk: %d keys", len(config.RedisMap))
+		}
+	}
+
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+
+	datasetLoaded = true
+	go persistenceCron(config)
+	if !config.AppendOnly {
+		return nil
+	}
+	//? Without an AOF to continue, it starts with the dataset loaded from RDB
+	return startAppendOnly(config, !aofLoaded)
+}
+
+func loadRDBFile(config *configuration.AppSettings, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	cache, err := utils.DecodeRDB(data)
+	if err != nil {
+		return fmt.Errorf("Bad RDB file %s: %v", path, err)
+	}
+	loadKeyspace(config, cache)
+	return nil
+}
+
+// loadAppendOnlyFiles loads the base then replays the incremental files the
+// manifest lists. It reports false when there is no AOF.
+func loadAppendOnlyFiles(config *configuration.AppSettings) (bool, error) {
+	manifest, err := loadAOFManifest(config)
+	if err != nil || manifest == nil {
+		return false, err
+	}
+
+	files := manifest.files()
+	for i, info := range files {
+		path := filepath.Join(aofDir(config), info.name)
+		if info.isRDB() {
+			err = loadRDBFile(config, path)
+		} else {
+			//? Only the last file can be cut short by a crash
+			err = replayAppendOnlyFile(config, path, i == len(files)-1)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	if len(files) == 0 {
+		return false, nil
+	}
+	log.Printf("DB loaded from append only file: %d keys", len(config.RedisMap))
+	return true, nil
+}
+
+// replayAppendOnlyFile runs the commands of an AOF file through the
+// dispatcher, on behalf of a client that propagates nothing
+func replayAppendOnlyFile(config *configuration.AppSettings, path string, last bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Can't open the append-only file %s: %v", path, err)
+	}
+	defer file.Close()
+
+	loader := NewClient(nil, config)
+	loader.Authenticated = true
+	loader.isAOFLoader = true
+
+	reader := utils.NewRESPReader(file)
+	//? Offset after the last command replayed outside of a transaction, a
+	//? MULTI without its EXEC at the end is a truncated file too
+	valid := int64(0)
+	for {
+		commandArgs, err := reader.ReadCommand()
+		if err == io.EOF && reader.Consumed() == valid {
+			return nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("Bad file format reading the append only file %s at offset %d: %v", path, valid, err)
+		}
+		if err != nil && !last {
+			return fmt.Errorf("Unexpected end of file reading the append only file %s, which is not the last file of the AOF", path)
+		}
+		if err != nil {
+			return truncateAppendOnlyFile(config, path, valid, loader.Tx.InvokedTx)
+		}
+
+		cmdName, args, err := validateCommand(commandArgs)
+		if err != nil || cmdName == "" {
+			return fmt.Errorf("Bad file format reading the append only file %s at offset %d", path, valid)
+		}
+		if _, err := lookupCommand(cmdName, args); err != nil {
+			return fmt.Errorf("Bad command reading the append only file %s at offset %d: %v", path, valid, err)
+		}
+		if reply := processCommand(loader, cmdName, args); reply.Type == '-' {
+			log.Printf("Error replaying '%s' from the append only file: %v", cmdName, reply.Value)
+		}
+		if !loader.Tx.InvokedTx {
+			valid = reader.Consumed()
+		}
+	}
+}
+
+// truncateAppendOnlyFile drops an incomplete last command, which a crash in
+// the middle of a write leaves behind, if aof-load-truncated allows it
+func truncateAppendOnlyFile(config *configuration.AppSettings, path string, valid int64, inTransaction bool) error {
+	if !config.AOFLoadTruncated {
+		return fmt.Errorf("Unexpected end of file reading the append only file %s. Make a backup of it and remove its incomplete tail, or set aof-load-truncated to yes and restart the server", path)
+	}
+
+	log.Printf("!!! Warning: short read while loading the AOF file %s!!!", path)
+	if inTransaction {
+		log.Printf("Revert incomplete MULTI/EXEC transaction in AOF file %s", path)
+	}
+	if err := os.Truncate(path, valid); err != nil {
+		return fmt.Errorf("Error truncating the AOF file %s: %v", path, err)
+	}
+	log.Printf("AOF %s loaded anyway because aof-load-truncated is enabled, truncated to %d bytes", path, valid)
+	return nil
+}
+
+// startAppendOnly opens the last incremental file of the AOF, after writing
+// a new base from the dataset when the AOF does not match it. The caller
+// holds keyspaceMu.
+func startAppendOnly(config *configuration.AppSettings, fromDataset bool) error {
+	stopAppendOnly()
+
+	if err := os.MkdirAll(aofDir(config), 0755); err != nil {
+		return err
+	}
+	manifest, err := loadAOFManifest(config)
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		manifest, fromDataset = &aofManifest{}, true
+	}
+
+	//? The new base replaces every file, the manifest swap makes it atomic
+	var previous []aofFileInfo
+	if fromDataset {
+		previous = manifest.files()
+		base := manifest.newBase(config)
+		temp := filepath.Join(aofDir(config), fmt.Sprintf("temp-rewriteaof-%d.aof", os.Getpid()))
+		if err := writeAOFBase(temp, base, config.RedisMap); err != nil {
+			return fmt.Errorf("Can't create the append only file: %v", err)
+		}
+		if err := utils.RenameSynced(temp, filepath.Join(aofDir(config), base.name)); err != nil {
+			os.Remove(temp)
+			return fmt.Errorf("Can't create the append only file: %v", err)
+		}
+		manifest.base, manifest.incrs = base, nil
+	}
+	if len(manifest.incrs) == 0 {
+		manifest.incrs = append(manifest.incrs, manifest.newIncr(config))
+		if err := writeAOFManifest(config, manifest); err != nil {
+			return err
+		}
+	}
+	removeAOFFiles(config, previous)
+
+	file, err := openAOFIncr(config, manifest.incrs[len(manifest.incrs)-1])
+	if err != nil {
+		return err
+	}
+	size := aofSize(config, manifest)
+
+	aofMu.Lock()
+	defer aofMu.Unlock()
+
+	//? What is already there was either replayed or just written and synced
+	aof = &appendOnlyFile{
+		config:          config,
+		file:            file,
+		fsync:           config.AppendFsync,
+		manifest:        manifest,
+		writtenOffset:   size,
+		fsyncedOffset:   size,
+		rewriteBaseSize: size,
+		currentSize:     size,
+		stop:            make(chan struct{}),
+	}
+	go fsyncEverySecond(aof)
+	return nil
+}
+
+// stopAppendOnly flushes and closes the AOF
+func stopAppendOnly() {
+	aofMu.Lock()
+	defer aofMu.Unlock()
+
+	if aof == nil {
+		return
+	}
+	close(aof.stop)
+	aof.file.Sync()
+	aof.file.Close()
+	aof = nil
+}
+
+func openAOFIncr(config *configuration.AppSettings, incr aofFileInfo) (*os.File, error) {
+	path := filepath.Join(aofDir(config), incr.name)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Can't open the append-only file %s: %v", path, err)
+	}
+	return file, nil
+}
+
+// aofSize sums the sizes of the files of the AOF
+func aofSize(config *configuration.AppSettings, manifest *aofManifest) int64 {
+	size := int64(0)
+	for _, info := range manifest.files() {
+		if stat, err := os.Stat(filepath.Join(aofDir(config), info.name)); err == nil {
+			size += stat.Size()
+		}
+	}
+	return size
+}
+
+// writeAOFBase writes to path a base that rebuilds cache, as an RDB or as
+// commands depending on the kind of base
+func writeAOFBase(path string, base *aofFileInfo, cache map[string]configuration.ICache) error {
+	return utils.WriteSyncedFile(path, func(w io.Writer) error {
+		if base.isRDB() {
+			return utils.WriteRDB(w, cache)
+		}
+		return writeDatasetCommands(w, cache)
+	})
+}
+
+// writeDatasetCommands writes, in RESP, the commands that rebuild cache
+func writeDatasetCommands(w io.Writer, cache map[string]configuration.ICache) error {
+	keys := make([]string, 0, len(cache))
+	for key := range cache {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := cache[key]
+		commands := [][]string{}
+
+		switch value.Type {
+		case configuration.String:
+			set := []string{"SET", key, value.Data}
+			if value.ExpirationMap != "" {
+				set = append(set, "PXAT", value.ExpirationMap)
+			}
+			commands = append(commands, set)
+		case configuration.Stream:
+			for _, entry := range value.StreamData.Entries {
+				xadd := []string{"XADD", key, entry.ID}
+				fields := make([]string, 0, len(entry.Values))
+				for field := range entry.Values {
+					fields = append(fields, field)
+				}
+				sort.Strings(fields)
+				for _, field := range fields {
+					xadd = append(xadd, field, entry.Values[field])
+				}
+				commands = append(commands, xadd)
+			}
+		}
+
+		for _, args := range commands {
+			if _, err := w.Write(utils.EncodeValue(utils.NewBulkStringArray(args), utils.RESP2)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// feedAppendOnlyFile appends the writes of a command and returns the AOF
+// offset right after them, for WAITAOF. replOffset is the replication offset
+// they bring the dataset to. The caller holds keyspaceMu, an automatic rewrite
+// may start from here.
+func feedAppendOnlyFile(commands [][]string, replOffset int64) int64 {
+	aofMu.Lock()
+	defer aofMu.Unlock()
+
+	if aof == nil {
+		return 0
+	}
+
+	buf := append([]byte{}, aof.unwritten...)
+	for _, args := range commands {
+		buf = append(buf, utils.EncodeValue(utils.NewBulkStringArray(args), utils.RESP2)...)
+	}
+	if !writeAOFBuffer(aof, buf, replOffset) {
+		//? WAITAOF waits for the retry
+		return aof.writtenOffset + int64(len(aof.unwritten))
+	}
+
+	//? The client is answered only once its write is on disk
+	if aof.fsync == "always" {
+		if err := aof.file.Sync(); err != nil {
+			log.Printf("Error fsyncing the AOF file: %v", err)
+		} else {
+			aof.fsyncedOffset = aof.writtenOffset
+			aof.fsyncedReplOffset = aof.writtenReplOffset
+		}
+	}
+
+	offset := aof.writtenOffset
+	if aofNeedsRewrite(aof) {
+		log.Printf("Starting automatic rewriting of AOF on %d%% growth", (aof.currentSize-aof.rewriteBaseSize)*100/max(aof.rewriteBaseSize, 1))
+		if err := startAOFRewrite(aof.config); err != nil {
+			log.Printf("Can't rewrite append only file in background: %v", err)
+		}
+	}
+	return offset
+}
+
+// writeAOFBuffer appends buf to the AOF. A partial write is undone when the
+// file can be truncated back, so no command is left half written, and what
+// could not be written is kept for the next write or the retry of
+// fsyncEverySecond. The caller holds aofMu.
+func writeAOFBuffer(f *appendOnlyFile, buf []byte, replOffset int64) bool {
+	n, err := f.file.Write(buf)
+	if err != nil && n > 0 {
+		if info, statErr := f.file.Stat(); statErr == nil && f.file.Truncate(info.Size()-int64(n)) == nil {
+			n = 0
+		}
+	}
+	f.writtenOffset += int64(n)
+	f.currentSize += int64(n)
+
+	if err != nil {
+		if f.lastWriteErr == nil {
+			log.Printf("Error writing to the AOF file: %v", err)
+		}
+		f.lastWriteErr = err
+		f.unwritten = buf[n:]
+		f.unwrittenReplOffset = replOffset
+		return false
+	}
+	if f.lastWriteErr != nil {
+		log.Printf("AOF write error looks solved, the server can write again")
+	}
+	f.lastWriteErr = nil
+	f.unwritten = nil
+	f.writtenReplOffset = replOffset
+	return true
+}
+
+// aofWriteError is the error of the last write to the AOF, nil while writes
+// succeed or the AOF is off
+func aofWriteError() error {
+	aofMu.Lock()
+	defer aofMu.Unlock()
+
+	if aof == nil {
+		return nil
+	}
+	return aof.lastWriteErr
+}
+
+// fsyncEverySecond is the background fsync of appendfsync everysec, writes
+// never wait for it
+func fsyncEverySecond(f *appendOnlyFile) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+		}
+
+		aofMu.Lock()
+		if len(f.unwritten) > 0 {
+			writeAOFBuffer(f, f.unwritten, f.unwrittenReplOffset)
+		}
+		pending := f.fsync == "everysec" && f.writtenOffset > f.fsyncedOffset
+		file, written, replOffset := f.file, f.writtenOffset, f.writtenReplOffset
+		aofMu.Unlock()
+		if !pending {
+			continue
+		}
+
+		//? A rewrite that switched files meanwhile synced the previous one
+		if err := file.Sync(); err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				log.Printf("Error fsyncing the AOF file: %v", err)
+			}
+			continue
+		}
+
+		aofMu.Lock()
+		f.fsyncedOffset = max(f.fsyncedOffset, written)
+		f.fsyncedReplOffset = max(f.fsyncedReplOffset, replOffset)
+		aofMu.Unlock()
+
+		replicationMu.Lock()
+		answerWaitRequests()
+		replicationMu.Unlock()
+	}
+}
+
+// setAppendFsync applies a new appendfsync policy to the open AOF
+func setAppendFsync(policy string) {
+	aofMu.Lock()
+	defer aofMu.Unlock()
+
+	if aof != nil {
+		aof.fsync = policy
+	}
+}
+
+// aofRewriting reports whether BGREWRITEAOF is writing a new base
+func aofRewriting() bool {
+	aofMu.Lock()
+	defer aofMu.Unlock()
+
+	return aof != nil && aof.rewriting
+}
+
+// aofFsynced reports whether the AOF is on disk up to offset
+func aofFsynced(offset int64) bool {
+	aofMu.Lock()
+	defer aofMu.Unlock()
+
+	return aof != nil && aof.fsyncedOffset >= offset
+}
+
+// aofFsyncedReplOffset is the replication offset a replica has on disk, -1
+// without AOF
+func aofFsyncedReplOffset() int64 {
+	aofMu.Lock()
+	defer aofMu.Unlock()
+
+	if aof == nil {
+		return -1
+	}
+	return aof.fsyncedReplOffset
+}
+
+// persistenceInfo is the Persistence section of INFO. The caller holds
+// keyspaceMu.
+func persistenceInfo() []string {
+	aofMu.Lock()
+	defer aofMu.Unlock()
+
+	enabled, rewriting, writeStatus := 0, 0, "ok"
+	if aof != nil {
+		enabled = 1
+		if aof.rewriting {
+			rewriting = 1
+		}
+		if aof.lastWriteErr != nil {
+			writeStatus = "err"
+		}
+	}
+	lines := append([]string{"# Persistence", "loading:0"}, rdbInfo()...)
+	lines = append(lines,
+		fmt.Sprintf("aof_enabled:%d", enabled),
+		fmt.Sprintf("aof_rewrite_in_progress:%d", rewriting),
+		"aof_last_bgrewrite_status:"+lastAOFRewriteStatus,
+		"aof_last_write_status:"+writeStatus,
+	)
+	if aof != nil {
+		lines = append(lines,
+			fmt.Sprintf("aof_current_size:%d", aof.currentSize),
+			fmt.Sprintf("aof_base_size:%d", aof.rewriteBaseSize),
+		)
+	}
+	return lines
+}
@@ -0,0 +1,213 @@
+package controller
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	configuration "github.com/oussamasf/yuji/config"
+	"github.com/oussamasf/yuji/utils"
+)
+
+// ? Types of the files listed in the manifest, as in Redis 7
+const (
+	aofBaseFile = "b"
+	aofIncrFile = "i"
+)
+
+// aofFileInfo is a file of the multi-part AOF
+type aofFileInfo struct {
+	name string
+	seq  int64
+	kind string
+}
+
+// aofManifest lists the files of the AOF in replay order: the base, written
+// by the last rewrite, then the incremental files written since
+type aofManifest struct {
+	base  *aofFileInfo
+	incrs []aofFileInfo
+	//? Highest sequence numbers used, new files continue from there
+	baseSeq int64
+	incrSeq int64
+}
+
+func aofDir(config *configuration.AppSettings) string {
+	return filepath.Join(config.Dir, config.AppendDirname)
+}
+
+func aofManifestPath(config *configuration.AppSettings) string {
+	return filepath.Join(aofDir(config), config.AppendFilename+".manifest")
+}
+
+// files lists the base then the incremental files
+func (m *aofManifest) files() []aofFileInfo {
+	files := []aofFileInfo{}
+	if m.base != nil {
+		files = append(files, *m.base)
+	}
+	return append(files, m.incrs...)
+}
+
+// isRDB reports whether the file is a base written with the RDB preamble
+func (info aofFileInfo) isRDB() bool {
+	return info.kind == aofBaseFile && strings.HasSuffix(info.name, ".rdb")
+}
+
+// newBase names the base file of the next rewrite, an RDB with the preamble
+func (m *aofManifest) newBase(config *configuration.AppSettings) *aofFileInfo {
+	m.baseSeq++
+	extension := "aof"
+	if config.AOFUseRDBPreamble {
+		extension = "rdb"
+	}
+	return &aofFileInfo{
+		name: fmt.Sprintf("%s.%d.base.%s", config.AppendFilename, m.baseSeq, extension),
+		seq:  m.baseSeq,
+		kind: aofBaseFile,
+	}
+}
+
+// newIncr names the next incremental file
+func (m *aofManifest) newIncr(config *configuration.AppSettings) aofFileInfo {
+	m.incrSeq++
+	return aofFileInfo{
+		name: fmt.Sprintf("%s.%d.incr.aof", config.AppendFilename, m.incrSeq),
+		seq:  m.incrSeq,
+		kind: aofIncrFile,
+	}
+}
+
+// loadAOFManifest reads the manifest, nil when there is none yet
+func loadAOFManifest(config *configuration.AppSettings) (*aofManifest, error) {
+	path := aofManifestPath(config)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Can't open the AOF manifest %s: %v", path, err)
+	}
+	defer file.Close()
+
+	m := &aofManifest{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		//? file <name> seq <seq> type <b|i>
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("Invalid AOF manifest line: %s", line)
+		}
+		info := aofFileInfo{}
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				info.name = fields[i+1]
+			case "seq":
+				info.seq, err = strconv.ParseInt(fields[i+1], 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid AOF manifest line: %s", line)
+				}
+			case "type":
+				info.kind = fields[i+1]
+			}
+		}
+		if info.name == "" || strings.ContainsAny(info.name, "/\\") {
+			return nil, fmt.Errorf("Invalid AOF manifest line: %s", line)
+		}
+
+		switch info.kind {
+		case aofBaseFile:
+			if m.base != nil {
+				return nil, fmt.Errorf("Found duplicate base file information in the AOF manifest")
+			}
+			base := info
+			m.base = &base
+			m.baseSeq = max(m.baseSeq, info.seq)
+		case aofIncrFile:
+			m.incrs = append(m.incrs, info)
+			m.incrSeq = max(m.incrSeq, info.seq)
+		default:
+			return nil, fmt.Errorf("Unknown AOF file type '%s' in the manifest", info.kind)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Can't read the AOF manifest %s: %v", path, err)
+	}
+	return m, nil
+}
+
+// writeAOFManifest replaces the manifest atomically, the files it lists are
+// those replayed from then on
+func writeAOFManifest(config *configuration.AppSettings, m *aofManifest) error {
+	path := aofManifestPath(config)
+	temp := filepath.Join(aofDir(config), "temp-"+filepath.Base(path))
+
+	err := utils.WriteSyncedFile(temp, func(w io.Writer) error {
+		for _, info := range m.files() {
+			if _, err := fmt.Fprintf(w, "file %s seq %d type %s\n", info.name, info.seq, info.kind); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Can't write the AOF manifest %s: %v", path, err)
+	}
+	if err := utils.RenameSynced(temp, path); err != nil {
+		return fmt.Errorf("Can't write the AOF manifest %s: %v", path, err)
+	}
+	return nil
+}
+
+// removeAOFFiles deletes files the manifest no longer lists
+func removeAOFFiles(config *configuration.AppSettings, files []aofFileInfo) {
+	for _, info := range files {
+		os.Remove(filepath.Join(aofDir(config), info.name))
+	}
+}
+
+// upgradeLegacyAppendOnlyFile moves a single file AOF, as written before the
+// manifest existed, into the AOF directory as its base
+func upgradeLegacyAppendOnlyFile(config *configuration.AppSettings) error {
+	legacy := filepath.Join(config.Dir, config.AppendFilename)
+	if _, err := os.Stat(legacy); err != nil {
+		return nil
+	}
+
+	m, err := loadAOFManifest(config)
+	if err != nil {
+		return err
+	}
+	base := config.AppendFilename + ".1.base.aof"
+	if m != nil && (m.base == nil || m.base.name != base) {
+		return nil
+	}
+
+	//? The manifest is written first, a crash before the rename is then
+	//? finished at the next startup
+	if m == nil {
+		if err := os.MkdirAll(aofDir(config), 0755); err != nil {
+			return err
+		}
+		m = &aofManifest{base: &aofFileInfo{name: base, seq: 1, kind: aofBaseFile}, baseSeq: 1}
+		if err := writeAOFManifest(config, m); err != nil {
+			return err
+		}
+	}
+	if err := utils.RenameSynced(legacy, filepath.Join(aofDir(config), base)); err != nil {
+		return fmt.Errorf("Can't move the append only file %s: %v", legacy, err)
+	}
+	log.Printf("Successfully migrated an old-style AOF %s into the AOF directory", legacy)
+	return nil
+}
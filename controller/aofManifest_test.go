@@ -0,0 +1,122 @@
+package controller
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	configuration "github.com/oussamasf/yuji/config"
+)
+
+func newAOFTestConfig(t *testing.T) *configuration.AppSettings {
+	config := &configuration.AppSettings{
+		RedisMap:       map[string]configuration.ICache{},
+		Dir:            t.TempDir(),
+		AppendDirname:  "appendonlydir",
+		AppendFilename: "appendonly.aof",
+	}
+	if err := os.MkdirAll(aofDir(config), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestLoadAOFManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		want     *aofManifest
+		wantErr  bool
+	}{
+		{
+			name: "base and incremental files",
+			manifest: "file appendonly.aof.2.base.rdb seq 2 type b\n" +
+				"file appendonly.aof.3.incr.aof seq 3 type i\n" +
+				"file appendonly.aof.4.incr.aof seq 4 type i\n",
+			want: &aofManifest{
+				base: &aofFileInfo{name: "appendonly.aof.2.base.rdb", seq: 2, kind: aofBaseFile},
+				incrs: []aofFileInfo{
+					{name: "appendonly.aof.3.incr.aof", seq: 3, kind: aofIncrFile},
+					{name: "appendonly.aof.4.incr.aof", seq: 4, kind: aofIncrFile},
+				},
+				baseSeq: 2,
+				incrSeq: 4,
+			},
+		},
+		{
+			name:     "comments, blank lines and any field order",
+			manifest: "# written by hand\n\n  seq 1 type i file appendonly.aof.1.incr.aof  \r\n",
+			want: &aofManifest{
+				incrs:   []aofFileInfo{{name: "appendonly.aof.1.incr.aof", seq: 1, kind: aofIncrFile}},
+				incrSeq: 1,
+			},
+		},
+		{name: "empty", manifest: "", want: &aofManifest{}},
+		{name: "duplicate base", manifest: "file a seq 1 type b\nfile b seq 2 type b\n", wantErr: true},
+		{name: "unknown type", manifest: "file a seq 1 type h\n", wantErr: true},
+		{name: "odd number of fields", manifest: "file a seq 1 type\n", wantErr: true},
+		{name: "invalid sequence", manifest: "file a seq one type i\n", wantErr: true},
+		{name: "missing name", manifest: "seq 1 type i\n", wantErr: true},
+		{name: "name outside the directory", manifest: "file ../a seq 1 type i\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := newAOFTestConfig(t)
+			if err := os.WriteFile(aofManifestPath(config), []byte(tt.manifest), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := loadAOFManifest(config)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("loadAOFManifest() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadAOFManifest() error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("loadAOFManifest() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadAOFManifestMissing(t *testing.T) {
+	config := newAOFTestConfig(t)
+	if got, err := loadAOFManifest(config); got != nil || err != nil {
+		t.Fatalf("loadAOFManifest() = %+v, %v, want nil, nil", got, err)
+	}
+}
+
+func TestWriteAOFManifest(t *testing.T) {
+	config := newAOFTestConfig(t)
+	config.AOFUseRDBPreamble = true
+
+	manifest := &aofManifest{}
+	manifest.base = manifest.newBase(config)
+	manifest.incrs = append(manifest.incrs, manifest.newIncr(config), manifest.newIncr(config))
+	if err := writeAOFManifest(config, manifest); err != nil {
+		t.Fatalf("writeAOFManifest() error: %v", err)
+	}
+
+	got, err := loadAOFManifest(config)
+	if err != nil {
+		t.Fatalf("loadAOFManifest() error: %v", err)
+	}
+	if !reflect.DeepEqual(got, manifest) {
+		t.Fatalf("loadAOFManifest() = %+v, want %+v", got, manifest)
+	}
+	if !got.base.isRDB() || got.incrs[1].name != "appendonly.aof.2.incr.aof" {
+		t.Fatalf("unexpected file names %+v", got.files())
+	}
+
+	//? The manifest is replaced through a temporary file that doesn't stay
+	entries, _ := os.ReadDir(filepath.Dir(aofManifestPath(config)))
+	if len(entries) != 1 {
+		t.Fatalf("AOF directory holds %d files, want only the manifest", len(entries))
+	}
+}
@@ -0,0 +1,147 @@
+package controller
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	configuration "github.com/oussamasf/yuji/config"
+	"github.com/oussamasf/yuji/utils"
+)
+
+// lastAOFRewriteStatus is reported by INFO, guarded by aofMu
+var lastAOFRewriteStatus = "ok"
+
+// ? BGREWRITEAOF
+func bgrewriteaofCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	aofMu.Lock()
+	defer aofMu.Unlock()
+
+	switch {
+	case aof == nil:
+		return utils.NewError("ERR Background append only file rewriting needs appendonly to be enabled")
+	case aof.rewriting:
+		return utils.NewError("ERR Background append only file rewriting already in progress")
+	case rdb.bgsaveInProgress:
+		rdb.aofRewriteScheduled = true
+		return utils.NewSimpleString("Background append only file rewriting scheduled")
+	}
+	if err := startAOFRewrite(c.Config); err != nil {
+		return utils.NewError("ERR Can't rewrite append only file in background: " + err.Error())
+	}
+	return utils.NewSimpleString("Background append only file rewriting started")
+}
+
+// aofNeedsRewrite applies auto-aof-rewrite-percentage and
+// auto-aof-rewrite-min-size. The caller holds keyspaceMu and aofMu.
+func aofNeedsRewrite(f *appendOnlyFile) bool {
+	config := f.config
+	if f.rewriting || rdb.bgsaveInProgress || config.AutoAOFRewritePercentage <= 0 || f.currentSize < int64(config.AutoAOFRewriteMinSize) {
+		return false
+	}
+	growth := (f.currentSize - f.rewriteBaseSize) * 100 / max(f.rewriteBaseSize, 1)
+	return growth >= int64(config.AutoAOFRewritePercentage)
+}
+
+// startAOFRewrite switches writes to a new incremental file, then writes in
+// the background a base holding the dataset as it is at that point. The
+// caller holds keyspaceMu and aofMu.
+func startAOFRewrite(config *configuration.AppSettings) error {
+	f := aof
+	//? The new base would already hold what is left to write to the
+	//? current file, replayed after it once written
+	if len(f.unwritten) > 0 {
+		return fmt.Errorf("the AOF can't be written: %v", f.lastWriteErr)
+	}
+	incr := f.manifest.newIncr(config)
+	file, err := openAOFIncr(config, incr)
+	if err != nil {
+		return err
+	}
+
+	//? Listed right away, a crash during the rewrite still replays it
+	f.manifest.incrs = append(f.manifest.incrs, incr)
+	if err := writeAOFManifest(config, f.manifest); err != nil {
+		f.manifest.incrs = f.manifest.incrs[:len(f.manifest.incrs)-1]
+		file.Close()
+		os.Remove(filepath.Join(aofDir(config), incr.name))
+		return err
+	}
+
+	//? The previous file holds every write before the switch
+	if err := f.file.Sync(); err == nil {
+		f.fsyncedOffset, f.fsyncedReplOffset = f.writtenOffset, f.writtenReplOffset
+	}
+	f.file.Close()
+	f.file = file
+	f.rewriting = true
+
+	base := f.manifest.newBase(config)
+	go rewriteAppendOnlyFile(f, base, incr, copyKeyspace(config.RedisMap))
+	return nil
+}
+
+// rewriteAppendOnlyFile writes the new base from the snapshot taken when the
+// rewrite started, then swaps it in
+func rewriteAppendOnlyFile(f *appendOnlyFile, base *aofFileInfo, incr aofFileInfo, snapshot map[string]configuration.ICache) {
+	temp := filepath.Join(aofDir(f.config), fmt.Sprintf("temp-rewriteaof-bg-%d.aof", os.Getpid()))
+	err := writeAOFBase(temp, base, snapshot)
+
+	aofMu.Lock()
+	defer aofMu.Unlock()
+
+	//? The AOF was turned off or started over meanwhile
+	if aof != f {
+		os.Remove(temp)
+		return
+	}
+	f.rewriting = false
+	if err == nil {
+		err = swapAOFBase(f, temp, base, incr)
+	}
+	if err != nil {
+		os.Remove(temp)
+		lastAOFRewriteStatus = "err"
+		log.Printf("Background AOF rewrite failed: %v", err)
+		return
+	}
+	lastAOFRewriteStatus = "ok"
+	log.Printf("Background AOF rewrite finished successfully")
+}
+
+// swapAOFBase makes the new base, followed by the incremental files opened
+// since the rewrite started, the whole AOF. Until the manifest is replaced
+// the previous files remain the AOF. The caller holds aofMu.
+func swapAOFBase(f *appendOnlyFile, temp string, base *aofFileInfo, incr aofFileInfo) error {
+	config := f.config
+	if err := utils.RenameSynced(temp, filepath.Join(aofDir(config), base.name)); err != nil {
+		return err
+	}
+
+	manifest := *f.manifest
+	manifest.base = base
+	manifest.incrs = nil
+	stale := []aofFileInfo{}
+	if f.manifest.base != nil {
+		stale = append(stale, *f.manifest.base)
+	}
+	for _, info := range f.manifest.incrs {
+		if info.seq < incr.seq {
+			stale = append(stale, info)
+			continue
+		}
+		manifest.incrs = append(manifest.incrs, info)
+	}
+
+	if err := writeAOFManifest(config, &manifest); err != nil {
+		os.Remove(filepath.Join(aofDir(config), base.name))
+		return err
+	}
+	*f.manifest = manifest
+	removeAOFFiles(config, stale)
+
+	f.rewriteBaseSize = aofSize(config, f.manifest)
+	f.currentSize = f.rewriteBaseSize
+	return nil
+}
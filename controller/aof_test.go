@@ -0,0 +1,111 @@
+package controller
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/oussamasf/yuji/utils"
+)
+
+func encodeAOFCommands(commands ...string) string {
+	var aof strings.Builder
+	for _, command := range commands {
+		aof.Write(utils.EncodeValue(utils.NewBulkStringArray(strings.Fields(command)), utils.RESP2))
+	}
+	return aof.String()
+}
+
+func TestReplayAppendOnlyFile(t *testing.T) {
+	setA := encodeAOFCommands("SET a 1")
+	setB := encodeAOFCommands("SET b 2")
+	transaction := encodeAOFCommands("MULTI", "SET b 2", "SET c 3", "EXEC")
+
+	tests := []struct {
+		name          string
+		content       string
+		notLast       bool
+		loadTruncated bool
+		wantKeys      map[string]string
+		//? Size the file is left with, its original size when untouched
+		wantSize int
+		wantErr  bool
+	}{
+		{
+			name:     "complete",
+			content:  setA + setB,
+			wantKeys: map[string]string{"a": "1", "b": "2"},
+			wantSize: len(setA + setB),
+		},
+		{
+			name:     "complete transaction",
+			content:  setA + transaction,
+			wantKeys: map[string]string{"a": "1", "b": "2", "c": "3"},
+			wantSize: len(setA + transaction),
+		},
+		{
+			name:          "truncated tail",
+			content:       setA + setB[:len(setB)-3],
+			loadTruncated: true,
+			wantKeys:      map[string]string{"a": "1"},
+			wantSize:      len(setA),
+		},
+		{
+			name:          "truncated inside a length",
+			content:       setA + "*3\r\n$3",
+			loadTruncated: true,
+			wantKeys:      map[string]string{"a": "1"},
+			wantSize:      len(setA),
+		},
+		{
+			name:          "transaction without exec",
+			content:       setA + transaction[:len(transaction)-len(encodeAOFCommands("EXEC"))],
+			loadTruncated: true,
+			wantKeys:      map[string]string{"a": "1"},
+			wantSize:      len(setA),
+		},
+		{name: "truncated tail refused", content: setA + setB[:len(setB)-3], wantErr: true},
+		{name: "truncated file that isn't the last", content: setA + setB[:len(setB)-3], notLast: true, loadTruncated: true, wantErr: true},
+		{name: "unknown command", content: setA + encodeAOFCommands("NOSUCHCOMMAND x"), loadTruncated: true, wantErr: true},
+		{name: "bad format", content: setA + "*1\r\n$x\r\n", loadTruncated: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := newAOFTestConfig(t)
+			config.AOFLoadTruncated = tt.loadTruncated
+			path := filepath.Join(aofDir(config), "appendonly.aof.1.incr.aof")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			err := replayAppendOnlyFile(config, path, !tt.notLast)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("replayAppendOnlyFile() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("replayAppendOnlyFile() error: %v", err)
+			}
+
+			keys := map[string]string{}
+			for key, value := range config.RedisMap {
+				keys[key] = value.Data
+			}
+			if !reflect.DeepEqual(keys, tt.wantKeys) {
+				t.Fatalf("replayed keyspace %v, want %v", keys, tt.wantKeys)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != int64(tt.wantSize) {
+				t.Fatalf("file left with %d bytes, want %d", info.Size(), tt.wantSize)
+			}
+		})
+	}
+}
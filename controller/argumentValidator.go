@@ -5,30 +5,14 @@ import (
 	"strings"
 
 	configuration "github.com/oussamasf/yuji/config"
-	"github.com/oussamasf/yuji/utils"
 )
 
-func validateCommand(data []byte) (string, []configuration.RESPValue, error) {
-
-	formattedInput := strings.ReplaceAll(string(data), "\\r\\n", "\r\n")
-
-	commands, err := utils.Parser(formattedInput)
-
-	if err != nil {
-		return "", []configuration.RESPValue{}, fmt.Errorf("ERR Invalid command")
-	}
-
-	if commands.Type != '*' {
-		return "", []configuration.RESPValue{}, fmt.Errorf("ERR Expected array for command")
-	}
-
-	args, ok := commands.Value.([]configuration.RESPValue)
-	if !ok {
-		return "", []configuration.RESPValue{}, fmt.Errorf("ERR Invalid command format")
-	}
-
+// validateCommand extracts the command name out of the arguments read from the
+// connection, an empty command (a blank inline line) yields an empty name and
+// is simply ignored
+func validateCommand(args []configuration.RESPValue) (string, []configuration.RESPValue, error) {
 	if len(args) < 1 {
-		return "", []configuration.RESPValue{}, fmt.Errorf("ERR No command given")
+		return "", []configuration.RESPValue{}, nil
 	}
 
 	cmdName, ok := args[0].Value.(string)
@@ -0,0 +1,236 @@
+package controller
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	configuration "github.com/oussamasf/yuji/config"
+	"github.com/oussamasf/yuji/utils"
+)
+
+// ? A failed BGSAVE is retried by the save points only after this delay
+const bgsaveRetryDelay = 5 * time.Second
+
+// rdbState tracks the saves of the dump file, guarded by keyspaceMu
+type rdbState struct {
+	//? Writes since the last successful save, and how many of them the
+	//? running BGSAVE covers
+	dirty             int64
+	dirtyBeforeBgsave int64
+	lastSave          time.Time
+	lastBgsaveTry     time.Time
+	lastBgsaveStatus  string
+	bgsaveInProgress  bool
+	//? Waiting for the AOF rewrite, or the BGSAVE, to finish
+	bgsaveScheduled     bool
+	aofRewriteScheduled bool
+}
+
+var rdb = rdbState{lastSave: time.Now(), lastBgsaveStatus: "ok"}
+
+// ? Replicas waiting for the next BGSAVE to full sync from the dump file,
+// ? guarded by replicationMu
+var bgsaveWaiting = []*Client{}
+
+// markDirty counts writes for the save points. The caller holds keyspaceMu.
+func markDirty(changes int) {
+	rdb.dirty += int64(changes)
+}
+
+func saveCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	if rdb.bgsaveInProgress {
+		return utils.NewError("ERR Background save already in progress")
+	}
+
+	if err := utils.SaveRDBFile(c.Config); err != nil {
+		log.Printf("Error saving DB on disk: %v", err)
+		return utils.NewError("ERR " + err.Error())
+	}
+	rdb.dirty = 0
+	rdb.lastSave = time.Now()
+	return utils.NewSimpleString(utils.OK)
+}
+
+// ? BGSAVE [SCHEDULE]
+func bgsaveCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	schedule := false
+	if len(args) > 1 {
+		if option, _ := args[1].Value.(string); len(args) > 2 || !strings.EqualFold(option, "schedule") {
+			return utils.NewError("ERR syntax error")
+		}
+		schedule = true
+	}
+
+	switch {
+	case rdb.bgsaveInProgress:
+		return utils.NewError("ERR Background save already in progress")
+	case aofRewriting() && schedule:
+		rdb.bgsaveScheduled = true
+		return utils.NewSimpleString("Background saving scheduled")
+	case aofRewriting():
+		return utils.NewError("ERR Another background save is active (AOF rewrite): can't BGSAVE right now. Use BGSAVE SCHEDULE in order to schedule a BGSAVE whenever possible.")
+	}
+
+	replicationMu.Lock()
+	startBgsave(c.Config)
+	replicationMu.Unlock()
+	return utils.NewSimpleString("Background saving started")
+}
+
+// ? LASTSAVE
+func lastsaveCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	return utils.NewInteger(rdb.lastSave.Unix())
+}
+
+// queueBgsaveSync makes a replica full sync from the dump of the next BGSAVE,
+// started now unless another save is running. The caller holds keyspaceMu
+// and replicationMu.
+func queueBgsaveSync(c *Client) {
+	bgsaveWaiting = append(bgsaveWaiting, c)
+	if rdb.bgsaveInProgress || aofRewriting() {
+		rdb.bgsaveScheduled = true
+		return
+	}
+	startBgsave(c.Config)
+}
+
+// startBgsave saves a copy of the dataset from a goroutine, clients keep
+// writing meanwhile. The waiting replicas are sent the dump once saved, their
+// stream starts from the copy. The caller holds keyspaceMu and replicationMu.
+func startBgsave(config *configuration.AppSettings) {
+	snapshot := copyKeyspace(config.RedisMap)
+	dir, fileName := config.Dir, config.DBFileName
+
+	fullResync := utils.EncodeValue(utils.NewSimpleString(fmt.Sprintf("FULLRESYNC %s %d", replication.replID, replication.offset)), utils.RESP2)
+	links := make([]*replicaLink, 0, len(bgsaveWaiting))
+	for _, c := range bgsaveWaiting {
+		link := registerReplica(c)
+		link.sendingSnapshot = true
+		links = append(links, link)
+	}
+	bgsaveWaiting = nil
+	if len(links) > 0 {
+		requestAcks(config)
+	}
+
+	rdb.bgsaveInProgress = true
+	rdb.bgsaveScheduled = false
+	rdb.dirtyBeforeBgsave = rdb.dirty
+	rdb.lastBgsaveTry = time.Now()
+	log.Printf("Background saving started")
+
+	go func() {
+		err := utils.SaveRDBSnapshot(dir, fileName, snapshot)
+		if len(links) > 0 {
+			sendDumpFile(links, fullResync, filepath.Join(dir, fileName), err)
+		}
+
+		keyspaceMu.Lock()
+		defer keyspaceMu.Unlock()
+
+		rdb.bgsaveInProgress = false
+		if err != nil {
+			rdb.lastBgsaveStatus = "err"
+			log.Printf("Background saving error: %v", err)
+			return
+		}
+		rdb.lastBgsaveStatus = "ok"
+		rdb.dirty -= rdb.dirtyBeforeBgsave
+		rdb.lastSave = time.Now()
+		log.Printf("Background saving terminated with success")
+	}()
+}
+
+// sendDumpFile lets the replicas write the dump file the BGSAVE saved, a
+// failed save disconnects them so they try again
+func sendDumpFile(links []*replicaLink, fullResync []byte, path string, err error) {
+	var dump []byte
+	if err == nil {
+		dump, err = os.ReadFile(path)
+	}
+	if err != nil {
+		log.Printf("Can't full sync %d replicas from the dump file: %v", len(links), err)
+		for _, link := range links {
+			link.client.Conn.Close()
+		}
+		return
+	}
+
+	for _, link := range links {
+		link.preamble = [][]byte{fullResync, utils.EncodeBulkPayload(dump)}
+		go link.writeLoop()
+	}
+}
+
+// persistenceCron starts the saves due to the save points, and those
+// scheduled while another one was running
+func persistenceCron(config *configuration.AppSettings) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		keyspaceMu.Lock()
+		runPersistenceJobs(config)
+		keyspaceMu.Unlock()
+	}
+}
+
+// runPersistenceJobs runs at most one of BGSAVE and the AOF rewrite at a
+// time, both write the whole dataset. The caller holds keyspaceMu.
+func runPersistenceJobs(config *configuration.AppSettings) {
+	if rdb.bgsaveInProgress || aofRewriting() {
+		return
+	}
+
+	if rdb.aofRewriteScheduled {
+		rdb.aofRewriteScheduled = false
+		aofMu.Lock()
+		if aof != nil {
+			if err := startAOFRewrite(config); err != nil {
+				log.Printf("Can't rewrite append only file in background: %v", err)
+			}
+		}
+		aofMu.Unlock()
+		return
+	}
+
+	replicationMu.Lock()
+	defer replicationMu.Unlock()
+
+	if rdb.bgsaveScheduled {
+		startBgsave(config)
+		return
+	}
+
+	//? After a failure the save points wait before trying again
+	if rdb.lastBgsaveStatus != "ok" && time.Since(rdb.lastBgsaveTry) < bgsaveRetryDelay {
+		return
+	}
+	for _, point := range config.SaveParams {
+		elapsed := time.Since(rdb.lastSave)
+		if rdb.dirty >= int64(point.Changes) && elapsed >= time.Duration(point.Seconds)*time.Second {
+			log.Printf("%d changes in %d seconds. Saving...", point.Changes, point.Seconds)
+			startBgsave(config)
+			return
+		}
+	}
+}
+
+// rdbInfo is the RDB part of the Persistence section of INFO. The caller
+// holds keyspaceMu.
+func rdbInfo() []string {
+	inProgress := 0
+	if rdb.bgsaveInProgress {
+		inProgress = 1
+	}
+	return []string{
+		fmt.Sprintf("rdb_changes_since_last_save:%d", rdb.dirty),
+		fmt.Sprintf("rdb_bgsave_in_progress:%d", inProgress),
+		fmt.Sprintf("rdb_last_save_time:%d", rdb.lastSave.Unix()),
+		"rdb_last_bgsave_status:" + rdb.lastBgsaveStatus,
+	}
+}
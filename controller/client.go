@@ -0,0 +1,144 @@
+package controller
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	configuration "github.com/oussamasf/yuji/config"
+	"github.com/oussamasf/yuji/service/tcp"
+	"github.com/oussamasf/yuji/utils"
+)
+
+// ? Pub/Sub messages, and subscription confirmations, waiting to be written to
+// ? a subscriber, a subscriber that falls further behind than this is
+// ? disconnected instead of slowing publishers
+const pubsubOutboxSize = 4096
+
+var nextClientID atomic.Int64
+
+// Client holds the state attached to a single client connection.
+type Client struct {
+	ID     int64
+	Name   string
+	Conn   net.Conn
+	Config *configuration.AppSettings
+	Tx     configuration.TransactionSettings
+	//? RESP version negotiated with HELLO, replies are encoded accordingly
+	Protocol      int
+	Authenticated bool
+	//? Set by QUIT, the connection is closed once the reply is written
+	CloseAfterReply bool
+
+	Channels      map[string]struct{}
+	Patterns      map[string]struct{}
+	ShardChannels map[string]struct{}
+	outbox        chan []configuration.RESPValue
+	//? Entries of the outbox not written yet, replies go through the outbox
+	//? too meanwhile so they don't overtake the confirmations queued there
+	outboxPending atomic.Int64
+
+	//? Writes of the running command to send to replicas, see propagate
+	propagation []propagatedCommand
+	//? Replication offset right after the last write of the client, for WAIT
+	replOffset int64
+	//? AOF offset right after the last write of the client, for WAITAOF
+	aofOffset int64
+	//? On the link to our master, the raw stream applied but not forwarded to
+	//? the sub-replicas yet
+	replStream []byte
+	//? Set once the connection is a replica streaming from this server
+	replica *replicaLink
+	//? The replica announced it can read a snapshot with EOF framing
+	replicaCapaEOF bool
+	//? Address the replica announced with REPLCONF, listed by INFO and ROLE
+	replicaListeningPort int
+	replicaAnnouncedIP   string
+	//? Set on the client that applies the stream received from the master
+	isMasterLink bool
+	//? Set on the client that replays the AOF at startup
+	isAOFLoader bool
+	//? Set while WAIT blocks the client, its reply arrives there and the
+	//? following commands are read only once it is written
+	blocked chan configuration.RESPValue
+
+	writeMu sync.Mutex
+}
+
+func NewClient(conn net.Conn, config *configuration.AppSettings) *Client {
+	return &Client{
+		ID:     nextClientID.Add(1),
+		Conn:   conn,
+		Config: config,
+		Tx: configuration.TransactionSettings{
+			InvokedTx: false,
+		},
+		Protocol:      utils.RESP2,
+		Authenticated: config.RequirePass == "",
+		Channels:      make(map[string]struct{}),
+		Patterns:      make(map[string]struct{}),
+		ShardChannels: make(map[string]struct{}),
+		outbox:        make(chan []configuration.RESPValue, pubsubOutboxSize),
+	}
+}
+
+// WriteValue sends a reply encoded with the client's protocol version, it is
+// safe to call from other goroutines.
+func (c *Client) WriteValue(value configuration.RESPValue) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return tcp.WriteValue(c.Conn, value, c.Protocol)
+}
+
+// SubscriptionCount is the number of channels and patterns the client listens
+// to, shard channels are counted on their own.
+func (c *Client) SubscriptionCount() int {
+	return len(c.Channels) + len(c.Patterns)
+}
+
+// InSubscriberMode reports whether the client has any kind of subscription.
+func (c *Client) InSubscriberMode() bool {
+	return c.SubscriptionCount()+len(c.ShardChannels) > 0
+}
+
+// writeReply sends the reply to a command from the connection's own
+// goroutine, after what is still queued in the outbox.
+func (c *Client) writeReply(reply configuration.RESPValue) {
+	if c.outboxPending.Load() > 0 {
+		c.outboxPending.Add(1)
+		c.outbox <- []configuration.RESPValue{reply}
+		return
+	}
+	c.WriteValue(reply)
+}
+
+// deliverMessages writes queued Pub/Sub messages until the outbox is closed.
+func (c *Client) deliverMessages() {
+	for messages := range c.outbox {
+		for _, message := range messages {
+			if err := c.WriteValue(message); err != nil {
+				c.Conn.Close()
+				break
+			}
+		}
+		c.outboxPending.Add(-1)
+	}
+}
+
+// propagate queues a write for the replicas, it is sent once the command, or
+// the whole transaction, has run. Handlers pass the effect of the command
+// rather than the command itself when they differ, e.g. an absolute expiry.
+func (c *Client) propagate(args ...string) {
+	c.propagation = append(c.propagation, propagatedCommand{args: args})
+}
+
+// propagateToReplicas queues a command the replicas run without it being a
+// write: it is neither logged in the AOF nor counted by the save points
+func (c *Client) propagateToReplicas(args ...string) {
+	c.propagation = append(c.propagation, propagatedCommand{args: args, replicaOnly: true})
+}
+
+type propagatedCommand struct {
+	args        []string
+	replicaOnly bool
+}
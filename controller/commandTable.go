@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	configuration "github.com/oussamasf/yuji/config"
+)
+
+type commandHandler func(c *Client, args []configuration.RESPValue) configuration.RESPValue
+
+type command struct {
+	//? Redis style arity: a positive value is the exact number of arguments
+	//? (command name included), a negative one is the minimum
+	Arity   int
+	Flags   int
+	Handler commandHandler
+}
+
+const (
+	//? MULTI, EXEC and DISCARD run right away even inside a transaction
+	flagTxControl = 1 << iota
+	//? Allowed before the client authenticated
+	flagNoAuth
+	//? Allowed while a RESP2 client is in subscriber mode
+	flagPubSub
+	//? Refused inside MULTI
+	flagNoMulti
+	//? Modifies the keyspace, refused by a read only replica
+	flagWrite
+)
+
+var commandTable map[string]command
+
+func init() {
+	commandTable = map[string]command{
+		"multi":     {Arity: 1, Flags: flagTxControl, Handler: multiCommand},
+		"exec":      {Arity: 1, Flags: flagTxControl, Handler: execCommand},
+		"discard":   {Arity: 1, Flags: flagTxControl, Handler: discardCommand},
+		"hello":     {Arity: -1, Flags: flagNoAuth, Handler: helloCommand},
+		"auth":      {Arity: -2, Flags: flagNoAuth, Handler: authCommand},
+		"ping":      {Arity: -1, Flags: flagPubSub, Handler: pingCommand},
+		"quit":      {Arity: -1, Flags: flagNoAuth | flagPubSub, Handler: quitCommand},
+		"echo":      {Arity: -2, Handler: echoCommand},
+		"save":      {Arity: 1, Handler: saveCommand},
+		"type":      {Arity: 2, Handler: typeCommand},
+		"keys":      {Arity: -1, Handler: keysCommand},
+		"config":    {Arity: -3, Handler: configCommand},
+		"info":      {Arity: -1, Handler: infoCommand},
+		"replconf":  {Arity: -1, Handler: replconfCommand},
+		"psync":     {Arity: -3, Handler: psyncCommand},
+		"replicaof": {Arity: 3, Flags: flagNoMulti, Handler: replicaofCommand},
+		"slaveof":   {Arity: 3, Flags: flagNoMulti, Handler: replicaofCommand},
+		"wait":      {Arity: 3, Handler: waitCommand},
+		"waitaof":   {Arity: 4, Handler: waitaofCommand},
+		"role":      {Arity: 1, Handler: roleCommand},
+		"failover":  {Arity: -1, Flags: flagNoMulti, Handler: failoverCommand},
+		"set":       {Arity: -3, Flags: flagWrite, Handler: setCommand},
+		"del":       {Arity: -2, Flags: flagWrite, Handler: delCommand},
+		"get":       {Arity: 2, Handler: getCommand},
+		"incr":      {Arity: 2, Flags: flagWrite, Handler: incrCommand},
+		"xadd":      {Arity: -5, Flags: flagWrite, Handler: xaddCommand},
+		"xread":     {Arity: -4, Handler: xreadCommand},
+		"xrange":    {Arity: 4, Handler: xrangeCommand},
+		"xinfo":     {Arity: -3, Handler: xinfoCommand},
+
+		"bgsave":       {Arity: -1, Handler: bgsaveCommand},
+		"lastsave":     {Arity: 1, Handler: lastsaveCommand},
+		"bgrewriteaof": {Arity: 1, Handler: bgrewriteaofCommand},
+
+		"subscribe":    {Arity: -2, Flags: flagPubSub | flagNoMulti, Handler: subscribeCommand},
+		"unsubscribe":  {Arity: -1, Flags: flagPubSub | flagNoMulti, Handler: unsubscribeCommand},
+		"psubscribe":   {Arity: -2, Flags: flagPubSub | flagNoMulti, Handler: psubscribeCommand},
+		"punsubscribe": {Arity: -1, Flags: flagPubSub | flagNoMulti, Handler: punsubscribeCommand},
+		"ssubscribe":   {Arity: -2, Flags: flagPubSub | flagNoMulti, Handler: ssubscribeCommand},
+		"sunsubscribe": {Arity: -1, Flags: flagPubSub | flagNoMulti, Handler: sunsubscribeCommand},
+		"publish":      {Arity: 3, Handler: publishCommand},
+		"spublish":     {Arity: 3, Handler: spublishCommand},
+		"pubsub":       {Arity: -2, Handler: pubsubCommand},
+	}
+}
+
+// lookupCommand resolves a command and checks its arity, the error it
+// returns is the one that should be sent back to the client as is.
+func lookupCommand(cmdName string, args []configuration.RESPValue) (command, error) {
+	cmd, ok := commandTable[cmdName]
+	if !ok {
+		return command{}, fmt.Errorf("ERR unknown command '%s', with args beginning with: %s", cmdName, formatArgsPreview(args[1:]))
+	}
+
+	if (cmd.Arity > 0 && len(args) != cmd.Arity) || (cmd.Arity < 0 && len(args) < -cmd.Arity) {
+		return command{}, fmt.Errorf("ERR wrong number of arguments for '%s' command", cmdName)
+	}
+
+	return cmd, nil
+}
+
+func formatArgsPreview(args []configuration.RESPValue) string {
+	var builder strings.Builder
+	for _, arg := range args {
+		value, _ := arg.Value.(string)
+		//? Arguments are binary safe, the preview goes in a single line reply
+		value = strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+		builder.WriteString(fmt.Sprintf("'%s' ", value))
+	}
+	return builder.String()
+}
@@ -27,49 +27,52 @@ func parseTypeArgs(args []configuration.RESPValue) (string, error) {
 	return key, nil
 }
 
-func ParseIncrArgs(args []configuration.RESPValue, cache map[string]configuration.ICache) (string, error) {
+func ParseIncrArgs(args []configuration.RESPValue, cache map[string]configuration.ICache) (int64, error) {
 	if len(args) != 2 {
-		return "", fmt.Errorf("ERROR: INVALID_NUMBER_OF_ARGUMENTS")
+		return 0, fmt.Errorf("ERROR: INVALID_NUMBER_OF_ARGUMENTS")
 	}
 	key, ok := args[1].Value.(string)
 	if !ok {
-		return "", fmt.Errorf("ERROR: INVALID_ARGUMENT_TYPE")
+		return 0, fmt.Errorf("ERROR: INVALID_ARGUMENT_TYPE")
 	}
+	var intValue int64
 	result, exists := cache[key]
-	if !exists {
-		cache[key] = configuration.ICache{
-			Data: "1",
-		}
-	} else {
-		intValue, err := strconv.Atoi(result.Data)
+	if exists {
+		parsed, err := strconv.ParseInt(result.Data, 10, 64)
 		if err != nil {
-			return "", fmt.Errorf("ERROR: CANNOT_INCR_NOT_INT")
-		}
-		cache[key] = configuration.ICache{
-			Data: strconv.Itoa(intValue + 1),
+			return 0, fmt.Errorf("ERROR: CANNOT_INCR_NOT_INT")
 		}
+		intValue = parsed
+	}
 
+	//? The key keeps its time to live
+	cache[key] = configuration.ICache{
+		Data:          strconv.FormatInt(intValue+1, 10),
+		Type:          configuration.String,
+		ExpirationMap: result.ExpirationMap,
 	}
 
-	return cache[key].Data, nil
+	return intValue + 1, nil
 }
 
 // ? GET
-func parseGetArgs(args []configuration.RESPValue, cache map[string]configuration.ICache) (string, error) {
+func parseGetArgs(args []configuration.RESPValue, config *configuration.AppSettings) (string, bool, error) {
 
 	if len(args) != 2 {
-		return "", fmt.Errorf("ERROR: INVALID_NUMBER_OF_ARGUMENTS")
+		return "", false, fmt.Errorf("ERROR: INVALID_NUMBER_OF_ARGUMENTS")
 	}
 	key, ok := args[1].Value.(string)
 	if !ok {
-		return "", fmt.Errorf("ERROR: INVALID_ARGUMENT_TYPE")
+		return "", false, fmt.Errorf("ERROR: INVALID_ARGUMENT_TYPE")
 	}
-	result := cache[key]
-	return result.Data, nil
+	result, exists := lookupKey(config, key)
+	return result.Data, exists, nil
 }
 
 // ? SET
-func parseSetArgs(args []configuration.RESPValue, cache map[string]configuration.ICache) (string, error) {
+func parseSetArgs(args []configuration.RESPValue, config *configuration.AppSettings) (string, error) {
+	cache := config.RedisMap
+
 	if len(args) < 3 {
 		return "", fmt.Errorf("ERROR: INVALID_NUMBER_OF_ARGUMENTS")
 	}
@@ -84,54 +87,37 @@ func parseSetArgs(args []configuration.RESPValue, cache map[string]configuration
 		return "", fmt.Errorf("ERROR: INVALID_ARGUMENT_TYPE")
 	}
 
-	cache[key] = configuration.ICache{
-		Data: value,
-		Type: configuration.CacheDataType(1),
-	}
-
+	var expireAt int64
 	if len(args) > 4 {
-		if strings.ToLower(args[3].Value.(string)) == "px" {
-			expiry, err := strconv.Atoi(args[4].Value.(string))
-			cache[key] = configuration.ICache{ExpirationMap: fmt.Sprintf("%d", expiry)}
-			if err != nil {
-				return "", fmt.Errorf("ERROR: INVALID_PX")
-			}
-			time.AfterFunc(time.Duration(expiry)*time.Millisecond, func() {
-				delete(cache, key)
-			})
-		} else {
+		expiry, err := strconv.ParseInt(args[4].Value.(string), 10, 64)
+		if err != nil || expiry <= 0 {
+			return "", fmt.Errorf("ERR invalid expire time in 'set' command")
+		}
+
+		switch strings.ToLower(args[3].Value.(string)) {
+		case "px":
+			expireAt = time.Now().UnixMilli() + expiry
+		case "ex":
+			expireAt = time.Now().UnixMilli() + expiry*1000
+		case "pxat":
+			expireAt = expiry
+		case "exat":
+			expireAt = expiry * 1000
+		default:
 			return "", fmt.Errorf("ERROR: INVALID_ARGUMENT")
 		}
 	}
 
-	return "OK", nil
-}
-
-func parseConfigArgs(args []configuration.RESPValue, dir string, db string) ([]string, error) {
-	subcommand, ok := args[1].Value.(string)
-	subcommand = strings.ToLower(subcommand)
-	if !ok && subcommand != "get" {
-		return []string{}, fmt.Errorf("ERR INVALID_ARGUMENT_TYPE")
-
+	cache[key] = configuration.ICache{
+		Data: value,
+		Type: configuration.String,
 	}
 
-	value, ok := args[2].Value.(string)
-	value = strings.ToLower(value)
-
-	if !ok {
-		return []string{}, fmt.Errorf("ERR INVALID_ARGUMENT_TYPE")
+	if expireAt > 0 {
+		setExpire(config, key, expireAt)
 	}
 
-	if value == "dir" {
-		return []string{"dir", fmt.Sprint(len(dir)), dir}, nil
-
-	} else if value == "dbfilename" {
-		return []string{"dbfilename", fmt.Sprint(len(db)), db}, nil
-
-	} else {
-		return []string{}, fmt.Errorf("ERR unsupported CONFIG parameter")
-
-	}
+	return "OK", nil
 }
 
 func parseEchoArgs(args []configuration.RESPValue) string {
@@ -224,29 +210,33 @@ func parseReadStreamArgs(args []configuration.RESPValue) ([]string, []string, bo
 	return ids, streamKeys, blockRequested, blockTime, nil
 }
 
-func generateReadStreamEntries(id string, entries []configuration.StreamEntry) []string {
-	streamResult := []string{}
+func generateReadStreamEntries(id string, entries []configuration.StreamEntry) []configuration.RESPValue {
+	streamResult := []configuration.RESPValue{}
 
 	for _, entry := range entries {
 		if utils.CompareIDs(entry.ID, id) > 0 {
-			values := []string{}
-			for key, value := range entry.Values {
-				values = append(values, fmt.Sprintf("$%d\r\n%s\r\n", len(key), key), fmt.Sprintf("$%d\r\n%s\r\n", len(value), value))
-			}
-
-			entryResp := fmt.Sprintf("*%d\r\n$%d\r\n%s\r\n*%d\r\n%s", 2, len(entry.ID), entry.ID, len(values)/2, strings.Join(values, ""))
-			streamResult = append(streamResult, entryResp)
+			streamResult = append(streamResult, streamEntryValue(entry))
 		}
 	}
 	return streamResult
 
 }
 
-func generateReadStreamResponse(ids []string, streamKeys []string, config *configuration.AppSettings) []string {
-	results := []string{}
+// streamEntryValue builds the [id, [field, value, ...]] pair used by XREAD and XRANGE
+func streamEntryValue(entry configuration.StreamEntry) configuration.RESPValue {
+	values := []string{}
+	for key, value := range entry.Values {
+		values = append(values, key, value)
+	}
+
+	return utils.NewArray(utils.NewBulkString(entry.ID), utils.NewBulkStringArray(values))
+}
+
+func generateReadStreamResponse(ids []string, streamKeys []string, config *configuration.AppSettings) []configuration.RESPValue {
+	results := []configuration.RESPValue{}
 	for i, streamKey := range streamKeys {
 		//? Check if the stream exists
-		stream, ok := config.RedisMap[streamKey]
+		stream, ok := lookupKey(config, streamKey)
 		if !ok {
 			continue
 		}
@@ -255,8 +245,7 @@ func generateReadStreamResponse(ids []string, streamKeys []string, config *confi
 
 		//? Wrap the stream key and its entries
 		if len(streamResult) > 0 {
-			keyResp := fmt.Sprintf("*2\r\n$%d\r\n%s\r\n*%d\r\n%s", len(streamKey), streamKey, len(streamResult), strings.Join(streamResult, ""))
-			results = append(results, keyResp)
+			results = append(results, utils.NewArray(utils.NewBulkString(streamKey), utils.NewArray(streamResult...)))
 		}
 	}
 	return results
@@ -0,0 +1,382 @@
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	configuration "github.com/oussamasf/yuji/config"
+	"github.com/oussamasf/yuji/utils"
+)
+
+type configParameter struct {
+	Get func(config *configuration.AppSettings) string
+	//? Nil for parameters that can only be set at startup
+	Set func(config *configuration.AppSettings, value string) error
+}
+
+var configParameters = map[string]configParameter{
+	"dir": {
+		Get: func(config *configuration.AppSettings) string { return config.Dir },
+	},
+	"dbfilename": {
+		Get: func(config *configuration.AppSettings) string { return config.DBFileName },
+		Set: func(config *configuration.AppSettings, value string) error {
+			if strings.ContainsAny(value, "/\\") {
+				return fmt.Errorf("dbfilename can't be a path, just a filename")
+			}
+			config.DBFileName = value
+			return nil
+		},
+	},
+	"save": {
+		Get: func(config *configuration.AppSettings) string {
+			points := []string{}
+			for _, point := range config.SaveParams {
+				points = append(points, fmt.Sprintf("%d %d", point.Seconds, point.Changes))
+			}
+			return strings.Join(points, " ")
+		},
+		Set: func(config *configuration.AppSettings, value string) error {
+			//? <seconds> <changes>, repeated, an empty value disables saving
+			fields := strings.Fields(value)
+			if len(fields)%2 != 0 {
+				return fmt.Errorf("Invalid save parameters")
+			}
+			points := []configuration.SaveParam{}
+			for i := 0; i < len(fields); i += 2 {
+				seconds, err := strconv.Atoi(fields[i])
+				if err != nil || seconds < 1 {
+					return fmt.Errorf("Invalid save parameters")
+				}
+				changes, err := strconv.Atoi(fields[i+1])
+				if err != nil || changes < 0 {
+					return fmt.Errorf("Invalid save parameters")
+				}
+				points = append(points, configuration.SaveParam{Seconds: seconds, Changes: changes})
+			}
+			config.SaveParams = points
+			return nil
+		},
+	},
+	"notify-keyspace-events": {
+		Get: func(config *configuration.AppSettings) string {
+			return formatNotifyKeyspaceEvents(config.NotifyKeyspaceEvents)
+		},
+		Set: func(config *configuration.AppSettings, value string) error {
+			mask, err := parseNotifyKeyspaceEvents(value)
+			if err != nil {
+				return err
+			}
+			config.NotifyKeyspaceEvents = mask
+			return nil
+		},
+	},
+	"repl-backlog-size": {
+		Get: func(config *configuration.AppSettings) string { return strconv.Itoa(config.ReplBacklogSize) },
+		Set: func(config *configuration.AppSettings, value string) error {
+			size, err := parseMemory(value)
+			if err != nil {
+				return err
+			}
+			//? Same lower bound as Redis
+			size = max(size, 16*1024)
+			config.ReplBacklogSize = size
+			resizeReplicationBacklog(size)
+			return nil
+		},
+	},
+	"replica-read-only": {
+		Get: func(config *configuration.AppSettings) string { return formatYesNo(config.ReplicaReadOnly) },
+		Set: func(config *configuration.AppSettings, value string) error {
+			readOnly, err := parseYesNo(value)
+			if err != nil {
+				return err
+			}
+			config.ReplicaReadOnly = readOnly
+			return nil
+		},
+	},
+	"repl-diskless-sync": {
+		Get: func(config *configuration.AppSettings) string { return formatYesNo(config.ReplDisklessSync) },
+		Set: func(config *configuration.AppSettings, value string) error {
+			diskless, err := parseYesNo(value)
+			if err != nil {
+				return err
+			}
+			config.ReplDisklessSync = diskless
+			return nil
+		},
+	},
+	"repl-diskless-sync-delay": {
+		Get: func(config *configuration.AppSettings) string { return strconv.Itoa(config.ReplDisklessSyncDelay) },
+		Set: func(config *configuration.AppSettings, value string) error {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds < 0 {
+				return fmt.Errorf("argument must be between 0 and 2147483647 inclusive")
+			}
+			config.ReplDisklessSyncDelay = seconds
+			return nil
+		},
+	},
+	"repl-timeout": {
+		Get: func(config *configuration.AppSettings) string { return strconv.Itoa(config.ReplTimeout) },
+		Set: func(config *configuration.AppSettings, value string) error {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds <= 0 {
+				return fmt.Errorf("argument must be between 1 and 2147483647 inclusive")
+			}
+			config.ReplTimeout = seconds
+			return nil
+		},
+	},
+	"sentinel-down-after-milliseconds": {
+		Get: func(config *configuration.AppSettings) string { return strconv.Itoa(config.SentinelDownAfter) },
+		Set: func(config *configuration.AppSettings, value string) error {
+			milliseconds, err := strconv.Atoi(value)
+			if err != nil || milliseconds <= 0 {
+				return fmt.Errorf("argument must be between 1 and 2147483647 inclusive")
+			}
+			//? Applies to the masters monitored from then on
+			config.SentinelDownAfter = milliseconds
+			return nil
+		},
+	},
+	"sentinel-failover-timeout": {
+		Get: func(config *configuration.AppSettings) string { return strconv.Itoa(config.SentinelFailoverTimeout) },
+		Set: func(config *configuration.AppSettings, value string) error {
+			milliseconds, err := strconv.Atoi(value)
+			if err != nil || milliseconds <= 0 {
+				return fmt.Errorf("argument must be between 1 and 2147483647 inclusive")
+			}
+			config.SentinelFailoverTimeout = milliseconds
+			return nil
+		},
+	},
+	"appendonly": {
+		Get: func(config *configuration.AppSettings) string { return formatYesNo(config.AppendOnly) },
+		Set: func(config *configuration.AppSettings, value string) error {
+			enabled, err := parseYesNo(value)
+			if err != nil {
+				return err
+			}
+			if enabled == config.AppendOnly {
+				return nil
+			}
+			config.AppendOnly = enabled
+			//? At startup LoadDataset opens the AOF once the dataset is loaded
+			if !datasetLoaded {
+				return nil
+			}
+			if !enabled {
+				stopAppendOnly()
+				return nil
+			}
+			if err := startAppendOnly(config, true); err != nil {
+				config.AppendOnly = false
+				return err
+			}
+			return nil
+		},
+	},
+	"appendfsync": {
+		Get: func(config *configuration.AppSettings) string { return config.AppendFsync },
+		Set: func(config *configuration.AppSettings, value string) error {
+			policy := strings.ToLower(value)
+			if policy != "always" && policy != "everysec" && policy != "no" {
+				return fmt.Errorf("argument(s) must be one of the following: always, everysec, no")
+			}
+			config.AppendFsync = policy
+			setAppendFsync(policy)
+			return nil
+		},
+	},
+	"appendfilename": {
+		Get: func(config *configuration.AppSettings) string { return config.AppendFilename },
+	},
+	"appenddirname": {
+		Get: func(config *configuration.AppSettings) string { return config.AppendDirname },
+	},
+	"aof-use-rdb-preamble": {
+		Get: func(config *configuration.AppSettings) string { return formatYesNo(config.AOFUseRDBPreamble) },
+		Set: func(config *configuration.AppSettings, value string) error {
+			preamble, err := parseYesNo(value)
+			if err != nil {
+				return err
+			}
+			config.AOFUseRDBPreamble = preamble
+			return nil
+		},
+	},
+	"auto-aof-rewrite-percentage": {
+		Get: func(config *configuration.AppSettings) string { return strconv.Itoa(config.AutoAOFRewritePercentage) },
+		Set: func(config *configuration.AppSettings, value string) error {
+			percentage, err := strconv.Atoi(value)
+			if err != nil || percentage < 0 {
+				return fmt.Errorf("argument must be between 0 and 2147483647 inclusive")
+			}
+			config.AutoAOFRewritePercentage = percentage
+			return nil
+		},
+	},
+	"auto-aof-rewrite-min-size": {
+		Get: func(config *configuration.AppSettings) string { return strconv.Itoa(config.AutoAOFRewriteMinSize) },
+		Set: func(config *configuration.AppSettings, value string) error {
+			size, err := parseMemory(value)
+			if err != nil {
+				return err
+			}
+			config.AutoAOFRewriteMinSize = size
+			return nil
+		},
+	},
+	"aof-load-truncated": {
+		Get: func(config *configuration.AppSettings) string { return formatYesNo(config.AOFLoadTruncated) },
+		Set: func(config *configuration.AppSettings, value string) error {
+			truncated, err := parseYesNo(value)
+			if err != nil {
+				return err
+			}
+			config.AOFLoadTruncated = truncated
+			return nil
+		},
+	},
+	"client-output-buffer-limit": {
+		Get: func(config *configuration.AppSettings) string {
+			limit := config.ReplicaOutputBufferLimit
+			return fmt.Sprintf("replica %d %d %d", limit.Hard, limit.Soft, limit.SoftSeconds)
+		},
+		Set: func(config *configuration.AppSettings, value string) error {
+			//? <class> <hard> <soft> <soft seconds>, repeated. Output buffers
+			//? are only bounded for replicas
+			fields := strings.Fields(value)
+			if len(fields)%4 != 0 {
+				return fmt.Errorf("wrong number of arguments in buffer limit configuration")
+			}
+			for i := 0; i < len(fields); i += 4 {
+				class := strings.ToLower(fields[i])
+				if class != "replica" && class != "slave" {
+					return fmt.Errorf("invalid client class specified in buffer limit configuration")
+				}
+				hard, err := parseMemory(fields[i+1])
+				if err != nil {
+					return err
+				}
+				soft, err := parseMemory(fields[i+2])
+				if err != nil {
+					return err
+				}
+				seconds, err := strconv.Atoi(fields[i+3])
+				if err != nil || seconds < 0 {
+					return fmt.Errorf("error in soft limit seconds")
+				}
+				config.ReplicaOutputBufferLimit = configuration.OutputBufferLimit{Hard: hard, Soft: soft, SoftSeconds: seconds}
+			}
+			return nil
+		},
+	},
+}
+
+// SetConfigParameter applies a configuration parameter, it is used both by
+// CONFIG SET and to apply command line flags at startup.
+func SetConfigParameter(config *configuration.AppSettings, name string, value string) error {
+	parameter, ok := configParameters[strings.ToLower(name)]
+	if !ok || parameter.Set == nil {
+		return fmt.Errorf("Unknown option or number of arguments for CONFIG SET - '%s'", name)
+	}
+	return parameter.Set(config, value)
+}
+
+// ? CONFIG GET parameter [parameter ...] | CONFIG SET parameter value [parameter value ...]
+func configCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	subcommand, _ := args[1].Value.(string)
+
+	switch strings.ToLower(subcommand) {
+	case "get":
+		//? parameter/value pairs, a map for RESP3 clients
+		names := []string{}
+		for _, pattern := range argsToStrings(args[2:]) {
+			for name := range configParameters {
+				if utils.GlobMatch(strings.ToLower(pattern), name) && !containsString(names, name) {
+					names = append(names, name)
+				}
+			}
+		}
+		sort.Strings(names)
+
+		pairs := []configuration.RESPValue{}
+		for _, name := range names {
+			pairs = append(pairs, utils.NewBulkString(name), utils.NewBulkString(configParameters[name].Get(c.Config)))
+		}
+		return utils.NewMap(pairs...)
+
+	case "set":
+		if len(args) < 4 || len(args)%2 != 0 {
+			return utils.NewError("ERR wrong number of arguments for 'config|set' command")
+		}
+		for i := 2; i < len(args); i += 2 {
+			name, _ := args[i].Value.(string)
+			value, _ := args[i+1].Value.(string)
+			if err := SetConfigParameter(c.Config, name, value); err != nil {
+				return utils.NewError(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - %v", name, err))
+			}
+		}
+		return utils.NewSimpleString(utils.OK)
+	}
+
+	return utils.NewError(fmt.Sprintf("ERR unknown subcommand '%s'. Try CONFIG HELP.", subcommand))
+}
+
+func parseYesNo(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("argument must be 'yes' or 'no'")
+}
+
+func formatYesNo(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "no"
+}
+
+// parseMemory reads a size such as 1048576, 512kb or 1mb
+func parseMemory(value string) (int, error) {
+	units := []struct {
+		suffix     string
+		multiplier int
+	}{
+		{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10},
+		{"g", 1000 * 1000 * 1000}, {"m", 1000 * 1000}, {"k", 1000}, {"b", 1},
+	}
+
+	lower := strings.ToLower(value)
+	multiplier := 1
+	for _, unit := range units {
+		if strings.HasSuffix(lower, unit.suffix) {
+			lower = strings.TrimSuffix(lower, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	n, err := strconv.Atoi(lower)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("argument must be a memory value")
+	}
+	return n * multiplier, nil
+}
+
+func containsString(values []string, target string) bool {
+	for _, value := range values {
+		if value == target {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package controller
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	configuration "github.com/oussamasf/yuji/config"
+	"github.com/oussamasf/yuji/utils"
+)
+
+// ? Replicas waiting for the next diskless snapshot, guarded by replicationMu
+var disklessWaiting = []*Client{}
+
+// queueDisklessSync makes the replica wait for repl-diskless-sync-delay, the
+// replicas arriving meanwhile share the same snapshot. The caller holds
+// replicationMu.
+func queueDisklessSync(c *Client) {
+	disklessWaiting = append(disklessWaiting, c)
+	if len(disklessWaiting) > 1 {
+		return
+	}
+
+	delay := time.Duration(c.Config.ReplDisklessSyncDelay) * time.Second
+	time.AfterFunc(delay, func() {
+		startDisklessSync(c.Config)
+	})
+}
+
+// startDisklessSync takes the snapshot for every waiting replica and streams
+// it to their sockets, their replication stream is queued in the meantime
+func startDisklessSync(config *configuration.AppSettings) {
+	keyspaceMu.Lock()
+	replicationMu.Lock()
+
+	waiting := disklessWaiting
+	disklessWaiting = nil
+
+	snapshot := copyKeyspace(config.RedisMap)
+
+	//? Written with the snapshot, a slow replica doesn't hold the locks
+	fullResync := utils.EncodeValue(utils.NewSimpleString(fmt.Sprintf("FULLRESYNC %s %d", replication.replID, replication.offset)), utils.RESP2)
+	links := make([]*replicaLink, 0, len(waiting))
+	for _, c := range waiting {
+		link := registerReplica(c)
+		link.preamble = [][]byte{fullResync}
+		link.sendingSnapshot = true
+		links = append(links, link)
+	}
+	if len(links) > 0 {
+		requestAcks(config)
+	}
+
+	replicationMu.Unlock()
+	keyspaceMu.Unlock()
+
+	if len(links) > 0 {
+		go transferSnapshot(links, snapshot)
+	}
+}
+
+// transferSnapshot writes the preamble then the RDB with EOF framing, then
+// lets the replicas that received it start streaming
+func transferSnapshot(links []*replicaLink, snapshot map[string]configuration.ICache) {
+	//? Any 40 random characters will do as a mark
+	mark := newReplicationID()
+
+	out := &snapshotFanout{}
+	for _, link := range links {
+		if err := link.writePreamble(); err != nil {
+			log.Printf("Error sending snapshot to replica %s: %v", link.client.Conn.RemoteAddr(), err)
+			link.client.Conn.Close()
+			continue
+		}
+		out.links = append(out.links, link)
+	}
+	fmt.Fprintf(out, "$EOF:%s\r\n", mark)
+	utils.WriteRDB(out, snapshot)
+	out.Write([]byte(mark))
+
+	log.Printf("Diskless sync: snapshot of %d keys sent to %d replicas", len(snapshot), len(out.links))
+	for _, link := range links {
+		link.syncDone()
+	}
+	for _, link := range out.links {
+		go link.writeLoop()
+	}
+}
+
+// snapshotFanout writes the same snapshot to several replicas, one that fails
+// is disconnected without stopping the transfer to the others
+type snapshotFanout struct {
+	links []*replicaLink
+}
+
+func (out *snapshotFanout) Write(p []byte) (int, error) {
+	alive := out.links[:0]
+	for _, link := range out.links {
+		if err := link.writeSnapshot(p); err != nil {
+			log.Printf("Error sending snapshot to replica %s: %v", link.client.Conn.RemoteAddr(), err)
+			link.client.Conn.Close()
+			continue
+		}
+		alive = append(alive, link)
+	}
+	out.links = alive
+
+	if len(alive) == 0 {
+		return 0, fmt.Errorf("no replica left to send the snapshot to")
+	}
+	return len(p), nil
+}
+
+// copyKeyspace takes a point in time view of the dataset: values are replaced
+// rather than modified and stream entries are only appended, a copy of the
+// map is enough. The caller holds keyspaceMu.
+func copyKeyspace(cache map[string]configuration.ICache) map[string]configuration.ICache {
+	snapshot := make(map[string]configuration.ICache, len(cache))
+	for key, value := range cache {
+		snapshot[key] = value
+	}
+	return snapshot
+}
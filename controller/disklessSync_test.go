@@ -0,0 +1,54 @@
+package controller
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	configuration "github.com/oussamasf/yuji/config"
+	"github.com/oussamasf/yuji/utils"
+)
+
+func TestDisklessSync(t *testing.T) {
+	config := newTestConfig()
+	config.ReplDisklessSync = true
+	config.ReplTimeout = 60
+	writer := newTestConn(t, config)
+	replica := newTestConn(t, config)
+
+	writer.do("SET", "k", "v")
+	if reply := replica.do("REPLCONF", "capa", "eof"); reply.Value != utils.OK {
+		t.Fatalf("REPLCONF capa eof = %v, want OK", reply.Value)
+	}
+	reply := replica.do("PSYNC", "?", "-1")
+	if line, _ := reply.Value.(string); !strings.HasPrefix(line, "FULLRESYNC ") {
+		t.Fatalf("PSYNC = %v, want FULLRESYNC", reply.Value)
+	}
+
+	replica.conn.SetReadDeadline(time.Now().Add(time.Second))
+	dump, err := replica.reader.ReadBulkPayload()
+	if err != nil {
+		t.Fatalf("reading the snapshot: %v", err)
+	}
+	want := utils.EncodeRDB(map[string]configuration.ICache{"k": {Type: configuration.String, Data: "v"}})
+	if !bytes.Equal(dump, want) {
+		t.Fatalf("snapshot = %q, want %q", dump, want)
+	}
+
+	//? Writes after the snapshot follow it on the stream
+	writer.do("SET", "k2", "v2")
+	for {
+		command, err := replica.read(time.Second)
+		if err != nil {
+			t.Fatalf("reading the stream: %v", err)
+		}
+		if got := replyStrings(command); !reflect.DeepEqual(got, []string{"REPLCONF", "GETACK", "*"}) {
+			if want := []string{"SET", "k2", "v2"}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("replica received %q, want %q", got, want)
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package controller
+
+import (
+	"strconv"
+	"time"
+
+	configuration "github.com/oussamasf/yuji/config"
+)
+
+// setExpire stores the absolute expiration time, in unix milliseconds, of an
+// existing key and schedules its removal. The caller holds keyspaceMu.
+func setExpire(config *configuration.AppSettings, key string, expireAt int64) {
+	entry := config.RedisMap[key]
+	entry.ExpirationMap = strconv.FormatInt(expireAt, 10)
+	config.RedisMap[key] = entry
+
+	time.AfterFunc(time.Until(time.UnixMilli(expireAt)), func() {
+		keyspaceMu.Lock()
+		defer keyspaceMu.Unlock()
+
+		//? The key may have been overwritten, or given another TTL, since then
+		current, ok := config.RedisMap[key]
+		if !ok || current.ExpirationMap != entry.ExpirationMap {
+			return
+		}
+
+		//? A replica keeps the key until the DEL of its master arrives, reads
+		//? only stop seeing it, so both hold the same dataset
+		if config.IsSlave {
+			return
+		}
+		expireKey(config, key)
+	})
+}
+
+// expireKey deletes an expired key, replicas receive the expiration as a DEL.
+// The caller holds keyspaceMu.
+func expireKey(config *configuration.AppSettings, key string) {
+	delete(config.RedisMap, key)
+	markDirty(1)
+	notifyKeyspaceEvent(config, notifyExpired, "expired", key)
+	propagate([]string{"DEL", key})
+}
+
+// expireStaleKeys deletes the keys whose time to live ran out while this
+// server was a replica, once it became a master
+func expireStaleKeys(config *configuration.AppSettings) {
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+
+	if config.IsSlave {
+		return
+	}
+	for key, entry := range config.RedisMap {
+		if isExpired(entry) {
+			expireKey(config, key)
+		}
+	}
+}
+
+func isExpired(entry configuration.ICache) bool {
+	if entry.ExpirationMap == "" {
+		return false
+	}
+	expireAt, err := strconv.ParseInt(entry.ExpirationMap, 10, 64)
+	return err == nil && expireAt <= time.Now().UnixMilli()
+}
+
+// lookupKey returns a key to read, unless its time to live ran out and it is
+// only waiting for its removal. The caller holds keyspaceMu.
+func lookupKey(config *configuration.AppSettings, key string) (configuration.ICache, bool) {
+	entry, ok := config.RedisMap[key]
+	if !ok || isExpired(entry) {
+		return configuration.ICache{}, false
+	}
+	return entry, true
+}
@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	configuration "github.com/oussamasf/yuji/config"
+	"github.com/oussamasf/yuji/utils"
+)
+
+func TestExpireOnReplica(t *testing.T) {
+	tests := []struct {
+		name        string
+		replica     bool
+		wantDeleted bool
+	}{
+		{name: "master deletes the key", wantDeleted: true},
+		{name: "replica keeps it for the DEL of its master", replica: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := newTestConfig()
+			config.IsSlave = tt.replica
+			c := NewClient(nil, config)
+
+			keyspaceMu.Lock()
+			config.RedisMap["k"] = configuration.ICache{Type: configuration.String, Data: "v"}
+			setExpire(config, "k", time.Now().Add(10*time.Millisecond).UnixMilli())
+			keyspaceMu.Unlock()
+			time.Sleep(50 * time.Millisecond)
+
+			keyspaceMu.Lock()
+			defer keyspaceMu.Unlock()
+			if _, ok := config.RedisMap["k"]; ok == tt.wantDeleted {
+				t.Fatalf("key still stored = %v, want %v", ok, !tt.wantDeleted)
+			}
+			//? Either way reads no longer see it
+			if reply := getCommand(c, utils.NewBulkStringArray([]string{"GET", "k"}).Value.([]configuration.RESPValue)); reply.Value != nil {
+				t.Fatalf("GET k = %v, want nil", reply.Value)
+			}
+			missing := typeCommand(c, utils.NewBulkStringArray([]string{"TYPE", "missing"}).Value.([]configuration.RESPValue))
+			if reply := typeCommand(c, utils.NewBulkStringArray([]string{"TYPE", "k"}).Value.([]configuration.RESPValue)); reply.Value != missing.Value {
+				t.Fatalf("TYPE k = %v, want %v like a missing key", reply.Value, missing.Value)
+			}
+		})
+	}
+}
+
+func TestExpireStaleKeysOnPromotion(t *testing.T) {
+	config := newTestConfig()
+	config.IsSlave = true
+
+	keyspaceMu.Lock()
+	config.RedisMap["old"] = configuration.ICache{Type: configuration.String, Data: "v"}
+	setExpire(config, "old", time.Now().Add(-time.Second).UnixMilli())
+	config.RedisMap["live"] = configuration.ICache{Type: configuration.String, Data: "v"}
+	setExpire(config, "live", time.Now().Add(time.Hour).UnixMilli())
+	config.RedisMap["persistent"] = configuration.ICache{Type: configuration.String, Data: "v"}
+	keyspaceMu.Unlock()
+	//? The timer of old already fired, while a replica
+	time.Sleep(20 * time.Millisecond)
+
+	keyspaceMu.Lock()
+	config.IsSlave = false
+	if _, ok := config.RedisMap["old"]; !ok {
+		t.Fatalf("replica deleted an expired key")
+	}
+	keyspaceMu.Unlock()
+	expireStaleKeys(config)
+
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	for key, want := range map[string]bool{"old": false, "live": true, "persistent": true} {
+		if _, ok := config.RedisMap[key]; ok != want {
+			t.Fatalf("%s stored = %v, want %v", key, ok, want)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package controller
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	configuration "github.com/oussamasf/yuji/config"
+	"github.com/oussamasf/yuji/utils"
+)
+
+const (
+	failoverWaitingForSync = "waiting-for-sync"
+	failoverInProgress     = "failover-in-progress"
+)
+
+// failoverRequest is a FAILOVER being run: writes are paused until a replica
+// caught up, which then gets the master role while this server follows it
+type failoverRequest struct {
+	state string
+	//? Target given with TO, otherwise the first replica to catch up
+	host  string
+	port  string
+	force bool
+	timer *time.Timer
+	//? Link to the target once the handoff started
+	link *masterLink
+	//? Closed when writes can go on
+	resume chan struct{}
+}
+
+// failover is nil unless a FAILOVER is running, guarded by replicationMu
+var failover *failoverRequest
+
+// ? FAILOVER [TO host port [FORCE]] [ABORT] [TIMEOUT milliseconds]
+func failoverCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	request := &failoverRequest{state: failoverWaitingForSync, resume: make(chan struct{})}
+	abort, timeout := false, int64(0)
+
+	for i := 1; i < len(args); i++ {
+		option, _ := args[i].Value.(string)
+		switch {
+		case strings.EqualFold(option, "to") && i+2 < len(args) && request.host == "":
+			request.host, _ = args[i+1].Value.(string)
+			request.port, _ = args[i+2].Value.(string)
+			if port, err := strconv.Atoi(request.port); err != nil || port < 0 || port > 65535 {
+				return utils.NewError("ERR Invalid port")
+			}
+			i += 2
+		case strings.EqualFold(option, "timeout") && i+1 < len(args) && timeout == 0:
+			value, _ := args[i+1].Value.(string)
+			ms, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || ms <= 0 {
+				return utils.NewError("ERR FAILOVER timeout must be greater than 0")
+			}
+			timeout = ms
+			i++
+		case strings.EqualFold(option, "force"):
+			request.force = true
+		case strings.EqualFold(option, "abort"):
+			abort = true
+		default:
+			return utils.NewError("ERR syntax error")
+		}
+	}
+
+	replicationMu.Lock()
+	defer replicationMu.Unlock()
+
+	if abort {
+		if request.host != "" || timeout > 0 || request.force {
+			return utils.NewError("ERR FAILOVER abort cannot be used with other options.")
+		}
+		if failover == nil {
+			return utils.NewError("ERR No failover in progress.")
+		}
+		abortFailover(c.Config, "Failover manually aborted")
+		return utils.NewSimpleString(utils.OK)
+	}
+
+	switch {
+	case c.Config.IsSlave:
+		return utils.NewError("ERR FAILOVER is not valid when server is a replica.")
+	case len(replicaLinks) == 0:
+		return utils.NewError("ERR FAILOVER requires connected replicas.")
+	case failover != nil:
+		return utils.NewError("ERR FAILOVER already in progress.")
+	case request.force && (request.host == "" || timeout == 0):
+		return utils.NewError("ERR FAILOVER with force option requires both a timeout and target HOST and IP.")
+	case request.host != "" && failoverTarget(request) == nil:
+		return utils.NewError("ERR FAILOVER target HOST and PORT is not a replica.")
+	}
+
+	failover = request
+	if timeout > 0 {
+		request.timer = time.AfterFunc(time.Duration(timeout)*time.Millisecond, func() {
+			failoverTimedOut(c.Config, request)
+		})
+	}
+	log.Printf("FAILOVER requested to %s", failoverTargetName(request))
+
+	//? The target may be in sync already, otherwise its next ACK tells
+	requestAcks(c.Config)
+	checkFailoverProgress(c.Config)
+	return utils.NewSimpleString(utils.OK)
+}
+
+// failoverTarget returns the link of the replica given with TO. The caller
+// holds replicationMu.
+func failoverTarget(request *failoverRequest) *replicaLink {
+	for _, link := range replicaLinks {
+		info := newReplicaInfo(link.client, "", 0, 0)
+		if info.ip == request.host && strconv.Itoa(info.port) == request.port {
+			return link
+		}
+	}
+	return nil
+}
+
+func failoverTargetName(request *failoverRequest) string {
+	if request.host == "" {
+		return "any replica"
+	}
+	return request.host + ":" + request.port
+}
+
+// checkFailoverProgress hands the master role over once the target
+// acknowledged every write. The caller holds keyspaceMu and replicationMu.
+func checkFailoverProgress(config *configuration.AppSettings) {
+	if failover == nil || failover.state != failoverWaitingForSync {
+		return
+	}
+
+	if failover.host != "" {
+		if link := failoverTarget(failover); link != nil && link.ackOffset >= replication.offset {
+			startFailoverHandoff(config)
+		}
+		return
+	}
+	for _, link := range replicaLinks {
+		if link.ackOffset >= replication.offset {
+			info := newReplicaInfo(link.client, "", 0, 0)
+			failover.host, failover.port = info.ip, strconv.Itoa(info.port)
+			startFailoverHandoff(config)
+			return
+		}
+	}
+}
+
+// startFailoverHandoff makes this server a replica of the target, asking it
+// with PSYNC FAILOVER to take the master role. The caller holds keyspaceMu
+// and replicationMu.
+func startFailoverHandoff(config *configuration.AppSettings) {
+	log.Printf("FAILOVER: handing the master role to %s at offset %d", failoverTargetName(failover), replication.offset)
+	failover.state = failoverInProgress
+	failover.link = replicaOf(config, failover.host, failover.port)
+	failover.link.failover = true
+}
+
+// failoverTimedOut aborts a failover that did not complete in time, unless
+// FORCE asked to hand the role over anyway
+func failoverTimedOut(config *configuration.AppSettings, request *failoverRequest) {
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	replicationMu.Lock()
+	defer replicationMu.Unlock()
+
+	if failover != request {
+		return
+	}
+	if request.force && request.state == failoverWaitingForSync {
+		startFailoverHandoff(config)
+		return
+	}
+	abortFailover(config, "Replica never caught up before timeout")
+}
+
+// endFailover completes or aborts the failover started on link, depending on
+// whether the target accepted the PSYNC FAILOVER
+func endFailover(config *configuration.AppSettings, link *masterLink, accepted bool) {
+	//? Aborting promotes this server back, the role changes under keyspaceMu
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+	replicationMu.Lock()
+	defer replicationMu.Unlock()
+
+	if failover == nil || failover.link != link {
+		return
+	}
+	if !accepted {
+		abortFailover(config, "Failover target rejected psync request")
+		return
+	}
+
+	log.Printf("FAILOVER: %s is now the master", failoverTargetName(failover))
+	link.failover = false
+	clearFailover()
+}
+
+// abortFailover resumes writes, as a master if the handoff already started.
+// The caller holds replicationMu.
+func abortFailover(config *configuration.AppSettings, reason string) {
+	log.Printf("FAILOVER aborted: %s", reason)
+	if failover.state == failoverInProgress {
+		promoteToMaster(config)
+	}
+	clearFailover()
+}
+
+// clearFailover lets the paused writes go on. The caller holds replicationMu.
+func clearFailover() {
+	if failover.timer != nil {
+		failover.timer.Stop()
+	}
+	close(failover.resume)
+	failover = nil
+}
+
+// failoverState is reported by INFO. The caller holds replicationMu.
+func failoverState() string {
+	if failover == nil {
+		return "no-failover"
+	}
+	return failover.state
+}
+
+// waitForPausedWrites blocks a write while FAILOVER runs. The caller holds
+// keyspaceMu, released meanwhile: failovers start and end under it, none can
+// start once the write holds it again.
+func waitForPausedWrites() {
+	for {
+		replicationMu.Lock()
+		request := failover
+		replicationMu.Unlock()
+
+		if request == nil {
+			return
+		}
+		keyspaceMu.Unlock()
+		<-request.resume
+		keyspaceMu.Lock()
+	}
+}
@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oussamasf/yuji/utils"
+)
+
+func TestFailoverPausesWrites(t *testing.T) {
+	config := newTestConfig()
+	config.ReplDisklessSync = true
+	config.ReplTimeout = 60
+	replica := newTestConn(t, config)
+	writer := newTestConn(t, config)
+	admin := newTestConn(t, config)
+
+	//? A replica that never acknowledges, the failover waits for it to sync
+	replica.do("REPLCONF", "capa", "eof")
+	replica.do("PSYNC", "?", "-1")
+	replica.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := replica.reader.ReadBulkPayload(); err != nil {
+		t.Fatalf("reading the snapshot: %v", err)
+	}
+	go func() {
+		for {
+			if _, err := replica.reader.ReadValue(); err != nil {
+				return
+			}
+		}
+	}()
+
+	if reply := admin.do("FAILOVER"); reply.Value != utils.OK {
+		t.Fatalf("FAILOVER = %v, want OK", reply.Value)
+	}
+	if reply := admin.do("INFO", "replication"); !strings.Contains(reply.Value.(string), "master_failover_state:waiting-for-sync") {
+		t.Fatalf("INFO replication = %q, want a failover waiting for sync", reply.Value)
+	}
+
+	//? Reads go on, writes wait for the failover to end
+	if reply := admin.do("GET", "k"); reply.Value != nil {
+		t.Fatalf("GET k = %v, want nil", reply.Value)
+	}
+	writer.send("SET", "k", "v")
+	if _, err := writer.read(50 * time.Millisecond); err == nil {
+		t.Fatalf("SET replied during the failover")
+	}
+
+	if reply := admin.do("FAILOVER", "ABORT"); reply.Value != utils.OK {
+		t.Fatalf("FAILOVER ABORT = %v, want OK", reply.Value)
+	}
+	reply, err := writer.read(time.Second)
+	if err != nil {
+		t.Fatalf("reading the SET reply: %v", err)
+	}
+	if reply.Value != utils.OK {
+		t.Fatalf("SET = %v, want OK", reply.Value)
+	}
+	if reply := admin.do("INFO", "replication"); !strings.Contains(reply.Value.(string), "master_failover_state:no-failover") {
+		t.Fatalf("INFO replication = %q, want no failover", reply.Value)
+	}
+}
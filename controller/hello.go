@@ -0,0 +1,132 @@
+package controller
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	configuration "github.com/oussamasf/yuji/config"
+	"github.com/oussamasf/yuji/utils"
+)
+
+const serverVersion = "7.2.0"
+
+// ? HELLO [protover [AUTH username password] [SETNAME clientname]]
+func helloCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	protocol, username, password, name, err := parseHelloArgs(args, c.Protocol)
+	if err != nil {
+		return utils.NewError(err.Error())
+	}
+
+	if password != "" {
+		if err := authenticate(c, username, password); err != nil {
+			return utils.NewError(err.Error())
+		}
+	}
+
+	if !c.Authenticated {
+		return utils.NewError("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+	}
+
+	if name != "" {
+		c.Name = name
+	}
+	c.writeMu.Lock()
+	c.Protocol = protocol
+	c.writeMu.Unlock()
+
+	role := "master"
+	if c.Config.IsSlave {
+		role = "replica"
+	}
+
+	return utils.NewMap(
+		utils.NewBulkString("server"), utils.NewBulkString("redis"),
+		utils.NewBulkString("version"), utils.NewBulkString(serverVersion),
+		utils.NewBulkString("proto"), utils.NewInteger(int64(c.Protocol)),
+		utils.NewBulkString("id"), utils.NewInteger(c.ID),
+		utils.NewBulkString("mode"), utils.NewBulkString("standalone"),
+		utils.NewBulkString("role"), utils.NewBulkString(role),
+		utils.NewBulkString("modules"), utils.NewArray(),
+	)
+}
+
+func parseHelloArgs(args []configuration.RESPValue, currentProtocol int) (int, string, string, string, error) {
+	var username, password, name string
+	protocol := currentProtocol
+
+	if len(args) < 2 {
+		return protocol, username, password, name, nil
+	}
+
+	protoStr, _ := args[1].Value.(string)
+	parsed, err := strconv.Atoi(protoStr)
+	if err != nil {
+		return 0, "", "", "", fmt.Errorf("ERR Protocol version is not an integer or out of range")
+	}
+	if parsed != utils.RESP2 && parsed != utils.RESP3 {
+		return 0, "", "", "", fmt.Errorf("NOPROTO unsupported protocol version")
+	}
+	protocol = parsed
+
+	for i := 2; i < len(args); i++ {
+		option, _ := args[i].Value.(string)
+
+		switch strings.ToLower(option) {
+		case "auth":
+			if i+2 >= len(args) {
+				return 0, "", "", "", fmt.Errorf("ERR Syntax error in HELLO option 'auth'")
+			}
+			username, _ = args[i+1].Value.(string)
+			password, _ = args[i+2].Value.(string)
+			i += 2
+		case "setname":
+			if i+1 >= len(args) {
+				return 0, "", "", "", fmt.Errorf("ERR Syntax error in HELLO option 'setname'")
+			}
+			name, _ = args[i+1].Value.(string)
+			if strings.ContainsAny(name, " \n") {
+				return 0, "", "", "", fmt.Errorf("ERR Client names cannot contain spaces, newlines or special characters.")
+			}
+			i++
+		default:
+			return 0, "", "", "", fmt.Errorf("ERR Syntax error in HELLO option '%s'", option)
+		}
+	}
+
+	return protocol, username, password, name, nil
+}
+
+// ? AUTH [username] password
+func authCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	if len(args) > 3 {
+		return utils.NewError("ERR syntax error")
+	}
+
+	username := "default"
+	password, _ := args[len(args)-1].Value.(string)
+	if len(args) == 3 {
+		username, _ = args[1].Value.(string)
+	}
+
+	if c.Config.RequirePass == "" && len(args) == 2 {
+		return utils.NewError("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+	}
+
+	if err := authenticate(c, username, password); err != nil {
+		return utils.NewError(err.Error())
+	}
+
+	return utils.NewSimpleString(utils.OK)
+}
+
+// authenticate checks the credentials against the default user, the only one
+// there is, which has no password unless requirepass is set
+func authenticate(c *Client, username string, password string) error {
+	if username != "default" || (c.Config.RequirePass != "" && password != c.Config.RequirePass) {
+		return fmt.Errorf("WRONGPASS invalid username-password pair or user is disabled.")
+	}
+
+	c.Authenticated = true
+	return nil
+}
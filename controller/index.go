@@ -1,46 +1,59 @@
 package controller
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/google/uuid"
 	configuration "github.com/oussamasf/yuji/config"
-	"github.com/oussamasf/yuji/service/tcp"
 	"github.com/oussamasf/yuji/utils"
 )
 
-var replicasConnections = []net.Conn{}
-
 var blockedStreamRequests = make(map[string][]*BlockedRequest)
 
+// keyspaceMu serializes every access to the keyspace, a transaction holds it
+// for the whole EXEC so its commands run atomically
+var keyspaceMu sync.Mutex
+
+// noReply is returned by handlers that answer the client later on their own,
+// like a blocked XREAD
+var noReply = configuration.RESPValue{}
+
 type BlockedRequest struct {
-	Conn       net.Conn
+	Client     *Client
 	StreamKeys []string
 	Ids        []string
 	BlockTime  time.Duration
 	StartTime  time.Time
+	//? Receives the reply once an XADD served the request or it timed out
+	done chan configuration.RESPValue
 }
 
 func HandleConnection(conn net.Conn, config *configuration.AppSettings) {
-
-	var txQueue = configuration.TransactionSettings{
-		InvokedTx: false,
-	}
-
-	infoRes := []string{"role:master", "master_replid:8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb", "master_repl_offset:0"}
+	c := NewClient(conn, config)
 
 	defer conn.Close()
 
-	data := make([]byte, 1028)
+	go c.deliverMessages()
+	defer releasePubSub(c)
+	defer releaseReplica(c)
+
+	reader := utils.NewRESPReader(conn)
 	for {
-		n, err := conn.Read(data)
+		reader.SetAuthenticated(c.Authenticated)
+		commandArgs, err := reader.ReadCommand()
 		if err != nil {
+			var protocolErr *utils.ProtocolError
+			if errors.As(err, &protocolErr) {
+				c.WriteValue(utils.NewError("ERR " + protocolErr.Error()))
+				break
+			}
 			if err == io.EOF {
 				log.Println("Connection closed")
 				break
@@ -48,425 +61,696 @@ func HandleConnection(conn net.Conn, config *configuration.AppSettings) {
 			log.Printf("Error reading: %v", err)
 			break
 		}
-		trimmedData := bytes.TrimRight(data[:n], "\x00")
 
-		cmdName, args, err := validateCommand(trimmedData)
+		cmdName, args, err := validateCommand(commandArgs)
 
 		if err != nil {
-			tcp.WriteRESPError(conn, err.Error())
+			c.writeReply(utils.NewError(err.Error()))
 			continue
 		}
 
-		switch cmdName {
+		if cmdName == "" {
+			continue
+		}
 
-		case "ping":
-			tcp.WriteRESPSimpleString(conn, parsePingArgs())
-		case "save":
-			err := utils.SaveRDBFile(config)
-			if err != nil {
-				tcp.WriteRESPError(conn, "ERROR: COULD_NOT_SAVE_FILE")
-				continue
-			}
-			tcp.WriteRESPSimpleString(conn, "OK")
-		case "type":
-			key, err := parseTypeArgs(args)
-			if err != nil {
-				tcp.WriteRESPError(conn, err.Error())
-			}
-			tcp.WriteRESPSimpleString(conn, config.RedisMap[key].Type.String())
-
-		case "multi":
-			txQueue.InvokedTx = true
-			tcp.WriteRESPSimpleString(conn, "OK")
-		case "discard":
-			if !txQueue.InvokedTx {
-				tcp.WriteRESPError(conn, "ERROR: DISCARD without MULTI")
-				continue
-			}
-			txQueue.Session = []configuration.TSession{}
-			txQueue.InvokedTx = false
-			tcp.WriteRESPSimpleString(conn, "OK")
-
-		case "exec":
-			if !txQueue.InvokedTx {
-				tcp.WriteRESPError(conn, "ERROR: EXEC without MULTI")
-				continue
-			}
-			if len(txQueue.Session) == 0 {
-				tcp.WriteArrayResp(conn, []string{})
-				txQueue.InvokedTx = false
-			} else {
-				results := []string{}
-				for _, session := range txQueue.Session {
-					switch session.Cmd {
-
-					case "set":
-						res, err := parseSetArgs(session.Args, config.RedisMap)
-						if err != nil {
-							results = append(results, fmt.Sprint(err))
-							continue
-						}
-						results = append(results, res)
-
-					case "get":
-						res, err := parseGetArgs(session.Args, config.RedisMap)
-						if err != nil {
-							results = append(results, fmt.Sprint(err))
-							continue
-						}
-
-						results = append(results, res)
-
-					case "incr":
-						res, err := ParseIncrArgs(session.Args, config.RedisMap)
-						if err != nil {
-							results = append(results, fmt.Sprint(err))
-							continue
-						}
-
-						results = append(results, res)
-
-					default:
-						tcp.WriteArrayResp(conn, []string{})
-					}
-				}
+		reply := processCommand(c, cmdName, args)
+		if c.blocked != nil {
+			reply = <-c.blocked
+			c.blocked = nil
+		}
+		if reply.Type != noReply.Type {
+			c.writeReply(reply)
+		}
 
-				tcp.WriteArrayResp(conn, results)
-				txQueue.InvokedTx = false
-			}
+		if c.CloseAfterReply {
+			break
+		}
+	}
+}
 
-		case "incr":
-			if txQueue.InvokedTx {
-				session := configuration.TSession{
-					Cmd:  strings.ToLower(cmdName),
-					Args: args,
-				}
-				tcp.WriteRESPSimpleString(conn, "QUEUED")
-				txQueue.Session = append(txQueue.Session, session)
-				continue
-			} else {
+func processCommand(c *Client, cmdName string, args []configuration.RESPValue) configuration.RESPValue {
+	cmd, err := lookupCommand(cmdName, args)
+	if err != nil {
+		if c.Tx.InvokedTx {
+			c.Tx.Aborted = true
+		}
+		return utils.NewError(err.Error())
+	}
 
-				res, err := ParseIncrArgs(args, config.RedisMap)
+	if !c.Authenticated && cmd.Flags&flagNoAuth == 0 {
+		if c.Tx.InvokedTx {
+			c.Tx.Aborted = true
+		}
+		return utils.NewError("NOAUTH Authentication required.")
+	}
 
-				if err != nil {
-					tcp.WriteRESPError(conn, "ERROR: DISCARD without MULTI")
-					continue
-				}
+	//? A RESP2 subscriber can only manage its subscriptions, its connection
+	//? otherwise carries nothing but messages
+	if c.Protocol == utils.RESP2 && c.InSubscriberMode() && cmd.Flags&flagPubSub == 0 {
+		return utils.NewError(fmt.Sprintf("ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", cmdName))
+	}
 
-				tcp.WriteRESPBulkString(conn, res)
+	//? EXEC writes when one of the queued commands does
+	writes := cmd.Flags&flagWrite != 0
+	if cmdName == "exec" && c.Tx.InvokedTx {
+		writes = c.queuedWrites()
+	}
 
-			}
+	//? Only the master writes to a read only replica
+	if writes && c.readOnlyReplica() {
+		return c.abortWrite(cmdName, readOnlyError)
+	}
 
-		case "keys":
-			keys, err := utils.LogFileKeys()
-			if err != nil {
-				tcp.WriteRESPError(conn, "ERROR: PARSE_ERROR")
-				continue
-			}
-			tcp.WriteArrayResp(conn, keys)
+	//? Writes the AOF can't log would not survive a restart
+	if writes && !c.isMasterLink {
+		if err := aofWriteError(); err != nil {
+			return c.abortWrite(cmdName, "MISCONF Errors writing to the AOF file: "+err.Error())
+		}
+	}
 
-		case "config":
-			res, err := parseConfigArgs(args, config.Dir, config.DBFileName)
+	if c.Tx.InvokedTx && cmd.Flags&flagNoMulti != 0 {
+		c.Tx.Aborted = true
+		return utils.NewError("ERR Command not allowed inside a transaction")
+	}
 
-			if err != nil {
-				tcp.WriteRESPError(conn, err.Error())
-				continue
-			}
+	//? Inside MULTI everything but the transaction control commands is queued
+	if c.Tx.InvokedTx && cmd.Flags&flagTxControl == 0 {
+		c.Tx.Session = append(c.Tx.Session, configuration.TSession{
+			Cmd:  cmdName,
+			Args: args,
+		})
+		return utils.NewSimpleString("QUEUED")
+	}
 
-			tcp.WriteArrayResp(conn, res)
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
 
-		case "info":
-			if config.IsSlave {
-				infoRes = []string{"role:slave"}
-			}
-			tcp.WriteResponse(conn, utils.NewBulkString(infoRes))
+	//? Writes wait while FAILOVER hands the master role over, they may then
+	//? find a replica
+	if writes && !c.isMasterLink {
+		waitForPausedWrites()
+	}
 
-		case "echo":
-			res := parseEchoArgs(args)
+	//? The server may have become a replica while the write waited
+	if writes && c.readOnlyReplica() {
+		return c.abortWrite(cmdName, readOnlyError)
+	}
 
-			tcp.WriteRESPBulkString(conn, res)
+	reply := cmd.Handler(c, args)
+	flushPropagation(c)
+	return reply
+}
 
-		case "replconf":
-			tcp.WriteRESPSimpleString(conn, "OK")
+const readOnlyError = "READONLY You can't write against a read only replica."
 
-		case "psync":
-			serverID := uuid.New()
+// readOnlyReplica tells whether a write of c is refused by this replica, the
+// role changes under keyspaceMu
+func (c *Client) readOnlyReplica() bool {
+	return c.Config.IsSlave && c.Config.ReplicaReadOnly && !c.isMasterLink
+}
 
-			tcp.WriteRESPSimpleString(conn, fmt.Sprintf("FULLRESYNC %s 0", serverID))
-			time.Sleep(100 * time.Millisecond)
+// abortWrite refuses a write, an EXEC discarding its transaction and a
+// queued command failing the EXEC to come
+func (c *Client) abortWrite(cmdName string, message string) configuration.RESPValue {
+	if cmdName == "exec" {
+		c.resetTx()
+	} else if c.Tx.InvokedTx {
+		c.Tx.Aborted = true
+	}
+	return utils.NewError(message)
+}
 
-			dumpFile := utils.ReadRDBFile(config)
+func multiCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	if c.Tx.InvokedTx {
+		return utils.NewError("ERR MULTI calls can not be nested")
+	}
+	c.Tx.InvokedTx = true
+	return utils.NewSimpleString(utils.OK)
+}
 
-			tcp.WriteRESPBulkString(conn, dumpFile)
-			time.Sleep(100 * time.Millisecond)
+func discardCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	if !c.Tx.InvokedTx {
+		return utils.NewError("ERROR: DISCARD without MULTI")
+	}
+	c.resetTx()
+	return utils.NewSimpleString(utils.OK)
+}
 
-			tcp.WriteArrayResp(conn, []string{"replconf", "getack", "*"})
+// execCommand runs the queued commands while the caller holds keyspaceMu and
+// collects their replies, errors included, into a single array
+func execCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	if !c.Tx.InvokedTx {
+		return utils.NewError("ERROR: EXEC without MULTI")
+	}
 
-			replicasConnections = append(replicasConnections, conn)
+	if c.Tx.Aborted {
+		c.resetTx()
+		return utils.NewError("EXECABORT Transaction discarded because of previous errors.")
+	}
 
-		case "set":
-			if txQueue.InvokedTx {
-				session := configuration.TSession{
-					Cmd:  strings.ToLower(cmdName),
-					Args: args,
-				}
-				tcp.WriteRESPSimpleString(conn, "QUEUED")
-				txQueue.Session = append(txQueue.Session, session)
-				continue
-			} else {
-				_, err := parseSetArgs(args, config.RedisMap)
-
-				if err != nil {
-					tcp.WriteRESPError(conn, "ERROR: DISCARD without MULTI")
-					continue
-				}
+	results := make([]configuration.RESPValue, 0, len(c.Tx.Session))
+	for _, session := range c.Tx.Session {
+		results = append(results, commandTable[session.Cmd].Handler(c, session.Args))
+	}
 
-				tcp.WriteRESPSimpleString(conn, "OK")
+	c.resetTx()
+	return utils.NewArray(results...)
+}
 
-				// TODO support for replica in tx
-				if !config.IsSlave {
-					WriteCommandSync(replicasConnections, trimmedData)
-				}
-			}
+func (c *Client) resetTx() {
+	c.Tx = configuration.TransactionSettings{
+		InvokedTx: false,
+	}
+}
 
-		case "get":
-			if txQueue.InvokedTx {
-				session := configuration.TSession{
-					Cmd:  strings.ToLower(cmdName),
-					Args: args,
-				}
-				tcp.WriteRESPSimpleString(conn, "QUEUED")
-				txQueue.Session = append(txQueue.Session, session)
-				continue
-			} else {
+// queuedWrites tells whether the transaction holds a write command
+func (c *Client) queuedWrites() bool {
+	for _, session := range c.Tx.Session {
+		if cmd, ok := commandTable[session.Cmd]; ok && cmd.Flags&flagWrite != 0 {
+			return true
+		}
+	}
+	return false
+}
 
-				res, err := parseGetArgs(args, config.RedisMap)
+func pingCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	if len(args) > 2 {
+		return utils.NewError("ERR wrong number of arguments for 'ping' command")
+	}
 
-				if err != nil {
-					tcp.WriteRESPError(conn, "ERROR: DISCARD without MULTI")
-					continue
-				}
+	//? In subscriber mode RESP2 clients get the pong as a message-like array
+	if c.Protocol == utils.RESP2 && c.InSubscriberMode() {
+		message := ""
+		if len(args) == 2 {
+			message, _ = args[1].Value.(string)
+		}
+		return utils.NewBulkStringArray([]string{"pong", message})
+	}
 
-				tcp.WriteRESPBulkString(conn, res)
+	if len(args) == 2 {
+		return utils.NewBulkString(args[1].Value.(string))
+	}
+	return utils.NewSimpleString(parsePingArgs())
+}
 
-				parseGetArgs(args, config.RedisMap)
-			}
+func quitCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	c.CloseAfterReply = true
+	return utils.NewSimpleString(utils.OK)
+}
 
-		case "xadd":
+func typeCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	key, err := parseTypeArgs(args)
+	if err != nil {
+		return utils.NewError(err.Error())
+	}
+	entry, _ := lookupKey(c.Config, key)
+	return utils.NewSimpleString(entry.Type.String())
+}
 
-			streamKey, rawEntryID, keyValue, err := parseAddStreamArgs(args)
+func incrCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	key, _ := args[1].Value.(string)
+	_, existed := c.Config.RedisMap[key]
 
-			if err != nil {
-				tcp.WriteRESPError(conn, err.Error())
-				continue
-			}
+	res, err := ParseIncrArgs(args, c.Config.RedisMap)
+	if err != nil {
+		return utils.NewError(err.Error())
+	}
 
-			stream := configuration.IStream{
-				Entries: []configuration.StreamEntry{},
-			}
+	if !existed {
+		notifyKeyspaceEvent(c.Config, notifyNew, "new", key)
+	}
+	notifyKeyspaceEvent(c.Config, notifyString, "incrby", key)
+	c.propagate(argsToStrings(args)...)
 
-			newEntryID, err := utils.RefineRawID(rawEntryID, stream.LastID)
-			if err != nil {
-				tcp.WriteRESPError(conn, err.Error())
-				continue
-			}
+	return utils.NewInteger(res)
+}
 
-			// ? Compare the new ID with the LastID in the stream
-			if stream.LastID != "" && utils.CompareIDs(stream.LastID, newEntryID) >= 0 {
-				tcp.WriteRESPError(conn, "ERROR: ERR The ID specified in XADD is equal or smaller than the target stream top item")
-				continue
-			}
+func keysCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	keys, err := utils.LogFileKeys()
+	if err != nil {
+		return utils.NewError("ERROR: PARSE_ERROR")
+	}
+	return utils.NewBulkStringArray(keys)
+}
 
-			//? Check if the stream already exists in RedisMap
-			if existingCache, found := config.RedisMap[streamKey]; found && existingCache.Type == configuration.Stream {
-				stream = existingCache.StreamData
-			}
+func infoCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	role := "master"
+	if c.Config.IsSlave {
+		role = "slave"
+	}
 
-			newEntry := configuration.StreamEntry{
-				ID:     newEntryID,
-				Values: keyValue,
+	infoRes := append(persistenceInfo(), "")
+
+	replicationMu.Lock()
+	infoRes = append(infoRes, "# Replication", "role:"+role)
+	if link := currentMasterLink; link != nil {
+		status, lastIO := "down", int64(-1)
+		if link.up {
+			status = "up"
+			lastIO = int64(time.Since(link.lastIO).Seconds())
+		}
+		syncInProgress := 0
+		if link.syncInProgress {
+			syncInProgress = 1
+		}
+		infoRes = append(infoRes,
+			"master_host:"+link.host,
+			"master_port:"+link.port,
+			"master_link_status:"+status,
+			fmt.Sprintf("master_last_io_seconds_ago:%d", lastIO),
+			fmt.Sprintf("master_sync_in_progress:%d", syncInProgress),
+		)
+		if !link.up {
+			downSince := int64(-1)
+			if !link.downSince.IsZero() {
+				downSince = int64(time.Since(link.downSince).Seconds())
 			}
+			infoRes = append(infoRes, fmt.Sprintf("master_link_down_since_seconds:%d", downSince))
+		}
+
+		readOnly := 0
+		if c.Config.ReplicaReadOnly {
+			readOnly = 1
+		}
+		infoRes = append(infoRes, fmt.Sprintf("slave_read_only:%d", readOnly))
+	}
+	if link := currentMasterLink; link == nil {
+		infoRes = append(infoRes, "master_failover_state:"+failoverState())
+	}
+	replicas := connectedReplicas()
+	infoRes = append(infoRes, fmt.Sprintf("connected_slaves:%d", len(replicas)))
+	for i, replica := range replicas {
+		infoRes = append(infoRes, fmt.Sprintf("slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d",
+			i, replica.ip, replica.port, replica.state, replica.offset, replica.lag))
+	}
+	infoRes = append(infoRes,
+		"master_replid:"+replication.replID,
+		"master_replid2:"+replication.replID2,
+		fmt.Sprintf("master_repl_offset:%d", replication.offset),
+		fmt.Sprintf("second_repl_offset:%d", replication.secondReplOffset),
+	)
+	if backlog := replication.backlog; backlog != nil {
+		infoRes = append(infoRes,
+			"repl_backlog_active:1",
+			fmt.Sprintf("repl_backlog_size:%d", len(backlog.buf)),
+			fmt.Sprintf("repl_backlog_first_byte_offset:%d", backlog.offset),
+			fmt.Sprintf("repl_backlog_histlen:%d", backlog.histlen),
+		)
+	} else {
+		infoRes = append(infoRes,
+			"repl_backlog_active:0",
+			fmt.Sprintf("repl_backlog_size:%d", c.Config.ReplBacklogSize),
+			"repl_backlog_first_byte_offset:0",
+			"repl_backlog_histlen:0",
+		)
+	}
+	replicationMu.Unlock()
 
-			//? Append the new stream entry
-			stream.Entries = append(stream.Entries, configuration.StreamEntry{
-				ID:     newEntryID,
-				Values: keyValue,
-			})
+	return utils.NewBulkString(strings.Join(infoRes, "\r\n"))
+}
 
-			stream.LastID = newEntryID
+func echoCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	return utils.NewBulkString(parseEchoArgs(args))
+}
 
-			//? Store the updated stream back in RedisMap
-			config.RedisMap[streamKey] = configuration.ICache{
-				Type:       configuration.Stream,
-				StreamData: stream,
-			}
+// ? REPLCONF listening-port port | capa capability | ACK offset [FACK aofoffset]
+func replconfCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	if len(args)%2 == 0 {
+		return utils.NewError("ERR syntax error")
+	}
 
-			//? Check if any blocked XRead requests should be unblocked
-			if blockedRequests, found := blockedStreamRequests[streamKey]; found {
-				for _, request := range blockedRequests {
-					//? Check if the new entry's ID is greater than the ID requested
-					for _, requestedID := range request.Ids {
-						if utils.CompareIDs(newEntryID, requestedID) > 0 {
-							go func(conn net.Conn, streamKey, entryID string, entry configuration.StreamEntry) {
-								values := []string{}
-								for key, value := range entry.Values {
-									values = append(values, fmt.Sprintf("$%d\r\n%s\r\n", len(key), key), fmt.Sprintf("$%d\r\n%s\r\n", len(value), value))
-								}
-								entryResp := fmt.Sprintf("*%d\r\n$%d\r\n%s\r\n*%d\r\n%s", 2, len(entryID), entryID, len(values)/2, strings.Join(values, ""))
-
-								keyResp := fmt.Sprintf("*2\r\n$%d\r\n%s\r\n*%d\r\n%s", len(streamKey), streamKey, 1, entryResp)
-								conn.Write([]byte(keyResp))
-							}(request.Conn, streamKey, newEntryID, newEntry)
-
-							break
-						}
+	for i := 1; i < len(args); i += 2 {
+		option, _ := args[i].Value.(string)
+		value, _ := args[i+1].Value.(string)
+
+		switch strings.ToLower(option) {
+		case "ack":
+			//? Acknowledgements are never answered, the reply would end up in
+			//? the replication stream of the replica. FACK follows with the
+			//? offset fsynced to its AOF.
+			offset, err := strconv.ParseInt(value, 10, 64)
+			fsyncOffset := int64(-1)
+			if i+3 < len(args) {
+				if fack, _ := args[i+2].Value.(string); strings.EqualFold(fack, "fack") {
+					fackValue, _ := args[i+3].Value.(string)
+					if parsed, err := strconv.ParseInt(fackValue, 10, 64); err == nil {
+						fsyncOffset = parsed
 					}
 				}
 			}
+			if err == nil {
+				acknowledgeOffset(c, offset, fsyncOffset)
+			}
+			return noReply
+		case "capa":
+			if strings.ToLower(value) == "eof" {
+				c.replicaCapaEOF = true
+			}
+		case "listening-port":
+			port, err := strconv.Atoi(value)
+			if err != nil || port < 0 || port > 65535 {
+				return utils.NewError("ERR value is out of range")
+			}
+			c.replicaListeningPort = port
+		case "ip-address":
+			c.replicaAnnouncedIP = value
+		default:
+			return utils.NewError(fmt.Sprintf("ERR Unrecognized REPLCONF option: %s", option))
+		}
+	}
+	return utils.NewSimpleString(utils.OK)
+}
 
-			tcp.WriteRESPBulkString(conn, newEntryID)
+// ? PSYNC replicationid offset [FAILOVER]
+func psyncCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	replID, _ := args[1].Value.(string)
+	offsetArg, _ := args[2].Value.(string)
 
-		case "xread":
+	replicationMu.Lock()
+	defer replicationMu.Unlock()
 
-			ids, streamKeys, blockRequested, blockTime, nil := parseReadStreamArgs(args)
-			if err != nil {
-				tcp.WriteRESPError(conn, "Err error while parsing arguments")
-				continue
-			}
+	//? FAILOVER: the master caught us up and asks us to take over
+	if len(args) > 3 {
+		if option, _ := args[3].Value.(string); len(args) > 4 || !strings.EqualFold(option, "failover") {
+			return utils.NewError("ERR syntax error")
+		}
+		if replID != replication.replID {
+			return utils.NewError("ERR PSYNC FAILOVER replid must match my replid.")
+		}
+		if c.Config.IsSlave {
+			promoteToMaster(c.Config)
+			log.Printf("MASTER MODE enabled (failover request from 'id=%d')", c.ID)
+		}
+	}
 
-			//? Ensure, have the same number of keys and IDs
-			if len(streamKeys) != len(ids) {
-				tcp.WriteRESPError(conn, "ERROR: MISMATCHED_KEYS_AND_IDS")
-				continue
-			}
+	//? A replica serves its sub-replicas only once in sync with its own master
+	if c.Config.IsSlave && (currentMasterLink == nil || !currentMasterLink.up) {
+		return utils.NewError("NOMASTERLINK Can't SYNC while not connected with my master")
+	}
 
-			results := generateReadStreamResponse(ids, streamKeys, config)
+	createReplicationBacklog(c.Config)
+
+	//? Partial resync: only the bytes the replica missed
+	if offset, err := strconv.ParseInt(offsetArg, 10, 64); err == nil && canPartialResync(replID, offset) {
+		//? Written by the link, a slow replica doesn't hold the locks
+		addReplica(c,
+			utils.EncodeValue(utils.NewSimpleString("CONTINUE "+replication.replID), utils.RESP2),
+			replication.backlog.since(offset),
+		)
+		log.Printf("Partial resynchronization accepted, sending %d bytes of backlog", replication.offset-offset+1)
+		return noReply
+	}
 
-			//? If results are found, send them immediately
-			if len(results) > 0 {
-				var builder strings.Builder
-				builder.WriteString(fmt.Sprintf("*%d\r\n", len(results)))
-				for _, result := range results {
-					builder.WriteString(result)
-				}
+	//? Diskless full sync, for replicas able to read the EOF framing
+	if c.Config.ReplDisklessSync && c.replicaCapaEOF {
+		queueDisklessSync(c)
+		return noReply
+	}
 
-				conn.Write([]byte(builder.String()))
-			}
+	//? Disk based full sync, from the dump file of a BGSAVE
+	queueBgsaveSync(c)
+	return noReply
+}
 
-			//? Handle blocking behavior
-			if blockRequested {
-				blockedRequest := &BlockedRequest{
-					Conn:       conn,
-					StreamKeys: streamKeys,
-					Ids:        ids,
-					BlockTime:  blockTime,
-					StartTime:  time.Now(),
-				}
+func setCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	key, _ := args[1].Value.(string)
+	_, existed := c.Config.RedisMap[key]
 
-				for _, streamKey := range streamKeys {
-					blockedStreamRequests[streamKey] = append(blockedStreamRequests[streamKey], blockedRequest)
-				}
+	_, err := parseSetArgs(args, c.Config)
 
-				if blockTime > 0 {
-					go func() {
-						time.Sleep(blockTime)
-						for _, streamKey := range streamKeys {
-							if requests, found := blockedStreamRequests[streamKey]; found {
-								for i, req := range requests {
-									if req == blockedRequest {
-										if len(results) == 0 {
-											conn.Write([]byte("$-1\r\n"))
-										}
-										blockedStreamRequests[streamKey] = append(requests[:i], requests[i+1:]...)
-										break
-									}
-								}
-							}
-						}
-					}()
-				} else if blockTime == 0 {
-					go func() {
-						time.Sleep(time.Duration(1<<63 - 1))
-					}()
-				}
-			} else {
-				conn.Write([]byte("$-1\r\n"))
-			}
+	if err != nil {
+		return utils.NewError(err.Error())
+	}
 
-		case "xrange":
-			startRangeID, endRangeID, streamKey, err := parseRangeStreamArgs(args)
-			if err != nil {
-				tcp.WriteResponse(conn, err.Error())
-				continue
-			}
+	if !existed {
+		notifyKeyspaceEvent(c.Config, notifyNew, "new", key)
+	}
+	notifyKeyspaceEvent(c.Config, notifyString, "set", key)
+	//? Relative expiry is sent as absolute so replicas expire at the same time
+	entry := c.Config.RedisMap[key]
+	if entry.ExpirationMap != "" {
+		notifyKeyspaceEvent(c.Config, notifyGeneric, "expire", key)
+		c.propagate("SET", key, entry.Data, "PXAT", entry.ExpirationMap)
+	} else {
+		c.propagate("SET", key, entry.Data)
+	}
 
-			stream, ok := config.RedisMap[streamKey]
-			if !ok {
-				tcp.WriteResponse(conn, "")
-				continue
-			}
+	return utils.NewSimpleString(utils.OK)
+}
+
+// ? DEL key [key ...]
+func delCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	deleted := 0
+	for _, key := range argsToStrings(args[1:]) {
+		if _, ok := c.Config.RedisMap[key]; ok {
+			delete(c.Config.RedisMap, key)
+			notifyKeyspaceEvent(c.Config, notifyGeneric, "del", key)
+			deleted++
+		}
+	}
+
+	if deleted > 0 {
+		c.propagate(argsToStrings(args)...)
+	}
+	return utils.NewInteger(int64(deleted))
+}
+
+func getCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	res, exists, err := parseGetArgs(args, c.Config)
+
+	if err != nil {
+		return utils.NewError(err.Error())
+	}
 
-			entries := stream.StreamData.Entries
+	if !exists {
+		notifyKeyspaceEvent(c.Config, notifyKeyMiss, "keymiss", args[1].Value.(string))
+		return utils.NewNullBulkString()
+	}
+
+	return utils.NewBulkString(res)
+}
+
+func xaddCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	config := c.Config
+
+	streamKey, rawEntryID, keyValue, err := parseAddStreamArgs(args)
+
+	if err != nil {
+		return utils.NewError(err.Error())
+	}
+
+	stream := configuration.IStream{
+		Entries: []configuration.StreamEntry{},
+	}
+
+	newEntryID, err := utils.RefineRawID(rawEntryID, stream.LastID)
+	if err != nil {
+		return utils.NewError(err.Error())
+	}
+
+	// ? Compare the new ID with the LastID in the stream
+	if stream.LastID != "" && utils.CompareIDs(stream.LastID, newEntryID) >= 0 {
+		return utils.NewError("ERROR: ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	}
+
+	//? Check if the stream already exists in RedisMap
+	existingCache, existed := config.RedisMap[streamKey]
+	if existed && existingCache.Type == configuration.Stream {
+		stream = existingCache.StreamData
+	}
+
+	newEntry := configuration.StreamEntry{
+		ID:     newEntryID,
+		Values: keyValue,
+	}
+
+	//? Append the new stream entry
+	stream.Entries = append(stream.Entries, newEntry)
+
+	stream.LastID = newEntryID
+
+	//? Store the updated stream back in RedisMap
+	config.RedisMap[streamKey] = configuration.ICache{
+		Type:       configuration.Stream,
+		StreamData: stream,
+	}
 
-			if utils.CompareIDs(startRangeID, endRangeID) > 0 {
-				tcp.WriteRESPError(conn, "ERROR invalid range id")
-				continue
+	if !existed {
+		notifyKeyspaceEvent(config, notifyNew, "new", streamKey)
+	}
+	notifyKeyspaceEvent(config, notifyStream, "xadd", streamKey)
+
+	//? With the generated ID, replicas must store the same entry
+	c.propagate(append([]string{"XADD", streamKey, newEntryID}, argsToStrings(args[3:])...)...)
+
+	//? Check if any blocked XRead requests should be unblocked
+	for _, request := range blockedStreamRequests[streamKey] {
+		//? Check if the new entry's ID is greater than the ID requested
+		for _, requestedID := range request.Ids {
+			if utils.CompareIDs(newEntryID, requestedID) > 0 {
+				unblockStreamRequest(request)
+
+				request.done <- utils.NewArray(utils.NewArray(utils.NewBulkString(streamKey), utils.NewArray(streamEntryValue(newEntry))))
+
+				break
 			}
+		}
+	}
 
-			results := []string{}
-			for _, entry := range entries {
-				if endRangeID == "+" {
-					if utils.CompareIDs(entry.ID, startRangeID) >= 0 {
-						values := []string{}
-						for key, value := range entry.Values {
-							values = append(values, key, value)
-						}
-
-						respValues := utils.NewArrayResp(values)
-						idResp := fmt.Sprintf("$%d\r\n%s\r\n", len(entry.ID), entry.ID)
-						valueResp := fmt.Sprintf("*2\r\n%s\r\n%s\r\n", idResp, respValues)
-						results = append(results, valueResp)
-					}
-					continue
-				}
-				if startRangeID == "-" {
-					if utils.CompareIDs(entry.ID, endRangeID) <= 0 {
-						values := []string{}
-						for key, value := range entry.Values {
-							values = append(values, key, value)
-						}
-
-						respValues := utils.NewArrayResp(values)
-						idResp := fmt.Sprintf("$%d\r\n%s\r\n", len(entry.ID), entry.ID)
-						valueResp := fmt.Sprintf("*2\r\n%s\r\n%s\r\n", idResp, respValues)
-						results = append(results, valueResp)
-					}
-					continue
-				}
-				if utils.CompareIDs(entry.ID, startRangeID) >= 0 && utils.CompareIDs(entry.ID, endRangeID) <= 0 {
-					values := []string{}
-					for key, value := range entry.Values {
-						values = append(values, key, value)
-					}
+	return utils.NewBulkString(newEntryID)
+}
 
-					respValues := utils.NewArrayResp(values)
-					idResp := fmt.Sprintf("$%d\r\n%s\r\n", len(entry.ID), entry.ID)
-					valueResp := fmt.Sprintf("*2\r\n%s\r\n%s\r\n", idResp, respValues)
-					results = append(results, valueResp)
-				}
+func xreadCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	ids, streamKeys, blockRequested, blockTime, err := parseReadStreamArgs(args)
+	if err != nil {
+		return utils.NewError("Err error while parsing arguments")
+	}
+
+	//? Ensure, have the same number of keys and IDs
+	if len(streamKeys) != len(ids) {
+		return utils.NewError("ERROR: MISMATCHED_KEYS_AND_IDS")
+	}
+
+	results := generateReadStreamResponse(ids, streamKeys, c.Config)
+
+	//? If results are found, send them immediately
+	if len(results) > 0 {
+		return utils.NewArray(results...)
+	}
+
+	//? A transaction can't wait for data, XREAD BLOCK behaves like a plain XREAD
+	if !blockRequested || c.Tx.InvokedTx {
+		return utils.NewNullArray()
+	}
+
+	//? The connection reads nothing more until the reply is written, once
+	//? processCommand released keyspaceMu
+	blockedRequest := &BlockedRequest{
+		Client:     c,
+		StreamKeys: streamKeys,
+		Ids:        ids,
+		BlockTime:  blockTime,
+		StartTime:  time.Now(),
+		done:       make(chan configuration.RESPValue, 1),
+	}
+	c.blocked = blockedRequest.done
+
+	for _, streamKey := range streamKeys {
+		blockedStreamRequests[streamKey] = append(blockedStreamRequests[streamKey], blockedRequest)
+	}
+
+	if blockTime > 0 {
+		time.AfterFunc(blockTime, func() {
+			keyspaceMu.Lock()
+			defer keyspaceMu.Unlock()
+
+			//? Only answer if no XADD served the request in the meantime
+			if unblockStreamRequest(blockedRequest) {
+				blockedRequest.done <- utils.NewNullArray()
 			}
-			var builder strings.Builder
-			builder.WriteString(fmt.Sprintf("*%d\r\n", len(results)))
+		})
+	}
+
+	return noReply
+}
 
-			for _, result := range results {
-				builder.WriteString(result)
+// unblockStreamRequest removes a blocked XREAD from every stream it waits on and
+// reports whether it was still registered
+func unblockStreamRequest(blockedRequest *BlockedRequest) bool {
+	found := false
+	for _, streamKey := range blockedRequest.StreamKeys {
+		requests := blockedStreamRequests[streamKey]
+		for i, req := range requests {
+			if req == blockedRequest {
+				blockedStreamRequests[streamKey] = append(requests[:i:i], requests[i+1:]...)
+				found = true
+				break
 			}
+		}
+		if len(blockedStreamRequests[streamKey]) == 0 {
+			delete(blockedStreamRequests, streamKey)
+		}
+	}
+	return found
+}
 
-			conn.Write([]byte(builder.String()))
+func xrangeCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	startRangeID, endRangeID, streamKey, err := parseRangeStreamArgs(args)
+	if err != nil {
+		return utils.NewError(err.Error())
+	}
 
-		default:
-			tcp.WriteRESPError(conn, "ERROR: Unknown command")
-			return
+	stream, ok := lookupKey(c.Config, streamKey)
+	if !ok {
+		notifyKeyspaceEvent(c.Config, notifyKeyMiss, "keymiss", streamKey)
+		return utils.NewArray()
+	}
+
+	entries := stream.StreamData.Entries
+
+	if utils.CompareIDs(startRangeID, endRangeID) > 0 {
+		return utils.NewError("ERROR invalid range id")
+	}
+
+	results := []configuration.RESPValue{}
+	for _, entry := range entries {
+		if endRangeID == "+" {
+			if utils.CompareIDs(entry.ID, startRangeID) >= 0 {
+				results = append(results, streamEntryValue(entry))
+			}
+			continue
+		}
+		if startRangeID == "-" {
+			if utils.CompareIDs(entry.ID, endRangeID) <= 0 {
+				results = append(results, streamEntryValue(entry))
+			}
+			continue
 		}
+		if utils.CompareIDs(entry.ID, startRangeID) >= 0 && utils.CompareIDs(entry.ID, endRangeID) <= 0 {
+			results = append(results, streamEntryValue(entry))
+		}
+	}
+
+	return utils.NewArray(results...)
+}
+
+// ? XINFO STREAM key
+func xinfoCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	subcommand, _ := args[1].Value.(string)
+	if strings.ToLower(subcommand) != "stream" || len(args) != 3 {
+		return utils.NewError(fmt.Sprintf("ERR unknown subcommand or wrong number of arguments for '%s'. Try XINFO HELP.", subcommand))
+	}
+
+	streamKey, _ := args[2].Value.(string)
+	cache, ok := lookupKey(c.Config, streamKey)
+	if !ok {
+		notifyKeyspaceEvent(c.Config, notifyKeyMiss, "keymiss", streamKey)
+		return utils.NewError("ERR no such key")
+	}
+	if cache.Type != configuration.Stream {
+		return utils.NewError("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+
+	stream := cache.StreamData
+	firstEntry, lastEntry := utils.NewNullArray(), utils.NewNullArray()
+	if len(stream.Entries) > 0 {
+		firstEntry = streamEntryValue(stream.Entries[0])
+		lastEntry = streamEntryValue(stream.Entries[len(stream.Entries)-1])
+	}
+
+	return utils.NewMap(
+		utils.NewBulkString("length"), utils.NewInteger(int64(len(stream.Entries))),
+		utils.NewBulkString("last-generated-id"), utils.NewBulkString(stream.LastID),
+		utils.NewBulkString("first-entry"), firstEntry,
+		utils.NewBulkString("last-entry"), lastEntry,
+	)
+}
+
+func argsToStrings(args []configuration.RESPValue) []string {
+	values := make([]string, 0, len(args))
+	for _, arg := range args {
+		value, _ := arg.Value.(string)
+		values = append(values, value)
 	}
+	return values
 }
@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	configuration "github.com/oussamasf/yuji/config"
+	"github.com/oussamasf/yuji/service/tcp"
+	"github.com/oussamasf/yuji/utils"
+)
+
+// testConn is a client connected to HandleConnection over an in-memory
+// connection
+type testConn struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *utils.RESPReader
+}
+
+func newTestConn(t *testing.T, config *configuration.AppSettings) *testConn {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go HandleConnection(server, config)
+	return &testConn{t: t, conn: client, reader: utils.NewRESPReader(client)}
+}
+
+func newTestConfig() *configuration.AppSettings {
+	return &configuration.AppSettings{RedisMap: map[string]configuration.ICache{}}
+}
+
+// send writes a command without waiting for its reply
+func (tc *testConn) send(args ...string) {
+	tc.t.Helper()
+	tc.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if err := tcp.WriteValue(tc.conn, utils.NewBulkStringArray(args), utils.RESP2); err != nil {
+		tc.t.Fatalf("sending %q: %v", args, err)
+	}
+}
+
+// read returns the next value the server writes, within timeout
+func (tc *testConn) read(timeout time.Duration) (*configuration.RESPValue, error) {
+	tc.conn.SetReadDeadline(time.Now().Add(timeout))
+	return tc.reader.ReadValue()
+}
+
+func (tc *testConn) do(args ...string) *configuration.RESPValue {
+	tc.t.Helper()
+	tc.send(args...)
+	reply, err := tc.read(time.Second)
+	if err != nil {
+		tc.t.Fatalf("reading the reply to %q: %v", args, err)
+	}
+	return reply
+}
+
+func TestXReadBlock(t *testing.T) {
+	config := newTestConfig()
+	reader := newTestConn(t, config)
+	writer := newTestConn(t, config)
+
+	//? Nothing is added in time, the reply is a null array
+	if reply := reader.do("XREAD", "BLOCK", "20", "STREAMS", "s", "0-0"); reply.Type != '*' || reply.Value != nil {
+		t.Fatalf("timed out XREAD = %c %v, want a null array", reply.Type, reply.Value)
+	}
+
+	reader.send("XREAD", "BLOCK", "0", "STREAMS", "s", "0-0")
+	if _, err := reader.read(50 * time.Millisecond); err == nil {
+		t.Fatalf("blocked XREAD replied before XADD")
+	}
+	if reply := writer.do("XADD", "s", "1-1", "f", "v"); reply.Value != "1-1" {
+		t.Fatalf("XADD = %v, want 1-1", reply.Value)
+	}
+
+	reply, err := reader.read(time.Second)
+	if err != nil {
+		t.Fatalf("reading the XREAD reply: %v", err)
+	}
+	want := utils.NewArray(utils.NewArray(utils.NewBulkString("s"), utils.NewArray(
+		utils.NewArray(utils.NewBulkString("1-1"), utils.NewArray(utils.NewBulkString("f"), utils.NewBulkString("v"))),
+	)))
+	if encoded := utils.EncodeValue(*reply, utils.RESP2); !reflect.DeepEqual(encoded, utils.EncodeValue(want, utils.RESP2)) {
+		t.Fatalf("XREAD = %q, want %q", encoded, utils.EncodeValue(want, utils.RESP2))
+	}
+	if reply := reader.do("PING"); reply.Value != "PONG" {
+		t.Fatalf("PING after XREAD = %v, want PONG", reply.Value)
+	}
+}
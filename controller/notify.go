@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	configuration "github.com/oussamasf/yuji/config"
+)
+
+// Keyspace event classes selected with notify-keyspace-events
+const (
+	notifyKeyspace = 1 << iota // K
+	notifyKeyevent             // E
+	notifyGeneric              // g
+	notifyString               // $
+	notifyList                 // l
+	notifySet                  // s
+	notifyHash                 // h
+	notifyZset                 // z
+	notifyExpired              // x
+	notifyEvicted              // e
+	notifyStream               // t
+	notifyKeyMiss              // m
+	notifyNew                  // n
+
+	//? A is an alias for every type of event but key misses and new keys
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash | notifyZset | notifyExpired | notifyEvicted | notifyStream
+)
+
+var notifyFlagLetters = []struct {
+	letter byte
+	flag   int
+}{
+	{'g', notifyGeneric},
+	{'$', notifyString},
+	{'l', notifyList},
+	{'s', notifySet},
+	{'h', notifyHash},
+	{'z', notifyZset},
+	{'x', notifyExpired},
+	{'e', notifyEvicted},
+	{'t', notifyStream},
+	{'K', notifyKeyspace},
+	{'E', notifyKeyevent},
+	{'m', notifyKeyMiss},
+	{'n', notifyNew},
+}
+
+// parseNotifyKeyspaceEvents turns a flag string such as "KEA" into its mask.
+func parseNotifyKeyspaceEvents(flags string) (int, error) {
+	mask := 0
+	for i := 0; i < len(flags); i++ {
+		if flags[i] == 'A' {
+			mask |= notifyAll
+			continue
+		}
+
+		found := false
+		for _, candidate := range notifyFlagLetters {
+			if candidate.letter == flags[i] {
+				mask |= candidate.flag
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("invalid event class character '%c'", flags[i])
+		}
+	}
+	return mask, nil
+}
+
+// formatNotifyKeyspaceEvents is the inverse of parseNotifyKeyspaceEvents,
+// using the same canonical ordering as Redis.
+func formatNotifyKeyspaceEvents(mask int) string {
+	var builder strings.Builder
+	if mask&notifyAll == notifyAll {
+		builder.WriteByte('A')
+		mask &^= notifyAll
+	}
+	for _, candidate := range notifyFlagLetters {
+		if mask&candidate.flag != 0 {
+			builder.WriteByte(candidate.letter)
+		}
+	}
+	return builder.String()
+}
+
+// notifyKeyspaceEvent publishes the event on __keyspace@0__:<key> and/or
+// __keyevent@0__:<event> when its class is enabled. Only database 0 exists.
+func notifyKeyspaceEvent(config *configuration.AppSettings, class int, event string, key string) {
+	mask := config.NotifyKeyspaceEvents
+	if mask&class == 0 {
+		return
+	}
+
+	if mask&notifyKeyspace != 0 {
+		publishMessage("__keyspace@0__:"+key, event)
+	}
+	if mask&notifyKeyevent != 0 {
+		publishMessage("__keyevent@0__:"+event, key)
+	}
+}
@@ -0,0 +1,339 @@
+package controller
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	configuration "github.com/oussamasf/yuji/config"
+	"github.com/oussamasf/yuji/utils"
+)
+
+// ? Subscribers by channel and by pattern, guarded by pubsubMu since messages
+// ? are also published from outside command handlers
+var pubsubChannels = make(map[string]map[*Client]struct{})
+var pubsubPatterns = make(map[string]map[*Client]struct{})
+var pubsubMu sync.Mutex
+
+// ? Shard channel subscribers grouped by the hash slot of the channel, every
+// ? slot is served by this node since there is no cluster mode
+var pubsubShardChannels = make(map[int]map[string]map[*Client]struct{})
+
+// ? SUBSCRIBE channel [channel ...]
+func subscribeCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	pubsubMu.Lock()
+	defer pubsubMu.Unlock()
+
+	replies := []configuration.RESPValue{}
+	for _, channel := range argsToStrings(args[1:]) {
+		if _, ok := c.Channels[channel]; !ok {
+			c.Channels[channel] = struct{}{}
+			addSubscriber(pubsubChannels, channel, c)
+		}
+		replies = append(replies, subscriptionReply("subscribe", utils.NewBulkString(channel), c.SubscriptionCount()))
+	}
+
+	//? Queued like messages, so the confirmations come before the messages
+	//? published once the client is subscribed
+	enqueueMessage(c, replies...)
+	return noReply
+}
+
+// ? UNSUBSCRIBE [channel ...]
+func unsubscribeCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	pubsubMu.Lock()
+	defer pubsubMu.Unlock()
+
+	unsubscribeClient(c, "unsubscribe", c.Channels, func(channel string) {
+		removeSubscriber(pubsubChannels, channel, c)
+	}, c.SubscriptionCount, argsToStrings(args[1:]))
+	return noReply
+}
+
+// ? PSUBSCRIBE pattern [pattern ...]
+func psubscribeCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	pubsubMu.Lock()
+	defer pubsubMu.Unlock()
+
+	replies := []configuration.RESPValue{}
+	for _, pattern := range argsToStrings(args[1:]) {
+		if _, ok := c.Patterns[pattern]; !ok {
+			c.Patterns[pattern] = struct{}{}
+			addSubscriber(pubsubPatterns, pattern, c)
+		}
+		replies = append(replies, subscriptionReply("psubscribe", utils.NewBulkString(pattern), c.SubscriptionCount()))
+	}
+
+	enqueueMessage(c, replies...)
+	return noReply
+}
+
+// ? PUNSUBSCRIBE [pattern ...]
+func punsubscribeCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	pubsubMu.Lock()
+	defer pubsubMu.Unlock()
+
+	unsubscribeClient(c, "punsubscribe", c.Patterns, func(pattern string) {
+		removeSubscriber(pubsubPatterns, pattern, c)
+	}, c.SubscriptionCount, argsToStrings(args[1:]))
+	return noReply
+}
+
+// ? PUBLISH channel message
+func publishCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	channel, _ := args[1].Value.(string)
+	message, _ := args[2].Value.(string)
+
+	return utils.NewInteger(int64(publishMessage(channel, message)))
+}
+
+// ? PUBSUB CHANNELS [pattern] | NUMSUB [channel ...] | NUMPAT
+func pubsubCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	subcommand, _ := args[1].Value.(string)
+
+	pubsubMu.Lock()
+	defer pubsubMu.Unlock()
+
+	switch strings.ToLower(subcommand) {
+	case "channels":
+		if len(args) > 3 {
+			break
+		}
+		pattern := "*"
+		if len(args) == 3 {
+			pattern, _ = args[2].Value.(string)
+		}
+		return utils.NewBulkStringArray(matchingChannels(pubsubChannels, pattern))
+
+	case "numsub":
+		pairs := []configuration.RESPValue{}
+		for _, channel := range argsToStrings(args[2:]) {
+			pairs = append(pairs, utils.NewBulkString(channel), utils.NewInteger(int64(len(pubsubChannels[channel]))))
+		}
+		return utils.NewMap(pairs...)
+
+	case "numpat":
+		if len(args) != 2 {
+			break
+		}
+		return utils.NewInteger(int64(len(pubsubPatterns)))
+
+	case "shardchannels":
+		if len(args) > 3 {
+			break
+		}
+		pattern := "*"
+		if len(args) == 3 {
+			pattern, _ = args[2].Value.(string)
+		}
+		channels := []string{}
+		for _, registry := range pubsubShardChannels {
+			channels = append(channels, matchingChannels(registry, pattern)...)
+		}
+		sort.Strings(channels)
+		return utils.NewBulkStringArray(channels)
+
+	case "shardnumsub":
+		pairs := []configuration.RESPValue{}
+		for _, channel := range argsToStrings(args[2:]) {
+			subscribers := pubsubShardChannels[utils.KeyHashSlot(channel)][channel]
+			pairs = append(pairs, utils.NewBulkString(channel), utils.NewInteger(int64(len(subscribers))))
+		}
+		return utils.NewMap(pairs...)
+	}
+
+	return utils.NewError(fmt.Sprintf("ERR unknown subcommand or wrong number of arguments for '%s'. Try PUBSUB HELP.", subcommand))
+}
+
+// ? SSUBSCRIBE shardchannel [shardchannel ...]
+func ssubscribeCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	pubsubMu.Lock()
+	defer pubsubMu.Unlock()
+
+	replies := []configuration.RESPValue{}
+	for _, channel := range argsToStrings(args[1:]) {
+		if _, ok := c.ShardChannels[channel]; !ok {
+			c.ShardChannels[channel] = struct{}{}
+			slot := utils.KeyHashSlot(channel)
+			if pubsubShardChannels[slot] == nil {
+				pubsubShardChannels[slot] = make(map[string]map[*Client]struct{})
+			}
+			addSubscriber(pubsubShardChannels[slot], channel, c)
+		}
+		replies = append(replies, subscriptionReply("ssubscribe", utils.NewBulkString(channel), len(c.ShardChannels)))
+	}
+
+	enqueueMessage(c, replies...)
+	return noReply
+}
+
+// ? SUNSUBSCRIBE [shardchannel ...]
+func sunsubscribeCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	pubsubMu.Lock()
+	defer pubsubMu.Unlock()
+
+	unsubscribeClient(c, "sunsubscribe", c.ShardChannels, func(channel string) {
+		removeShardSubscriber(channel, c)
+	}, func() int { return len(c.ShardChannels) }, argsToStrings(args[1:]))
+	return noReply
+}
+
+// ? SPUBLISH shardchannel message
+func spublishCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	channel, _ := args[1].Value.(string)
+	message, _ := args[2].Value.(string)
+
+	receivers := publishShardMessage(channel, message)
+
+	//? Replicas deliver shard messages to their own subscribers
+	c.propagateToReplicas(argsToStrings(args)...)
+
+	return utils.NewInteger(int64(receivers))
+}
+
+// publishShardMessage delivers to the subscribers of a shard channel only,
+// patterns never match shard channels
+func publishShardMessage(channel string, message string) int {
+	pubsubMu.Lock()
+	defer pubsubMu.Unlock()
+
+	receivers := 0
+	for subscriber := range pubsubShardChannels[utils.KeyHashSlot(channel)][channel] {
+		enqueueMessage(subscriber, utils.NewPush(
+			utils.NewBulkString("smessage"), utils.NewBulkString(channel), utils.NewBulkString(message),
+		))
+		receivers++
+	}
+	return receivers
+}
+
+// publishMessage hands the message to every subscriber of the channel and of
+// a matching pattern and returns how many received it. Messages are queued,
+// a subscriber that can't keep up is disconnected rather than waited for.
+func publishMessage(channel string, message string) int {
+	pubsubMu.Lock()
+	defer pubsubMu.Unlock()
+
+	receivers := 0
+	for subscriber := range pubsubChannels[channel] {
+		enqueueMessage(subscriber, utils.NewPush(
+			utils.NewBulkString("message"), utils.NewBulkString(channel), utils.NewBulkString(message),
+		))
+		receivers++
+	}
+
+	for pattern, subscribers := range pubsubPatterns {
+		if !utils.GlobMatch(pattern, channel) {
+			continue
+		}
+		for subscriber := range subscribers {
+			enqueueMessage(subscriber, utils.NewPush(
+				utils.NewBulkString("pmessage"), utils.NewBulkString(pattern), utils.NewBulkString(channel), utils.NewBulkString(message),
+			))
+			receivers++
+		}
+	}
+
+	return receivers
+}
+
+// enqueueMessage queues messages written together, nothing waits on the
+// subscriber's connection. It must be called with pubsubMu held, which
+// guarantees the outbox isn't closed underneath it.
+func enqueueMessage(subscriber *Client, messages ...configuration.RESPValue) {
+	subscriber.outboxPending.Add(1)
+	select {
+	case subscriber.outbox <- messages:
+	default:
+		subscriber.outboxPending.Add(-1)
+		log.Printf("Closing client %d: pubsub output buffer limit reached", subscriber.ID)
+		subscriber.Conn.Close()
+	}
+}
+
+// releasePubSub drops every subscription of a disconnecting client and stops
+// its message writer.
+func releasePubSub(c *Client) {
+	pubsubMu.Lock()
+	defer pubsubMu.Unlock()
+
+	for channel := range c.Channels {
+		removeSubscriber(pubsubChannels, channel, c)
+	}
+	for pattern := range c.Patterns {
+		removeSubscriber(pubsubPatterns, pattern, c)
+	}
+	for channel := range c.ShardChannels {
+		removeShardSubscriber(channel, c)
+	}
+	c.Channels = make(map[string]struct{})
+	c.Patterns = make(map[string]struct{})
+	c.ShardChannels = make(map[string]struct{})
+
+	close(c.outbox)
+}
+
+// unsubscribeClient removes the given names, or all of them when none are
+// given, and queues one confirmation per name
+func unsubscribeClient(c *Client, kind string, subscribed map[string]struct{}, remove func(string), count func() int, names []string) {
+	if len(names) == 0 {
+		for name := range subscribed {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	if len(names) == 0 {
+		enqueueMessage(c, subscriptionReply(kind, utils.NewNullBulkString(), count()))
+		return
+	}
+
+	replies := make([]configuration.RESPValue, 0, len(names))
+	for _, name := range names {
+		if _, ok := subscribed[name]; ok {
+			delete(subscribed, name)
+			remove(name)
+		}
+		replies = append(replies, subscriptionReply(kind, utils.NewBulkString(name), count()))
+	}
+	enqueueMessage(c, replies...)
+}
+
+func subscriptionReply(kind string, name configuration.RESPValue, count int) configuration.RESPValue {
+	return utils.NewPush(utils.NewBulkString(kind), name, utils.NewInteger(int64(count)))
+}
+
+func addSubscriber(registry map[string]map[*Client]struct{}, name string, c *Client) {
+	if registry[name] == nil {
+		registry[name] = make(map[*Client]struct{})
+	}
+	registry[name][c] = struct{}{}
+}
+
+func removeSubscriber(registry map[string]map[*Client]struct{}, name string, c *Client) {
+	delete(registry[name], c)
+	if len(registry[name]) == 0 {
+		delete(registry, name)
+	}
+}
+
+func removeShardSubscriber(channel string, c *Client) {
+	slot := utils.KeyHashSlot(channel)
+	removeSubscriber(pubsubShardChannels[slot], channel, c)
+	if len(pubsubShardChannels[slot]) == 0 {
+		delete(pubsubShardChannels, slot)
+	}
+}
+
+func matchingChannels(registry map[string]map[*Client]struct{}, pattern string) []string {
+	channels := []string{}
+	for channel := range registry {
+		if utils.GlobMatch(pattern, channel) {
+			channels = append(channels, channel)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
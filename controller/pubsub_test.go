@@ -0,0 +1,98 @@
+package controller
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	configuration "github.com/oussamasf/yuji/config"
+)
+
+// replyStrings flattens an array of bulk strings and integers
+func replyStrings(reply *configuration.RESPValue) []string {
+	items, _ := reply.Value.([]configuration.RESPValue)
+	values := []string{}
+	for _, item := range items {
+		values = append(values, fmt.Sprint(item.Value))
+	}
+	return values
+}
+
+func TestSubscribeRepliesInOrder(t *testing.T) {
+	config := newTestConfig()
+	subscriber := newTestConn(t, config)
+	publisher := newTestConn(t, config)
+
+	subscriber.send("SUBSCRIBE", "a", "b")
+	subscriber.send("PING")
+	for _, want := range [][]string{{"subscribe", "a", "1"}, {"subscribe", "b", "2"}, {"pong", ""}} {
+		reply, err := subscriber.read(time.Second)
+		if err != nil {
+			t.Fatalf("reading %q: %v", want, err)
+		}
+		if got := replyStrings(reply); !reflect.DeepEqual(got, want) {
+			t.Fatalf("subscriber received %q, want %q", got, want)
+		}
+	}
+
+	if reply := publisher.do("PUBLISH", "b", "hi"); reply.Value != int64(1) {
+		t.Fatalf("PUBLISH = %v, want 1 receiver", reply.Value)
+	}
+	reply, err := subscriber.read(time.Second)
+	if err != nil {
+		t.Fatalf("reading the message: %v", err)
+	}
+	if got, want := replyStrings(reply), []string{"message", "b", "hi"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("subscriber received %q, want %q", got, want)
+	}
+
+	subscriber.send("UNSUBSCRIBE")
+	subscriber.send("PING")
+	for _, want := range [][]string{{"unsubscribe", "a", "1"}, {"unsubscribe", "b", "0"}, {"PONG"}} {
+		reply, err := subscriber.read(time.Second)
+		if err != nil {
+			t.Fatalf("reading %q: %v", want, err)
+		}
+		got := replyStrings(reply)
+		if reply.Type == '+' {
+			got = []string{fmt.Sprint(reply.Value)}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("subscriber received %q, want %q", got, want)
+		}
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	config := newTestConfig()
+	subscriber := newTestConn(t, config)
+	publisher := newTestConn(t, config)
+
+	//? The subscriber never reads, not even its confirmation
+	subscriber.send("SUBSCRIBE", "a")
+	for deadline := time.Now().Add(time.Second); !reflect.DeepEqual(replyStrings(publisher.do("PUBSUB", "NUMSUB", "a")), []string{"a", "1"}); {
+		if time.Now().After(deadline) {
+			t.Fatalf("SUBSCRIBE wasn't applied")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	//? Publishers don't wait for it, until it is disconnected for falling
+	//? too far behind
+	disconnected := false
+	for i := 0; i < 2*pubsubOutboxSize && !disconnected; i++ {
+		reply := publisher.do("PUBLISH", "a", "message")
+		disconnected = reply.Value == int64(0)
+	}
+	if !disconnected {
+		t.Fatalf("subscriber still subscribed after %d unread messages", 2*pubsubOutboxSize)
+	}
+	if reply := publisher.do("PUBSUB", "NUMSUB", "a"); !reflect.DeepEqual(replyStrings(reply), []string{"a", "0"}) {
+		t.Fatalf("PUBSUB NUMSUB a = %q, want no subscriber left", replyStrings(reply))
+	}
+
+	if _, err := subscriber.read(time.Second); err == nil {
+		t.Fatalf("slow subscriber still connected")
+	}
+}
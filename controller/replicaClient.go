@@ -1,7 +1,6 @@
 package controller
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"log"
@@ -15,110 +14,486 @@ import (
 	"github.com/oussamasf/yuji/utils"
 )
 
-func HandleReplicaConnection(masterHost string, masterPort string, replicaPort string, cache map[string]configuration.ICache) {
-	address := fmt.Sprintf("%s:%s", masterHost, masterPort)
-	m, err := net.Dial("tcp", address)
-	if err != nil {
-		log.Fatalln("couldn't connect to master at ", address)
+// Steps of the handshake with the master, each one waits for the reply to
+// the command sent by the previous step
+type replicaHandshakeState int
+
+const (
+	replStateSendPing replicaHandshakeState = iota
+	replStateReceivePong
+	replStateReceivePort
+	replStateReceiveCapa
+	replStateReceivePsync
+	replStateTransfer
+	replStateConnected
+)
+
+// ? Delay before reconnecting to the master, doubled after every failure
+const (
+	replReconnectMinDelay = 500 * time.Millisecond
+	replReconnectMaxDelay = 30 * time.Second
+)
+
+// masterLink is the connection of a replica to its master, REPLICAOF closes
+// it to follow another master or to be promoted
+type masterLink struct {
+	host   string
+	port   string
+	conn   net.Conn
+	closed bool
+	//? Closed with the link, interrupts the wait between reconnections
+	stop chan struct{}
+	//? Set by FAILOVER, the PSYNC asks the new master to take over
+	failover bool
+
+	//? Reported by INFO replication
+	up             bool
+	syncInProgress bool
+	lastIO         time.Time
+	downSince      time.Time
+}
+
+// currentMasterLink is nil on a master, guarded by replicationMu
+var currentMasterLink *masterLink
+
+// ReplicaOf makes the server a replica of host:port, the dataset is replaced
+// by the one of the master unless it can continue its replication history.
+func ReplicaOf(config *configuration.AppSettings, host string, port string) {
+	replicationMu.Lock()
+	defer replicationMu.Unlock()
+
+	replicaOf(config, host, port)
+}
+
+// replicaOf starts the link to the new master. The caller holds replicationMu.
+func replicaOf(config *configuration.AppSettings, host string, port string) *masterLink {
+	//? A master hands its own history to the new master, which may know it
+	if !config.IsSlave {
+		replication.cachedMaster = true
+	}
+	closeMasterLink()
+
+	link := &masterLink{host: host, port: port, stop: make(chan struct{})}
+	currentMasterLink = link
+	config.IsSlave = true
+	config.ReplicaAddress = net.JoinHostPort(host, port)
+
+	go HandleReplicaConnection(link, config)
+	return link
+}
+
+// promoteToMaster is REPLICAOF NO ONE: the data is kept and the history of the
+// old master stays valid as replid2, so replicas of this server can continue.
+// The caller holds replicationMu.
+func promoteToMaster(config *configuration.AppSettings) {
+	closeMasterLink()
+	config.IsSlave = false
+	config.ReplicaAddress = ""
+
+	replication.replID2 = replication.replID
+	replication.secondReplOffset = replication.offset + 1
+	replication.replID = newReplicationID()
+	createReplicationBacklog(config)
+
+	//? They reconnect and learn the new replication ID with +CONTINUE
+	disconnectReplicas()
+
+	//? Expired keys waited for the DEL of the old master, it is ours to send now
+	go expireStaleKeys(config)
+}
+
+// closeMasterLink stops the replication from the current master. The caller
+// holds replicationMu.
+func closeMasterLink() {
+	if currentMasterLink == nil {
+		return
+	}
+	currentMasterLink.closed = true
+	close(currentMasterLink.stop)
+	if currentMasterLink.conn != nil {
+		currentMasterLink.conn.Close()
 	}
+	currentMasterLink = nil
+}
+
+// isClosed tells the link goroutines to stop once REPLICAOF replaced the link
+func (link *masterLink) isClosed() bool {
+	replicationMu.Lock()
+	defer replicationMu.Unlock()
 
+	return link.closed
+}
+
+// HandleReplicaConnection keeps the replica connected to its master until
+// the link is closed, reconnecting with an exponential backoff. Once synced,
+// every reconnection first tries to continue with PSYNC.
+func HandleReplicaConnection(link *masterLink, config *configuration.AppSettings) {
+	address := net.JoinHostPort(link.host, link.port)
+	delay := replReconnectMinDelay
+
+	for !link.isClosed() {
+		if connectToMaster(link, config) {
+			delay = replReconnectMinDelay
+		}
+		//? A failover target that could not be reached is given up
+		endFailover(config, link, false)
+
+		replicationMu.Lock()
+		if link.up || link.downSince.IsZero() {
+			link.downSince = time.Now()
+		}
+		link.up = false
+		link.syncInProgress = false
+		replicationMu.Unlock()
+
+		log.Printf("Reconnecting to master %s in %v", address, delay)
+		select {
+		case <-link.stop:
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, replReconnectMaxDelay)
+	}
+}
+
+// connectToMaster runs one connection to the master, from the handshake to
+// the end of the stream, and reports whether the sync succeeded
+func connectToMaster(link *masterLink, config *configuration.AppSettings) bool {
+	address := net.JoinHostPort(link.host, link.port)
+	timeout := time.Duration(config.ReplTimeout) * time.Second
+
+	m, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		log.Printf("Error connecting to master %s: %v", address, err)
+		return false
+	}
 	defer m.Close()
 
-	tcp.WriteArrayResp(m, []string{"ping"})
-	time.Sleep(100 * time.Millisecond)
+	replicationMu.Lock()
+	link.conn = m
+	closed := link.closed
+	replicationMu.Unlock()
+	if closed {
+		return false
+	}
+
+	reader := utils.NewRESPReader(m)
+	if err := syncWithMaster(link, m, reader, config); err != nil {
+		log.Printf("Error syncing with master %s: %v", address, err)
+		return false
+	}
+	log.Printf("MASTER <-> REPLICA sync: Finished with success")
 
-	tcp.WriteArrayResp(m, []string{"REPLCONF", "capa", "psync2"})
-	time.Sleep(100 * time.Millisecond)
+	replicationMu.Lock()
+	link.up = true
+	link.syncInProgress = false
+	link.lastIO = time.Now()
+	replicationMu.Unlock()
 
-	tcp.WriteArrayResp(m, []string{"REPLCONF", "listening-port", replicaPort})
-	time.Sleep(100 * time.Millisecond)
+	master := NewClient(m, config)
+	master.Authenticated = true
+	master.isMasterLink = true
 
-	tcp.WriteArrayResp(m, []string{"PSYNC", "?", "-1"})
+	done := make(chan struct{})
+	defer close(done)
+	go sendReplicationAcks(master, done)
+
+	applyReplicationStream(link, master, reader)
+	return true
+}
+
+// ? How often a replica reports its offset to the master
+const replAckPeriod = time.Second
+
+// sendReplicationAcks is the heartbeat of the replica, the master learns from
+// it how far the replica got and that it is still alive
+func sendReplicationAcks(master *Client, done chan struct{}) {
+	ticker := time.NewTicker(replAckPeriod)
+	defer ticker.Stop()
 
-	buffer := make([]byte, 1028)
 	for {
-		n, err := m.Read(buffer)
-		if err != nil {
-			if err == io.EOF {
-				log.Println("Connection closed by master")
-				break
-			}
-			log.Printf("Error reading from master: %v", err)
-			break
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			sendReplicationAck(master)
 		}
+	}
+}
+
+// sendReplicationAck reports the number of bytes of the stream processed so
+// far and, with AOF on, how many of them are on disk for WAITAOF
+func sendReplicationAck(master *Client) error {
+	replicationMu.Lock()
+	offset := replication.offset
+	replicationMu.Unlock()
+
+	ack := []string{"REPLCONF", "ACK", strconv.FormatInt(offset, 10)}
+	if fsynced := aofFsyncedReplOffset(); fsynced >= 0 {
+		ack = append(ack, "FACK", strconv.FormatInt(fsynced, 10))
+	}
+	return master.WriteValue(utils.NewBulkStringArray(ack))
+}
+
+// syncWithMaster runs the handshake up to the end of the full resync, leaving
+// the reader positioned at the start of the command stream
+func syncWithMaster(link *masterLink, m net.Conn, reader *utils.RESPReader, config *configuration.AppSettings) error {
+	timeout := time.Duration(config.ReplTimeout) * time.Second
+	state := replStateSendPing
+	masterReplID, masterOffset := "", int64(0)
 
-		if n > 0 {
-			trimmedBuffer := bytes.Trim(buffer[:n], "\x00")
+	for state != replStateConnected {
+		m.SetDeadline(time.Now().Add(timeout))
 
-			formattedInput := strings.ReplaceAll(string(trimmedBuffer), "\\r\\n", "\r\n")
+		switch state {
+		case replStateSendPing:
+			if err := sendToMaster(m, "PING"); err != nil {
+				return err
+			}
+			state = replStateReceivePong
+
+		case replStateReceivePong:
+			//? An error such as -NOAUTH is fatal, anything else is fine
+			if _, err := readMasterReply(reader, "PING"); err != nil {
+				return err
+			}
+			if err := sendToMaster(m, "REPLCONF", "listening-port", config.Port); err != nil {
+				return err
+			}
+			state = replStateReceivePort
 
-			commands, err := utils.Parser(formattedInput)
+		case replStateReceivePort:
+			if err := expectOK(reader, "REPLCONF listening-port"); err != nil {
+				return err
+			}
+			if err := sendToMaster(m, "REPLCONF", "capa", "eof", "capa", "psync2"); err != nil {
+				return err
+			}
+			state = replStateReceiveCapa
 
+		case replStateReceiveCapa:
+			if err := expectOK(reader, "REPLCONF capa"); err != nil {
+				return err
+			}
+			replID, offset := "?", int64(-1)
+			replicationMu.Lock()
+			if replication.cachedMaster {
+				replID, offset = replication.replID, replication.offset+1
+			}
+			psync := []string{"PSYNC", replID, strconv.FormatInt(offset, 10)}
+			if link.failover {
+				psync = append(psync, "FAILOVER")
+			}
+			replicationMu.Unlock()
+			if err := sendToMaster(m, psync...); err != nil {
+				return err
+			}
+			state = replStateReceivePsync
+
+		case replStateReceivePsync:
+			reply, err := readMasterReply(reader, "PSYNC")
+			endFailover(config, link, err == nil)
 			if err != nil {
-				if err == io.EOF {
-					continue
-				}
+				return err
+			}
+			if status, _ := reply.Value.(string); reply.Type == '+' && strings.HasPrefix(status, "CONTINUE") {
+				continueReplication(config, strings.TrimSpace(strings.TrimPrefix(status, "CONTINUE")))
+				log.Printf("MASTER <-> REPLICA sync: Master accepted a Partial Resynchronization")
+				state = replStateConnected
 				continue
 			}
+			replID, offset, err := parseFullResync(reply)
+			if err != nil {
+				return err
+			}
+			log.Printf("Full resync from master: %s:%d", replID, offset)
+			masterReplID, masterOffset = replID, offset
 
-			if args, ok := commands.Value.([]configuration.RESPValue); ok {
-				bytesCount := +len(formattedInput)
-
-				cmdName, _ := args[0].Value.(string)
-
-				switch strings.ToLower(cmdName) {
-				case "replconf":
-					tcp.WriteArrayResp(m, []string{"replconf", "ack", fmt.Sprint(bytesCount)})
-				case "set":
-					if len(args) < 3 {
-						tcp.WriteRESPError(m, "ERROR: INVALID_NUMBER_OF_ARGUMENTS")
-						continue
-					}
-					key, ok := args[1].Value.(string)
-					if !ok {
-						tcp.WriteRESPError(m, "ERROR: INVALID_ARGUMENT_TYPE")
-						continue
-					}
-					value, ok := args[2].Value.(string)
-					if !ok {
-						tcp.WriteRESPError(m, "ERROR: INVALID_ARGUMENT_TYPE")
-						continue
-					}
-					cache[key] = configuration.ICache{
-						Data: value,
-					}
-
-					if len(args) > 4 {
-
-						if strings.ToLower(args[3].Value.(string)) == "px" {
-							expiry, err := strconv.Atoi(args[4].Value.(string))
-							if err != nil {
-								tcp.WriteRESPError(m, "ERROR: INVALID_PX")
-								continue
-							}
-							time.AfterFunc(time.Duration(expiry)*time.Millisecond, func() {
-								delete(cache, key)
-							})
-						} else {
-							tcp.WriteRESPError(m, "ERROR: INVALID_ARGUMENT")
-							continue
-						}
-					}
-					tcp.WriteRESPSimpleString(m, "OK")
-
-				default:
-					tcp.WriteResponse(m, "ERROR: Unknown command")
-					return
-				}
+			replicationMu.Lock()
+			link.syncInProgress = true
+			replicationMu.Unlock()
+			state = replStateTransfer
+
+		case replStateTransfer:
+			//? The snapshot follows FULLRESYNC as a bulk payload without trailing CRLF
+			payload, err := reader.ReadBulkPayload()
+			if err != nil {
+				return fmt.Errorf("reading RDB payload: %v", err)
+			}
+			cache, err := utils.DecodeRDB(payload)
+			if err != nil {
+				return fmt.Errorf("loading RDB payload: %v", err)
 			}
+			loadKeyspace(config, cache)
+			resetReplication(config, masterReplID, masterOffset)
+			log.Printf("MASTER <-> REPLICA sync: Loaded %d keys (%d bytes)", len(cache), len(payload))
+			state = replStateConnected
+		}
+	}
+
+	m.SetDeadline(time.Time{})
+	return nil
+}
+
+func sendToMaster(m net.Conn, args ...string) error {
+	return tcp.WriteValue(m, utils.NewBulkStringArray(args), utils.RESP2)
+}
+
+// readMasterReply reads one reply and turns an error reply into an error
+func readMasterReply(reader *utils.RESPReader, step string) (*configuration.RESPValue, error) {
+	reply, err := reader.ReadValue()
+	if err != nil {
+		return reply, fmt.Errorf("reading reply to %s: %v", step, err)
+	}
+	if reply.Type == '-' {
+		return reply, fmt.Errorf("master replied to %s: %v", step, reply.Value)
+	}
+	return reply, nil
+}
+
+func expectOK(reader *utils.RESPReader, step string) error {
+	reply, err := readMasterReply(reader, step)
+	if err != nil {
+		return err
+	}
+	if status, _ := reply.Value.(string); reply.Type != '+' || status != utils.OK {
+		return fmt.Errorf("unexpected reply to %s: %v", step, reply.Value)
+	}
+	return nil
+}
+
+// parseFullResync extracts the replication ID and offset of +FULLRESYNC <replid> <offset>
+func parseFullResync(reply *configuration.RESPValue) (string, int64, error) {
+	status, _ := reply.Value.(string)
+	fields := strings.Fields(status)
+	if reply.Type != '+' || len(fields) != 3 || fields[0] != "FULLRESYNC" {
+		return "", 0, fmt.Errorf("unexpected reply to PSYNC: %v", reply.Value)
+	}
+
+	offset, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || len(fields[1]) != 40 {
+		return "", 0, fmt.Errorf("malformed FULLRESYNC reply: %s", status)
+	}
+	return fields[1], offset, nil
+}
 
+// resetReplication adopts the history of the master after a full resync
+func resetReplication(config *configuration.AppSettings, replID string, offset int64) {
+	replicationMu.Lock()
+	defer replicationMu.Unlock()
+
+	replication.replID = replID
+	replication.replID2 = "0000000000000000000000000000000000000000"
+	replication.secondReplOffset = -1
+	replication.offset = offset
+	replication.backlog = newReplicationBacklog(config.ReplBacklogSize, offset)
+	replication.cachedMaster = true
+
+	//? Their dataset belongs to a history that no longer exists
+	disconnectReplicas()
+}
+
+// continueReplication handles +CONTINUE [replid], the master may have been
+// given a new ID, the current one is then still valid up to the offset reached
+func continueReplication(config *configuration.AppSettings, replID string) {
+	replicationMu.Lock()
+	defer replicationMu.Unlock()
+
+	createReplicationBacklog(config)
+	if replID != "" && replID != replication.replID {
+		replication.replID2 = replication.replID
+		replication.secondReplOffset = replication.offset + 1
+		replication.replID = replID
+		disconnectReplicas()
+	}
+}
+
+// loadKeyspace replaces the whole dataset with the one received from the
+// master, keys that expired during the transfer are dropped
+func loadKeyspace(config *configuration.AppSettings, cache map[string]configuration.ICache) {
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+
+	for key := range config.RedisMap {
+		delete(config.RedisMap, key)
+	}
+
+	now := time.Now().UnixMilli()
+	for key, value := range cache {
+		if value.ExpirationMap == "" {
+			config.RedisMap[key] = value
+			continue
+		}
+		expireAt, err := strconv.ParseInt(value.ExpirationMap, 10, 64)
+		if err != nil || expireAt <= now {
+			continue
+		}
+		config.RedisMap[key] = value
+		setExpire(config, key, expireAt)
+	}
+
+	//? The AOF no longer matches, it starts over from the new dataset
+	if datasetLoaded && config.AppendOnly {
+		if err := startAppendOnly(config, true); err != nil {
+			log.Printf("Can't restart the append only file after the sync: %v", err)
 		}
 	}
 }
 
-func WriteCommandSync(replicaPorts []net.Conn, command []byte) {
+// applyReplicationStream executes the commands the master propagates through
+// the normal dispatcher, on behalf of a client standing for the master. They
+// are never answered except for REPLCONF GETACK.
+func applyReplicationStream(link *masterLink, master *Client, reader *utils.RESPReader) {
+	//? A master that stays silent longer than repl-timeout, despite its
+	//? periodic PINGs, is considered gone
+	timeout := time.Duration(master.Config.ReplTimeout) * time.Second
+
+	reader.Record()
+	for {
+		master.Conn.SetReadDeadline(time.Now().Add(timeout))
+		commandArgs, err := reader.ReadCommand()
+		if err != nil {
+			if err == io.EOF {
+				log.Println("Connection closed by master")
+				return
+			}
+			log.Printf("Error reading from master: %v", err)
+			return
+		}
+
+		//? Commands still buffered when REPLICAOF closed the link are dropped
+		if link.isClosed() {
+			return
+		}
+
+		master.replStream = append(master.replStream, reader.Recorded()...)
+
+		cmdName, args, err := validateCommand(commandArgs)
+		switch {
+		case err != nil || cmdName == "":
+		case cmdName == "replconf":
+			//? GETACK is answered with the offset before the GETACK itself
+			if len(args) > 1 {
+				if option, _ := args[1].Value.(string); strings.ToLower(option) == "getack" {
+					sendReplicationAck(master)
+				}
+			}
+		default:
+			if reply := processCommand(master, cmdName, args); reply.Type == '-' {
+				log.Printf("Error applying '%s' from master: %v", cmdName, reply.Value)
+			}
+		}
+
+		//? The offset follows every byte processed, including those that ran
+		//? no command. Queued commands wait for their EXEC.
+		if !master.Tx.InvokedTx && len(master.replStream) > 0 {
+			keyspaceMu.Lock()
+			forwardReplicationStream(master)
+			keyspaceMu.Unlock()
+		}
 
-	for _, m := range replicaPorts {
-		m.Write(command)
+		replicationMu.Lock()
+		link.lastIO = time.Now()
+		replicationMu.Unlock()
 	}
 }
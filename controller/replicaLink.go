@@ -0,0 +1,185 @@
+package controller
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// replicaLink is the master side of a replica connection. The stream is
+// queued and written by a goroutine of its own, so a slow replica never
+// blocks the clients whose writes are propagated.
+type replicaLink struct {
+	client *Client
+	//? Replication offset the replica acknowledged, and when
+	ackOffset int64
+	ackTime   time.Time
+	//? Replication offset the replica fsynced to its AOF, -1 without AOF
+	fsyncOffset int64
+	//? Set while the snapshot, or the backlog of a partial resync, is
+	//? written, guarded by replicationMu
+	sendingSnapshot bool
+
+	//? The reply to PSYNC and the backlog or snapshot, written before the
+	//? stream and outside of the output buffer limits
+	preamble [][]byte
+
+	mu           sync.Mutex
+	pending      [][]byte
+	pendingBytes int
+	//? When the output went over the soft limit, zero while below it
+	softLimitSince time.Time
+	closed         bool
+	//? Signals the writer that there is something to send or to stop
+	wake chan struct{}
+}
+
+func newReplicaLink(c *Client) *replicaLink {
+	return &replicaLink{client: c, ackTime: time.Now(), fsyncOffset: -1, wake: make(chan struct{}, 1)}
+}
+
+// enqueue adds data to the output of the replica and disconnects it once
+// client-output-buffer-limit replica is reached
+func (link *replicaLink) enqueue(data []byte) {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+
+	if link.closed {
+		return
+	}
+	link.pending = append(link.pending, data)
+	link.pendingBytes += len(data)
+
+	limit := link.client.Config.ReplicaOutputBufferLimit
+	switch {
+	case limit.Hard > 0 && link.pendingBytes > limit.Hard:
+		link.disconnect("hard")
+		return
+	case limit.Soft > 0 && link.pendingBytes > limit.Soft:
+		if link.softLimitSince.IsZero() {
+			link.softLimitSince = time.Now()
+		} else if time.Since(link.softLimitSince) > time.Duration(limit.SoftSeconds)*time.Second {
+			link.disconnect("soft")
+			return
+		}
+	default:
+		link.softLimitSince = time.Time{}
+	}
+
+	select {
+	case link.wake <- struct{}{}:
+	default:
+	}
+}
+
+// disconnect drops a replica that fell too far behind, its connection handler
+// then releases it. The caller holds link.mu.
+func (link *replicaLink) disconnect(limit string) {
+	log.Printf("Closing replica %s: %s output buffer limit reached (%d bytes pending)", link.client.Conn.RemoteAddr(), limit, link.pendingBytes)
+	link.closeLocked()
+	link.client.Conn.Close()
+}
+
+func (link *replicaLink) close() {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+
+	link.closeLocked()
+}
+
+func (link *replicaLink) closeLocked() {
+	if link.closed {
+		return
+	}
+	link.closed = true
+	link.pending = nil
+	link.pendingBytes = 0
+	close(link.wake)
+}
+
+// writeLoop sends the preamble then the queued stream until the link is
+// closed, a write error closes the connection
+func (link *replicaLink) writeLoop() {
+	if link.preamble != nil {
+		if err := link.writePreamble(); err != nil {
+			log.Printf("Error writing to replica %s: %v", link.client.Conn.RemoteAddr(), err)
+			link.client.Conn.Close()
+			return
+		}
+		link.syncDone()
+	}
+
+	for range link.wake {
+		link.mu.Lock()
+		pending := link.pending
+		link.pending = nil
+		link.mu.Unlock()
+
+		for _, data := range pending {
+			link.client.writeMu.Lock()
+			_, err := link.client.Conn.Write(data)
+			link.client.writeMu.Unlock()
+
+			if err != nil {
+				log.Printf("Error writing to replica %s: %v", link.client.Conn.RemoteAddr(), err)
+				link.client.Conn.Close()
+				return
+			}
+
+			link.mu.Lock()
+			if link.closed {
+				link.mu.Unlock()
+				return
+			}
+			link.pendingBytes -= len(data)
+			link.mu.Unlock()
+		}
+	}
+}
+
+// writePreamble sends the preamble, a diskless sync sends the snapshot after
+// it rather than in it
+func (link *replicaLink) writePreamble() error {
+	for _, data := range link.preamble {
+		if err := link.writeSnapshot(data); err != nil {
+			return err
+		}
+	}
+	link.preamble = nil
+	return nil
+}
+
+// ? Size of the writes of a snapshot, each is given repl-timeout to complete
+const replSnapshotChunk = 64 * 1024
+
+// writeSnapshot writes part of the snapshot with a deadline of repl-timeout
+// per chunk: the replica can't acknowledge anything before it has the whole
+// snapshot, only the progress of the transfer tells it is still there
+func (link *replicaLink) writeSnapshot(data []byte) error {
+	conn := link.client.Conn
+	timeout := time.Duration(link.client.Config.ReplTimeout) * time.Second
+
+	link.client.writeMu.Lock()
+	defer link.client.writeMu.Unlock()
+	defer conn.SetWriteDeadline(time.Time{})
+
+	for len(data) > 0 {
+		chunk := data[:min(len(data), replSnapshotChunk)]
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+		if _, err := conn.Write(chunk); err != nil {
+			return err
+		}
+		data = data[len(chunk):]
+	}
+	return nil
+}
+
+// syncDone ends the transfer of the snapshot, the replica is then timed out
+// on its acknowledgements again, counted from now
+func (link *replicaLink) syncDone() {
+	replicationMu.Lock()
+	defer replicationMu.Unlock()
+
+	link.sendingSnapshot = false
+	link.ackTime = time.Now()
+}
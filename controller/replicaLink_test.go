@@ -0,0 +1,106 @@
+package controller
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	configuration "github.com/oussamasf/yuji/config"
+)
+
+// newTestReplicaLink returns a link over an in-memory connection, and the
+// end the replica reads from
+func newTestReplicaLink(t *testing.T, limit configuration.OutputBufferLimit) (*replicaLink, net.Conn) {
+	master, replica := net.Pipe()
+	t.Cleanup(func() {
+		master.Close()
+		replica.Close()
+	})
+	config := &configuration.AppSettings{ReplicaOutputBufferLimit: limit}
+	return newReplicaLink(NewClient(master, config)), replica
+}
+
+func TestReplicaLinkOutputBufferLimit(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit configuration.OutputBufferLimit
+		sizes []int
+		//? Pause between two writes, to let the soft limit expire
+		pause          time.Duration
+		wantDisconnect bool
+	}{
+		{name: "under the limits", limit: configuration.OutputBufferLimit{Hard: 100, Soft: 50, SoftSeconds: 60}, sizes: []int{20, 20}},
+		{name: "over the hard limit", limit: configuration.OutputBufferLimit{Hard: 100}, sizes: []int{60, 60}, wantDisconnect: true},
+		{name: "briefly over the soft limit", limit: configuration.OutputBufferLimit{Hard: 1000, Soft: 50, SoftSeconds: 60}, sizes: []int{60, 1}},
+		{name: "over the soft limit for too long", limit: configuration.OutputBufferLimit{Soft: 50}, sizes: []int{60, 1}, pause: 10 * time.Millisecond, wantDisconnect: true},
+		{name: "no limits", sizes: []int{1 << 20, 1 << 20}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//? Nothing reads the output, it all stays pending
+			link, replica := newTestReplicaLink(t, tt.limit)
+			for i, size := range tt.sizes {
+				if i > 0 {
+					time.Sleep(tt.pause)
+				}
+				link.enqueue(make([]byte, size))
+			}
+
+			link.mu.Lock()
+			closed := link.closed
+			link.mu.Unlock()
+			if closed != tt.wantDisconnect {
+				t.Fatalf("link closed = %v, want %v", closed, tt.wantDisconnect)
+			}
+			if !tt.wantDisconnect {
+				return
+			}
+			//? The replica sees its connection dropped
+			replica.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := replica.Read(make([]byte, 1)); err != io.EOF {
+				t.Fatalf("replica read error = %v, want %v", err, io.EOF)
+			}
+		})
+	}
+}
+
+func TestReplicaLinkWriteLoop(t *testing.T) {
+	link, replica := newTestReplicaLink(t, configuration.OutputBufferLimit{})
+	go link.writeLoop()
+
+	//? Queuing doesn't wait for the replica to read
+	parts := []string{"*1\r\n", "$4\r\n", "PING\r\n"}
+	done := make(chan struct{})
+	go func() {
+		for _, part := range parts {
+			link.enqueue([]byte(part))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("enqueue blocked on a replica that doesn't read")
+	}
+
+	want := strings.Join(parts, "")
+	got := make([]byte, len(want))
+	replica.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(replica, got); err != nil {
+		t.Fatalf("reading the stream: %v", err)
+	}
+	if string(got) != want {
+		t.Fatalf("replica received %q, want %q", got, want)
+	}
+
+	link.close()
+	link.enqueue([]byte("lost"))
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	if link.pendingBytes != 0 {
+		t.Fatalf("closed link holds %d pending bytes", link.pendingBytes)
+	}
+}
@@ -0,0 +1,660 @@
+package controller
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	configuration "github.com/oussamasf/yuji/config"
+	"github.com/oussamasf/yuji/utils"
+)
+
+// replicationState is the position of this server in the replication
+// history. A replica shares the ID and offset of its master, replid2 keeps
+// the previous ID valid up to secondReplOffset after a change of master.
+type replicationState struct {
+	replID           string
+	replID2          string
+	secondReplOffset int64
+	//? Total number of bytes propagated, or received from the master
+	offset  int64
+	backlog *replicationBacklog
+	//? Set on a replica once it holds the history of replID, it then asks
+	//? its master to continue from offset instead of a full resync
+	cachedMaster bool
+}
+
+// replicationMu guards replication, replicaLinks and waitRequests, propagation also
+// happens outside of keyspaceMu, e.g. for shard messages
+var replicationMu sync.Mutex
+
+var replication = replicationState{
+	replID:           newReplicationID(),
+	replID2:          "0000000000000000000000000000000000000000",
+	secondReplOffset: -1,
+}
+
+var replicaLinks = []*replicaLink{}
+
+// waitRequest is a client blocked in WAIT until enough replicas acknowledged
+// its writes, or in WAITAOF until enough of them and the local AOF fsynced them
+type waitRequest struct {
+	client      *Client
+	offset      int64
+	numReplicas int
+	//? WAITAOF, aofOffset is where the local AOF must be fsynced to
+	aof       bool
+	numLocal  int
+	aofOffset int64
+	//? Receives the reply once the request is satisfied or timed out
+	done chan configuration.RESPValue
+}
+
+var waitRequests = []*waitRequest{}
+
+// ? Replication ID replicas sync against, 40 hex characters like in Redis
+func newReplicationID() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// replicationBacklog is a circular buffer holding the last bytes sent to
+// replicas, a replica that reconnects is sent what it missed from there
+type replicationBacklog struct {
+	buf []byte
+	//? Next write position in buf
+	idx     int
+	histlen int
+	//? Replication offset of the first byte held, offsets start at 1
+	offset int64
+}
+
+func newReplicationBacklog(size int, masterOffset int64) *replicationBacklog {
+	return &replicationBacklog{buf: make([]byte, size), offset: masterOffset + 1}
+}
+
+func (b *replicationBacklog) feed(data []byte) {
+	size := len(b.buf)
+
+	//? Only the tail of a write bigger than the whole backlog survives
+	skipped := 0
+	if len(data) > size {
+		skipped = len(data) - size
+		data = data[skipped:]
+	}
+
+	for len(data) > 0 {
+		n := copy(b.buf[b.idx:], data)
+		b.idx = (b.idx + n) % size
+		data = data[n:]
+		if b.histlen += n; b.histlen > size {
+			skipped += b.histlen - size
+			b.histlen = size
+		}
+	}
+	b.offset += int64(skipped)
+}
+
+// covers reports whether every byte from offset onwards is still held
+func (b *replicationBacklog) covers(offset int64) bool {
+	return offset >= b.offset && offset <= b.offset+int64(b.histlen)
+}
+
+// since copies the bytes from offset to the end of the backlog
+func (b *replicationBacklog) since(offset int64) []byte {
+	skip := int(offset - b.offset)
+	length := b.histlen - skip
+	start := ((b.idx-b.histlen+skip)%len(b.buf) + len(b.buf)) % len(b.buf)
+
+	data := make([]byte, 0, length)
+	for length > 0 {
+		chunk := b.buf[start:min(start+length, len(b.buf))]
+		data = append(data, chunk...)
+		length -= len(chunk)
+		start = 0
+	}
+	return data
+}
+
+// resize keeps the most recent bytes that fit in the new size
+func (b *replicationBacklog) resize(size int) {
+	data := b.since(b.offset)
+	end := b.offset + int64(len(data))
+
+	b.buf = make([]byte, size)
+	b.idx = 0
+	b.histlen = 0
+	b.offset = end - int64(min(len(data), size))
+	b.feed(data[len(data)-min(len(data), size):])
+}
+
+// createReplicationBacklog is called when the first replica syncs, before
+// that nothing is propagated and the offset doesn't move. The caller holds
+// replicationMu.
+func createReplicationBacklog(config *configuration.AppSettings) {
+	if replication.backlog == nil {
+		replication.backlog = newReplicationBacklog(config.ReplBacklogSize, replication.offset)
+	}
+}
+
+// propagate sends a command to every replica and records it in the backlog,
+// advancing the replication offset, then appends it to the AOF
+func propagate(args []string) {
+	replicationMu.Lock()
+	feedReplicationStream(utils.EncodeValue(utils.NewBulkStringArray(args), utils.RESP2))
+	offset := replication.offset
+	replicationMu.Unlock()
+
+	feedAppendOnlyFile([][]string{args}, offset)
+}
+
+// flushPropagation sends what the last command wrote to the replicas and the
+// AOF, the writes of a transaction are wrapped in MULTI/EXEC so they apply
+// atomically. A replica forwards the stream of its master instead.
+func flushPropagation(c *Client) {
+	propagation := c.propagation
+	c.propagation = nil
+	//? What the AOF replays is in it already
+	if c.isAOFLoader {
+		return
+	}
+
+	commands := make([][]string, 0, len(propagation))
+	writes := make([][]string, 0, len(propagation))
+	for _, command := range propagation {
+		commands = append(commands, command.args)
+		if !command.replicaOnly {
+			writes = append(writes, command.args)
+		}
+	}
+	markDirty(len(writes))
+	if len(commands) > 1 {
+		commands = append([][]string{{"MULTI"}}, append(commands, []string{"EXEC"})...)
+	}
+	if len(writes) > 1 {
+		writes = append([][]string{{"MULTI"}}, append(writes, []string{"EXEC"})...)
+	}
+
+	var offset int64
+	if c.isMasterLink {
+		offset = forwardReplicationStream(c)
+	} else if len(commands) > 0 && !c.Config.IsSlave {
+		offset = feedReplicationCommands(commands)
+		//? WAIT waits for the replicas to reach this offset
+		if len(writes) > 0 {
+			c.replOffset = offset
+		}
+	}
+	//? Local writes of a writable replica are only logged
+	if len(writes) > 0 {
+		c.aofOffset = feedAppendOnlyFile(writes, offset)
+	}
+}
+
+// feedReplicationCommands propagates commands and returns the replication
+// offset right after them
+func feedReplicationCommands(commands [][]string) int64 {
+	replicationMu.Lock()
+	defer replicationMu.Unlock()
+
+	for _, args := range commands {
+		feedReplicationStream(utils.EncodeValue(utils.NewBulkStringArray(args), utils.RESP2))
+	}
+	return replication.offset
+}
+
+// forwardReplicationStream passes the bytes received from our master on to the
+// sub-replicas unchanged, so the whole chain shares one replid and offset, and
+// returns the offset reached. The caller holds keyspaceMu, a snapshot then
+// never includes a write its offset does not.
+func forwardReplicationStream(master *Client) int64 {
+	replicationMu.Lock()
+	defer replicationMu.Unlock()
+
+	if len(master.replStream) > 0 {
+		feedReplicationStream(master.replStream)
+		master.replStream = nil
+	}
+	return replication.offset
+}
+
+// requestAcks asks every replica for its offset. A replica does not add to the
+// stream it forwards, its offsets are those of its master. The caller holds
+// replicationMu.
+func requestAcks(config *configuration.AppSettings) {
+	if config.IsSlave {
+		return
+	}
+	feedReplicationStream(utils.EncodeValue(utils.NewBulkStringArray([]string{"REPLCONF", "GETACK", "*"}), utils.RESP2))
+}
+
+// feedReplicationStream appends raw protocol to the replication stream. The
+// caller holds replicationMu.
+func feedReplicationStream(command []byte) {
+	if replication.backlog == nil {
+		return
+	}
+	replication.backlog.feed(command)
+	replication.offset += int64(len(command))
+	for _, link := range replicaLinks {
+		link.enqueue(command)
+	}
+}
+
+// addReplica starts streaming to a replica that just synced. The caller holds
+// replicationMu.
+func addReplica(c *Client, preamble ...[]byte) {
+	link := registerReplica(c)
+	link.preamble = preamble
+	link.sendingSnapshot = len(preamble) > 0
+	go link.writeLoop()
+}
+
+// registerReplica queues the replication stream for a replica without sending
+// it yet, a diskless sync first has to write the snapshot. The caller holds
+// replicationMu.
+func registerReplica(c *Client) *replicaLink {
+	c.replica = newReplicaLink(c)
+	replicaLinks = append(replicaLinks, c.replica)
+
+	replicationCronOnce.Do(func() {
+		go replicationCron(c.Config)
+	})
+	return c.replica
+}
+
+// ? How often a master pings its replicas so they can tell it is alive
+const replPingPeriod = 10 * time.Second
+
+var replicationCronOnce sync.Once
+
+// replicationCron pings the replicas and drops the ones that stopped
+// acknowledging for longer than repl-timeout once in sync
+func replicationCron(config *configuration.AppSettings) {
+	lastPing := time.Now()
+	for range time.Tick(time.Second) {
+		replicationMu.Lock()
+
+		//? A replica forwards the pings of its own master instead
+		if !config.IsSlave && len(replicaLinks) > 0 && time.Since(lastPing) >= replPingPeriod {
+			feedReplicationStream(utils.EncodeValue(utils.NewBulkStringArray([]string{"PING"}), utils.RESP2))
+			lastPing = time.Now()
+		}
+
+		timeout := time.Duration(config.ReplTimeout) * time.Second
+		for _, link := range replicaLinks {
+			//? No ACK comes before the snapshot is received, the transfer
+			//? has timeouts of its own
+			if !link.sendingSnapshot && time.Since(link.ackTime) > timeout {
+				log.Printf("Disconnecting timedout replica %s", link.client.Conn.RemoteAddr())
+				link.client.Conn.Close()
+			}
+		}
+
+		replicationMu.Unlock()
+	}
+}
+
+// disconnectReplicas closes the connection of every replica, they reconnect
+// and resync. The caller holds replicationMu.
+func disconnectReplicas() {
+	for _, link := range replicaLinks {
+		link.client.Conn.Close()
+	}
+}
+
+// releaseReplica forgets a replica whose connection is gone
+func releaseReplica(c *Client) {
+	replicationMu.Lock()
+	defer replicationMu.Unlock()
+
+	for i, link := range replicaLinks {
+		if link.client == c {
+			replicaLinks = append(replicaLinks[:i:i], replicaLinks[i+1:]...)
+			link.close()
+			break
+		}
+	}
+	for _, request := range waitRequests {
+		if request.client == c {
+			removeWaitRequest(request)
+			break
+		}
+	}
+	for i, waiting := range disklessWaiting {
+		if waiting == c {
+			disklessWaiting = append(disklessWaiting[:i:i], disklessWaiting[i+1:]...)
+			break
+		}
+	}
+	for i, waiting := range bgsaveWaiting {
+		if waiting == c {
+			bgsaveWaiting = append(bgsaveWaiting[:i:i], bgsaveWaiting[i+1:]...)
+			break
+		}
+	}
+}
+
+// removeWaitRequest reports whether the request was still waiting. The caller
+// holds replicationMu.
+func removeWaitRequest(request *waitRequest) bool {
+	for i, candidate := range waitRequests {
+		if candidate == request {
+			waitRequests = append(waitRequests[:i:i], waitRequests[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// acknowledgeOffset records a REPLCONF ACK, with the offset the replica
+// fsynced to its AOF or -1, and answers the requests it satisfies
+func acknowledgeOffset(c *Client, offset int64, fsyncOffset int64) {
+	replicationMu.Lock()
+	defer replicationMu.Unlock()
+
+	if c.replica == nil {
+		return
+	}
+	c.replica.ackOffset = max(c.replica.ackOffset, offset)
+	c.replica.fsyncOffset = max(c.replica.fsyncOffset, fsyncOffset)
+	c.replica.ackTime = time.Now()
+
+	answerWaitRequests()
+	checkFailoverProgress(c.Config)
+}
+
+// answerWaitRequests answers the WAIT and WAITAOF requests now satisfied. The
+// caller holds replicationMu.
+func answerWaitRequests() {
+	pending := waitRequests[:0]
+	for _, request := range waitRequests {
+		if reply, done := request.reply(); done {
+			request.done <- reply
+			continue
+		}
+		pending = append(pending, request)
+	}
+	waitRequests = pending
+}
+
+// reply is what the request is answered with so far, and whether that is
+// enough. The caller holds replicationMu.
+func (request *waitRequest) reply() (configuration.RESPValue, bool) {
+	if !request.aof {
+		acked := ackedReplicas(request.offset)
+		return utils.NewInteger(int64(acked)), acked >= request.numReplicas
+	}
+
+	local := 0
+	if request.numLocal > 0 && aofFsynced(request.aofOffset) {
+		local = 1
+	}
+	fsynced := fsyncedReplicas(request.offset)
+	reply := utils.NewArray(utils.NewInteger(int64(local)), utils.NewInteger(int64(fsynced)))
+	return reply, local >= request.numLocal && fsynced >= request.numReplicas
+}
+
+// ackedReplicas counts the replicas that processed the stream up to offset.
+// The caller holds replicationMu.
+func ackedReplicas(offset int64) int {
+	count := 0
+	for _, link := range replicaLinks {
+		if link.ackOffset >= offset {
+			count++
+		}
+	}
+	return count
+}
+
+// fsyncedReplicas counts the replicas whose AOF is on disk up to offset. The
+// caller holds replicationMu.
+func fsyncedReplicas(offset int64) int {
+	count := 0
+	for _, link := range replicaLinks {
+		if link.fsyncOffset >= offset {
+			count++
+		}
+	}
+	return count
+}
+
+// canPartialResync reports whether a replica that has seen the history of
+// replID up to offset-1 can be sent the rest from the backlog. The caller
+// holds replicationMu.
+func canPartialResync(replID string, offset int64) bool {
+	if replication.backlog == nil || !replication.backlog.covers(offset) {
+		return false
+	}
+	return replID == replication.replID || (replID == replication.replID2 && offset <= replication.secondReplOffset)
+}
+
+// replicaInfo describes a replica the way INFO and ROLE list it
+type replicaInfo struct {
+	ip     string
+	port   int
+	state  string
+	offset int64
+	lag    int64
+}
+
+// connectedReplicas lists the replicas streaming from this server, then those
+// still waiting for a snapshot. The caller holds replicationMu.
+func connectedReplicas() []replicaInfo {
+	replicas := []replicaInfo{}
+	for _, link := range replicaLinks {
+		state := "online"
+		if link.sendingSnapshot {
+			state = "send_bulk"
+		}
+		replicas = append(replicas, newReplicaInfo(link.client, state, link.ackOffset, int64(time.Since(link.ackTime).Seconds())))
+	}
+	for _, c := range append(disklessWaiting, bgsaveWaiting...) {
+		replicas = append(replicas, newReplicaInfo(c, "wait_bgsave", 0, 0))
+	}
+	return replicas
+}
+
+func newReplicaInfo(c *Client, state string, offset int64, lag int64) replicaInfo {
+	//? Unless it announced another one, the replica is reached at the address
+	//? it connected from
+	ip := c.replicaAnnouncedIP
+	if ip == "" {
+		if addr, ok := c.Conn.RemoteAddr().(*net.TCPAddr); ok {
+			ip = addr.IP.String()
+		}
+	}
+	return replicaInfo{ip: ip, port: c.replicaListeningPort, state: state, offset: offset, lag: lag}
+}
+
+// ? ROLE
+func roleCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	replicationMu.Lock()
+	defer replicationMu.Unlock()
+
+	link := currentMasterLink
+	if link == nil {
+		replicas := []configuration.RESPValue{}
+		for _, replica := range connectedReplicas() {
+			replicas = append(replicas, utils.NewBulkStringArray([]string{
+				replica.ip, strconv.Itoa(replica.port), strconv.FormatInt(replica.offset, 10),
+			}))
+		}
+		return utils.NewArray(
+			utils.NewBulkString("master"),
+			utils.NewInteger(replication.offset),
+			utils.NewArray(replicas...),
+		)
+	}
+
+	state, offset := "connect", int64(-1)
+	switch {
+	case link.up:
+		state, offset = "connected", replication.offset
+	case link.syncInProgress:
+		state = "sync"
+	}
+	port, _ := strconv.Atoi(link.port)
+	return utils.NewArray(
+		utils.NewBulkString("slave"),
+		utils.NewBulkString(link.host),
+		utils.NewInteger(int64(port)),
+		utils.NewBulkString(state),
+		utils.NewInteger(offset),
+	)
+}
+
+// ? WAIT numreplicas timeout
+func waitCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	numReplicasArg, _ := args[1].Value.(string)
+	timeoutArg, _ := args[2].Value.(string)
+
+	numReplicas, err := strconv.Atoi(numReplicasArg)
+	if err != nil {
+		return utils.NewError("ERR value is not an integer or out of range")
+	}
+	timeout, err := parseWaitTimeout(timeoutArg)
+	if err != nil {
+		return utils.NewError(err.Error())
+	}
+
+	if c.Config.IsSlave {
+		return utils.NewError("ERR WAIT cannot be used with replica instances.")
+	}
+
+	return blockWaitRequest(c, &waitRequest{client: c, offset: c.replOffset, numReplicas: numReplicas}, timeout)
+}
+
+// ? WAITAOF numlocal numreplicas timeout
+func waitaofCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	numLocalArg, _ := args[1].Value.(string)
+	numReplicasArg, _ := args[2].Value.(string)
+	timeoutArg, _ := args[3].Value.(string)
+
+	numLocal, err := strconv.Atoi(numLocalArg)
+	if err != nil {
+		return utils.NewError("ERR value is not an integer or out of range")
+	}
+	numReplicas, err := strconv.Atoi(numReplicasArg)
+	if err != nil {
+		return utils.NewError("ERR value is not an integer or out of range")
+	}
+	timeout, err := parseWaitTimeout(timeoutArg)
+	if err != nil {
+		return utils.NewError(err.Error())
+	}
+
+	if c.Config.IsSlave {
+		return utils.NewError("ERR WAITAOF cannot be used with replica instances. Please also note that writes to replicas are just local and are not propagated.")
+	}
+	if numLocal > 0 && !c.Config.AppendOnly {
+		return utils.NewError("ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled.")
+	}
+
+	return blockWaitRequest(c, &waitRequest{
+		client:      c,
+		offset:      c.replOffset,
+		numReplicas: numReplicas,
+		aof:         true,
+		numLocal:    numLocal,
+		aofOffset:   c.aofOffset,
+	}, timeout)
+}
+
+func parseWaitTimeout(arg string) (int64, error) {
+	timeout, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, errors.New("ERR timeout is not an integer or out of range")
+	}
+	if timeout < 0 {
+		return 0, errors.New("ERR timeout is negative")
+	}
+	return timeout, nil
+}
+
+// blockWaitRequest answers request right away when it is satisfied, otherwise
+// blocks the client until it is or until timeout milliseconds passed, see
+// Client.blocked
+func blockWaitRequest(c *Client, request *waitRequest, timeout int64) configuration.RESPValue {
+	replicationMu.Lock()
+	defer replicationMu.Unlock()
+
+	//? A transaction can't wait, it gets the current counts like with a zero
+	//? timeout
+	if reply, done := request.reply(); done || c.Tx.InvokedTx {
+		return reply
+	}
+
+	//? The connection reads nothing more until the reply is written, once
+	//? processCommand released keyspaceMu
+	request.done = make(chan configuration.RESPValue, 1)
+	c.blocked = request.done
+	waitRequests = append(waitRequests, request)
+
+	//? Ask for acknowledgements now rather than waiting for the next heartbeats
+	requestAcks(c.Config)
+
+	//? A zero timeout blocks until the request is satisfied
+	if timeout > 0 {
+		time.AfterFunc(time.Duration(timeout)*time.Millisecond, func() {
+			replicationMu.Lock()
+			defer replicationMu.Unlock()
+
+			if removeWaitRequest(request) {
+				reply, _ := request.reply()
+				request.done <- reply
+			}
+		})
+	}
+
+	return noReply
+}
+
+// ? REPLICAOF host port | REPLICAOF NO ONE
+func replicaofCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	host, _ := args[1].Value.(string)
+	port, _ := args[2].Value.(string)
+
+	if strings.EqualFold(host, "no") && strings.EqualFold(port, "one") {
+		replicationMu.Lock()
+		defer replicationMu.Unlock()
+
+		if c.Config.IsSlave {
+			promoteToMaster(c.Config)
+			log.Printf("MASTER MODE enabled (user request from 'id=%d')", c.ID)
+		}
+		return utils.NewSimpleString(utils.OK)
+	}
+
+	if portNumber, err := strconv.Atoi(port); err != nil || portNumber < 0 || portNumber > 65535 {
+		return utils.NewError("ERR Invalid master port")
+	}
+
+	replicationMu.Lock()
+	if currentMasterLink != nil && currentMasterLink.host == host && currentMasterLink.port == port {
+		replicationMu.Unlock()
+		return utils.NewSimpleString("OK Already connected to specified master")
+	}
+	replicationMu.Unlock()
+
+	ReplicaOf(c.Config, host, port)
+	log.Printf("REPLICAOF %s:%s enabled (user request from 'id=%d')", host, port, c.ID)
+	return utils.NewSimpleString(utils.OK)
+}
+
+// resizeReplicationBacklog applies a new repl-backlog-size
+func resizeReplicationBacklog(size int) {
+	replicationMu.Lock()
+	defer replicationMu.Unlock()
+
+	if replication.backlog != nil {
+		replication.backlog.resize(size)
+	}
+}
@@ -0,0 +1,142 @@
+package controller
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	configuration "github.com/oussamasf/yuji/config"
+	"github.com/oussamasf/yuji/utils"
+)
+
+func TestReplicationBacklogSince(t *testing.T) {
+	tests := []struct {
+		name       string
+		feeds      []string
+		offset     int64
+		wantCovers bool
+		want       string
+	}{
+		{name: "empty", offset: 1, wantCovers: true, want: ""},
+		{name: "from the start", feeds: []string{"abc"}, offset: 1, wantCovers: true, want: "abc"},
+		{name: "from the middle", feeds: []string{"abc"}, offset: 2, wantCovers: true, want: "bc"},
+		{name: "up to date", feeds: []string{"abc"}, offset: 4, wantCovers: true, want: ""},
+		{name: "ahead", feeds: []string{"abc"}, offset: 5},
+		{name: "before the start", feeds: []string{"abc"}, offset: 0},
+		{name: "exactly full", feeds: []string{"abcdefgh"}, offset: 1, wantCovers: true, want: "abcdefgh"},
+		{name: "wrapped, oldest byte", feeds: []string{"abcdef", "ghij"}, offset: 3, wantCovers: true, want: "cdefghij"},
+		{name: "wrapped, across the end", feeds: []string{"abcdef", "ghij"}, offset: 7, wantCovers: true, want: "ghij"},
+		{name: "wrapped, at the end", feeds: []string{"abcdef", "ghij"}, offset: 8, wantCovers: true, want: "hij"},
+		{name: "wrapped, at the start", feeds: []string{"abcdef", "ghij"}, offset: 9, wantCovers: true, want: "ij"},
+		{name: "wrapped, overwritten", feeds: []string{"abcdef", "ghij"}, offset: 2},
+		{name: "write bigger than the backlog", feeds: []string{"abc", "0123456789"}, offset: 6, wantCovers: true, want: "23456789"},
+		{name: "many wraps", feeds: []string{"abcde", "fghij", "klmno", "pqrst"}, offset: 15, wantCovers: true, want: "opqrst"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backlog := newReplicationBacklog(8, 0)
+			for _, data := range tt.feeds {
+				backlog.feed([]byte(data))
+			}
+
+			if covers := backlog.covers(tt.offset); covers != tt.wantCovers {
+				t.Fatalf("covers(%d) = %v, want %v", tt.offset, covers, tt.wantCovers)
+			}
+			if !tt.wantCovers {
+				return
+			}
+			if got := string(backlog.since(tt.offset)); got != tt.want {
+				t.Fatalf("since(%d) = %q, want %q", tt.offset, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplicationBacklogResize(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       int
+		wantOffset int64
+		want       string
+	}{
+		{name: "grow", size: 16, wantOffset: 3, want: "cdefghij"},
+		{name: "shrink", size: 4, wantOffset: 7, want: "ghij"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backlog := newReplicationBacklog(8, 0)
+			backlog.feed([]byte("abcdef"))
+			backlog.feed([]byte("ghij"))
+			backlog.resize(tt.size)
+
+			if got := string(backlog.since(backlog.offset)); backlog.offset != tt.wantOffset || got != tt.want {
+				t.Fatalf("after resize(%d) offset %d holds %q, want offset %d holding %q", tt.size, backlog.offset, got, tt.wantOffset, tt.want)
+			}
+
+			//? New writes keep following the old ones
+			backlog.feed([]byte("kl"))
+			if got := string(backlog.since(11)); got != "kl" {
+				t.Fatalf("since(11) = %q, want %q", got, "kl")
+			}
+		})
+	}
+}
+
+func TestDiskFullResync(t *testing.T) {
+	config := newTestConfig()
+	config.Dir = t.TempDir()
+	config.DBFileName = "dump.rdb"
+	config.ReplTimeout = 60
+	writer := newTestConn(t, config)
+	replica := newTestConn(t, config)
+
+	writer.do("SET", "k", "v")
+	reply := replica.do("PSYNC", "?", "-1")
+	if line, _ := reply.Value.(string); !strings.HasPrefix(line, "FULLRESYNC ") {
+		t.Fatalf("PSYNC = %v, want FULLRESYNC", reply.Value)
+	}
+	replica.conn.SetReadDeadline(time.Now().Add(time.Second))
+	dump, err := replica.reader.ReadBulkPayload()
+	if err != nil {
+		t.Fatalf("reading the snapshot: %v", err)
+	}
+	want := utils.EncodeRDB(map[string]configuration.ICache{"k": {Type: configuration.String, Data: "v"}})
+	if !bytes.Equal(dump, want) {
+		t.Fatalf("snapshot = %q, want %q", dump, want)
+	}
+
+	//? The snapshot is the dump of a BGSAVE, which counts as a save
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		keyspaceMu.Lock()
+		inProgress, dirty := rdb.bgsaveInProgress, rdb.dirty
+		keyspaceMu.Unlock()
+		if !inProgress {
+			if dirty != 0 {
+				t.Fatalf("%d changes since the last save, want 0", dirty)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("BGSAVE still in progress")
+		}
+	}
+
+	//? Writes after the snapshot follow it on the stream
+	writer.do("SET", "k2", "v2")
+	for {
+		command, err := replica.read(time.Second)
+		if err != nil {
+			t.Fatalf("reading the stream: %v", err)
+		}
+		if got := replyStrings(command); !reflect.DeepEqual(got, []string{"REPLCONF", "GETACK", "*"}) {
+			if want := []string{"SET", "k2", "v2"}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("replica received %q, want %q", got, want)
+			}
+			break
+		}
+	}
+}
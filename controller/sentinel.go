@@ -0,0 +1,610 @@
+package controller
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	configuration "github.com/oussamasf/yuji/config"
+	"github.com/oussamasf/yuji/service/tcp"
+	"github.com/oussamasf/yuji/utils"
+)
+
+// ? Sentinels announce themselves, and the configuration they know of, on
+// ? this channel of every monitored instance
+const sentinelHelloChannel = "__sentinel__:hello"
+
+const (
+	sentinelTickPeriod  = 100 * time.Millisecond
+	sentinelPingPeriod  = time.Second
+	sentinelInfoPeriod  = 10 * time.Second
+	sentinelHelloPeriod = 2 * time.Second
+	sentinelAskPeriod   = time.Second
+	//? INFO is refreshed every second while the master is down or failing over
+	sentinelFailoverInfoPeriod = time.Second
+	//? Time allowed to connect to an instance and get a reply
+	sentinelCommandTimeout = time.Second
+	//? Randomizes when sentinels start a failover, so one of them gets there first
+	sentinelMaxDesync       = time.Second
+	sentinelElectionTimeout = 10 * time.Second
+	//? An instance with the wrong role is fixed only after this long, it may be
+	//? in the middle of a failover run by another sentinel
+	sentinelFixConfigDelay = 4 * sentinelHelloPeriod
+)
+
+// sentinelInstance is a master or replica monitored by this sentinel
+type sentinelInstance struct {
+	host string
+	port string
+	link *sentinelConn
+	//? Closed once the instance is no longer monitored
+	stop chan struct{}
+
+	//? Last valid reply to PING, and when the oldest PING still unanswered
+	//? was sent: the instance is SDOWN once that is older than
+	//? down-after-milliseconds
+	lastPong   time.Time
+	pingSent   time.Time
+	sdownSince time.Time
+
+	//? What the last INFO replication said
+	infoRefresh  time.Time
+	role         string
+	roleSince    time.Time
+	masterHost   string
+	masterPort   string
+	masterLinkUp bool
+	replOffset   int64
+
+	//? Last REPLICAOF sent to the instance
+	lastReconf time.Time
+}
+
+func newSentinelInstance(host string, port string) *sentinelInstance {
+	address := net.JoinHostPort(host, port)
+	return &sentinelInstance{
+		host:     host,
+		port:     port,
+		link:     &sentinelConn{address: address},
+		stop:     make(chan struct{}),
+		lastPong: time.Now(),
+	}
+}
+
+func (inst *sentinelInstance) address() string {
+	return net.JoinHostPort(inst.host, inst.port)
+}
+
+// sentinelPeer is another sentinel monitoring the same master
+type sentinelPeer struct {
+	id   string
+	host string
+	port string
+	link *sentinelConn
+
+	lastHello time.Time
+	//? Last reply to SENTINEL is-master-down-by-addr
+	asking            bool
+	masterDown        bool
+	masterDownReplied time.Time
+	leader            string
+	leaderEpoch       int64
+}
+
+// sentinelMaster is a master monitored under a name, with the replicas and
+// sentinels discovered through it
+type sentinelMaster struct {
+	name            string
+	quorum          int
+	downAfter       time.Duration
+	failoverTimeout time.Duration
+	//? Epoch of the failover that produced the current configuration
+	configEpoch int64
+
+	instance  *sentinelInstance
+	replicas  map[string]*sentinelInstance
+	sentinels map[string]*sentinelPeer
+	//? Closed once the master is no longer monitored
+	stop chan struct{}
+
+	odownSince time.Time
+	lastAsk    time.Time
+	//? Sentinel this one voted for to lead the failover of leaderEpoch
+	leader      string
+	leaderEpoch int64
+
+	failoverState       string
+	failoverEpoch       int64
+	failoverStart       time.Time
+	failoverStateChange time.Time
+	//? SENTINEL FAILOVER skips the agreement with the other sentinels
+	failoverForced bool
+	promoted       *sentinelInstance
+}
+
+type sentinelState struct {
+	myID string
+	//? Port announced to the other sentinels
+	port         string
+	currentEpoch int64
+	masters      map[string]*sentinelMaster
+	config       *configuration.AppSettings
+}
+
+// sentinelMu guards sentinel and everything it refers to. Nothing waits on
+// the network while holding it.
+var sentinelMu sync.Mutex
+
+var sentinel = sentinelState{
+	myID:    newReplicationID(),
+	masters: map[string]*sentinelMaster{},
+}
+
+// StartSentinel turns the server into a sentinel, monitor is the optional
+// "<name> <host> <port> <quorum>" of a first master to monitor
+func StartSentinel(config *configuration.AppSettings, monitor string) error {
+	commandTable = sentinelCommandTable
+
+	sentinelMu.Lock()
+	defer sentinelMu.Unlock()
+
+	sentinel.port = config.Port
+	sentinel.config = config
+	log.Printf("Sentinel ID is %s", sentinel.myID)
+
+	if monitor == "" {
+		return nil
+	}
+	fields := strings.Fields(monitor)
+	if len(fields) != 4 {
+		return fmt.Errorf("expected <name> <host> <port> <quorum>")
+	}
+	return monitorMaster(fields[0], fields[1], fields[2], fields[3])
+}
+
+// monitorMaster starts monitoring a master. The caller holds sentinelMu.
+func monitorMaster(name string, host string, port string, quorumArg string) error {
+	if _, ok := sentinel.masters[name]; ok {
+		return fmt.Errorf("Duplicated master name")
+	}
+	if portNumber, err := strconv.Atoi(port); err != nil || portNumber <= 0 || portNumber > 65535 {
+		return fmt.Errorf("Invalid port number")
+	}
+	quorum, err := strconv.Atoi(quorumArg)
+	if err != nil || quorum <= 0 {
+		return fmt.Errorf("Quorum must be 1 or greater.")
+	}
+
+	m := &sentinelMaster{
+		name:            name,
+		quorum:          quorum,
+		downAfter:       time.Duration(sentinel.config.SentinelDownAfter) * time.Millisecond,
+		failoverTimeout: time.Duration(sentinel.config.SentinelFailoverTimeout) * time.Millisecond,
+		instance:        newSentinelInstance(host, port),
+		replicas:        map[string]*sentinelInstance{},
+		sentinels:       map[string]*sentinelPeer{},
+		stop:            make(chan struct{}),
+		failoverState:   sentinelFailoverNone,
+	}
+	sentinel.masters[name] = m
+
+	startSentinelInstance(m, m.instance)
+	go sentinelMasterLoop(m)
+	sentinelEvent("+monitor", fmt.Sprintf("%s quorum %d", m.describe(m.instance), quorum))
+	return nil
+}
+
+// removeMaster stops monitoring a master. The caller holds sentinelMu.
+func removeMaster(m *sentinelMaster) {
+	delete(sentinel.masters, m.name)
+	close(m.stop)
+	close(m.instance.stop)
+	for _, replica := range m.replicas {
+		close(replica.stop)
+	}
+	for _, peer := range m.sentinels {
+		peer.link.close()
+	}
+	sentinelEvent("-monitor", m.describe(m.instance))
+}
+
+func startSentinelInstance(m *sentinelMaster, inst *sentinelInstance) {
+	go monitorInstance(m, inst)
+	go subscribeHello(inst)
+}
+
+// describe formats an instance the way sentinel events name it
+func (m *sentinelMaster) describe(inst *sentinelInstance) string {
+	master := fmt.Sprintf("master %s %s %s", m.name, m.instance.host, m.instance.port)
+	if inst == m.instance {
+		return master
+	}
+	return fmt.Sprintf("slave %s %s %s @ %s", inst.address(), inst.host, inst.port, strings.TrimPrefix(master, "master "))
+}
+
+// sentinelEvent logs an event and publishes it on the channel of the same
+// name, where clients of the sentinel can follow what happens
+func sentinelEvent(event string, message string) {
+	log.Printf("%s %s", event, message)
+	publishMessage(event, message)
+}
+
+// monitorInstance pings the instance, refreshes its INFO and announces this
+// sentinel on its hello channel, until the instance is no longer monitored
+func monitorInstance(m *sentinelMaster, inst *sentinelInstance) {
+	ticker := time.NewTicker(sentinelTickPeriod)
+	defer ticker.Stop()
+	defer inst.link.close()
+
+	var lastPing, lastInfo, lastHello time.Time
+	for {
+		select {
+		case <-inst.stop:
+			return
+		case <-ticker.C:
+		}
+
+		//? A short down-after-milliseconds needs pings at least as often
+		if time.Since(lastPing) >= min(m.downAfter, sentinelPingPeriod) {
+			lastPing = time.Now()
+			sentinelMu.Lock()
+			if inst.pingSent.IsZero() {
+				inst.pingSent = lastPing
+			}
+			sentinelMu.Unlock()
+
+			reply, err := inst.link.command("PING")
+			if err == nil && validPingReply(reply) {
+				sentinelMu.Lock()
+				inst.lastPong = time.Now()
+				inst.pingSent = time.Time{}
+				sentinelMu.Unlock()
+			}
+		}
+
+		sentinelMu.Lock()
+		infoPeriod := sentinelInfoPeriod
+		if m.failoverState != sentinelFailoverNone || !m.instance.sdownSince.IsZero() {
+			infoPeriod = sentinelFailoverInfoPeriod
+		}
+		sentinelMu.Unlock()
+
+		if time.Since(lastInfo) >= infoPeriod {
+			lastInfo = time.Now()
+			if reply, err := inst.link.command("INFO", "replication"); err == nil {
+				if info, ok := reply.Value.(string); ok && reply.Type == '$' {
+					refreshInstanceInfo(m, inst, info)
+				}
+			}
+		}
+
+		if time.Since(lastHello) >= sentinelHelloPeriod {
+			lastHello = time.Now()
+			if ip := inst.link.localIP(); ip != "" {
+				sentinelMu.Lock()
+				hello := sentinelHello(m, ip)
+				sentinelMu.Unlock()
+				inst.link.command("PUBLISH", sentinelHelloChannel, hello)
+			}
+		}
+	}
+}
+
+// validPingReply accepts PONG, and the errors of an instance that is alive
+// but busy loading or cut from its own master
+func validPingReply(reply *configuration.RESPValue) bool {
+	status, _ := reply.Value.(string)
+	switch reply.Type {
+	case '+':
+		return status == "PONG"
+	case '-':
+		return strings.HasPrefix(status, "LOADING") || strings.HasPrefix(status, "MASTERDOWN")
+	}
+	return false
+}
+
+// refreshInstanceInfo records the role and offset of an instance, discovers
+// the replicas of the master and fixes instances configured the wrong way
+func refreshInstanceInfo(m *sentinelMaster, inst *sentinelInstance, info string) {
+	fields := map[string]string{}
+	for _, line := range strings.Split(info, "\r\n") {
+		if key, value, ok := strings.Cut(line, ":"); ok {
+			fields[key] = value
+		}
+	}
+
+	sentinelMu.Lock()
+	defer sentinelMu.Unlock()
+
+	now := time.Now()
+	inst.infoRefresh = now
+	if role := fields["role"]; role != inst.role {
+		inst.role = role
+		inst.roleSince = now
+	}
+	inst.masterHost = fields["master_host"]
+	inst.masterPort = fields["master_port"]
+	inst.masterLinkUp = fields["master_link_status"] == "up"
+	inst.replOffset, _ = strconv.ParseInt(fields["master_repl_offset"], 10, 64)
+
+	//? slave0:ip=127.0.0.1,port=6380,state=online,offset=42,lag=0
+	if inst == m.instance && inst.role == "master" {
+		for key, value := range fields {
+			if _, err := strconv.Atoi(strings.TrimPrefix(key, "slave")); err != nil || !strings.HasPrefix(key, "slave") {
+				continue
+			}
+			replica := map[string]string{}
+			for _, pair := range strings.Split(value, ",") {
+				if name, field, ok := strings.Cut(pair, "="); ok {
+					replica[name] = field
+				}
+			}
+			if replica["ip"] != "" && replica["port"] != "" && replica["port"] != "0" {
+				discoverReplica(m, replica["ip"], replica["port"])
+			}
+		}
+	}
+
+	if m.failoverState == sentinelFailoverWaitPromotion && inst == m.promoted && inst.role == "master" {
+		m.configEpoch = m.failoverEpoch
+		m.failoverState = sentinelFailoverReconfReplicas
+		m.failoverStateChange = now
+		sentinelEvent("+promoted-slave", m.describe(inst))
+		sentinelEvent("+failover-state-reconf-slaves", m.describe(m.instance))
+		return
+	}
+	fixInstanceRole(m, inst)
+}
+
+// discoverReplica starts monitoring a replica listed by the master. The
+// caller holds sentinelMu.
+func discoverReplica(m *sentinelMaster, host string, port string) {
+	address := net.JoinHostPort(host, port)
+	if _, ok := m.replicas[address]; ok || address == m.instance.address() {
+		return
+	}
+
+	replica := newSentinelInstance(host, port)
+	m.replicas[address] = replica
+	startSentinelInstance(m, replica)
+	sentinelEvent("+slave", m.describe(replica))
+}
+
+// fixInstanceRole turns back into a replica an old master that restarted, and
+// points replicas following another master to the right one. The caller
+// holds sentinelMu.
+func fixInstanceRole(m *sentinelMaster, inst *sentinelInstance) {
+	if inst == m.instance || m.failoverState != sentinelFailoverNone || !m.instance.sdownSince.IsZero() {
+		return
+	}
+	if time.Since(inst.roleSince) < sentinelFixConfigDelay || time.Since(inst.lastReconf) < sentinelFixConfigDelay {
+		return
+	}
+
+	switch {
+	case inst.role == "master":
+		sentinelEvent("+convert-to-slave", m.describe(inst))
+	case inst.role == "slave" && net.JoinHostPort(inst.masterHost, inst.masterPort) != m.instance.address():
+		sentinelEvent("+fix-slave-config", m.describe(inst))
+	default:
+		return
+	}
+	inst.lastReconf = time.Now()
+	go inst.link.command("REPLICAOF", m.instance.host, m.instance.port)
+}
+
+// sentinelHello is "ip,port,id,epoch,master name,master ip,master port,master
+// config epoch". The caller holds sentinelMu.
+func sentinelHello(m *sentinelMaster, ip string) string {
+	master := m.instance
+	if m.failoverState == sentinelFailoverReconfReplicas && m.promoted != nil {
+		master = m.promoted
+	}
+	return fmt.Sprintf("%s,%s,%s,%d,%s,%s,%s,%d",
+		ip, sentinel.port, sentinel.myID, sentinel.currentEpoch, m.name, master.host, master.port, m.configEpoch)
+}
+
+// subscribeHello listens to the hello channel of an instance, reconnecting
+// until it is no longer monitored
+func subscribeHello(inst *sentinelInstance) {
+	for {
+		if conn, err := net.DialTimeout("tcp", inst.address(), sentinelCommandTimeout); err == nil {
+			readHellos(inst, conn)
+		}
+
+		select {
+		case <-inst.stop:
+			return
+		case <-time.After(sentinelPingPeriod):
+		}
+	}
+}
+
+func readHellos(inst *sentinelInstance, conn net.Conn) {
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-inst.stop:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if err := tcp.WriteValue(conn, utils.NewBulkStringArray([]string{"SUBSCRIBE", sentinelHelloChannel}), utils.RESP2); err != nil {
+		return
+	}
+	reader := utils.NewRESPReader(conn)
+	for {
+		//? This sentinel's own hellos come every 2 seconds, silence means the
+		//? connection is gone
+		conn.SetReadDeadline(time.Now().Add(5 * sentinelHelloPeriod))
+		reply, err := reader.ReadValue()
+		if err != nil {
+			return
+		}
+
+		items, _ := reply.Value.([]configuration.RESPValue)
+		if len(items) != 3 {
+			continue
+		}
+		if kind, _ := items[0].Value.(string); kind == "message" {
+			hello, _ := items[2].Value.(string)
+			processHello(hello)
+		}
+	}
+}
+
+// processHello learns about the sentinel that sent the hello, and adopts the
+// master it announces when its configuration is newer
+func processHello(hello string) {
+	fields := strings.Split(hello, ",")
+	if len(fields) != 8 {
+		return
+	}
+	epoch, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return
+	}
+	configEpoch, err := strconv.ParseInt(fields[7], 10, 64)
+	if err != nil {
+		return
+	}
+	host, port, id := fields[0], fields[1], fields[2]
+
+	sentinelMu.Lock()
+	defer sentinelMu.Unlock()
+
+	m := sentinel.masters[fields[4]]
+	if m == nil || id == sentinel.myID {
+		return
+	}
+
+	peer := m.sentinels[id]
+	if peer == nil {
+		//? A sentinel restarted with a new ID replaces the one at its address
+		for otherID, other := range m.sentinels {
+			if other.host == host && other.port == port {
+				other.link.close()
+				delete(m.sentinels, otherID)
+			}
+		}
+		peer = &sentinelPeer{id: id, host: host, port: port, link: &sentinelConn{address: net.JoinHostPort(host, port)}}
+		m.sentinels[id] = peer
+		sentinelEvent("+sentinel", fmt.Sprintf("sentinel %s %s %s @ %s", id, host, port, strings.TrimPrefix(m.describe(m.instance), "master ")))
+	}
+	peer.lastHello = time.Now()
+	updateCurrentEpoch(epoch)
+
+	if configEpoch > m.configEpoch {
+		m.configEpoch = configEpoch
+		if net.JoinHostPort(fields[5], fields[6]) != m.instance.address() {
+			sentinelEvent("+config-update-from", fmt.Sprintf("sentinel %s %s %s @ %s", id, host, port, strings.TrimPrefix(m.describe(m.instance), "master ")))
+			switchMaster(m, fields[5], fields[6])
+		}
+	}
+}
+
+// updateCurrentEpoch follows the highest epoch seen. The caller holds
+// sentinelMu.
+func updateCurrentEpoch(epoch int64) {
+	if epoch > sentinel.currentEpoch {
+		sentinel.currentEpoch = epoch
+		sentinelEvent("+new-epoch", strconv.FormatInt(epoch, 10))
+	}
+}
+
+// switchMaster makes host:port the master, the old master and the other
+// replicas are monitored as its replicas. The caller holds sentinelMu.
+func switchMaster(m *sentinelMaster, host string, port string) {
+	old := m.instance
+	sentinelEvent("+switch-master", fmt.Sprintf("%s %s %s %s %s", m.name, old.host, old.port, host, port))
+
+	address := net.JoinHostPort(host, port)
+	master, ok := m.replicas[address]
+	if ok {
+		delete(m.replicas, address)
+	} else {
+		master = newSentinelInstance(host, port)
+		startSentinelInstance(m, master)
+	}
+	if old.address() != address {
+		m.replicas[old.address()] = old
+	}
+
+	m.instance = master
+	m.odownSince = time.Time{}
+	m.failoverState = sentinelFailoverNone
+	m.failoverForced = false
+	m.promoted = nil
+	for _, peer := range m.sentinels {
+		peer.masterDown = false
+	}
+}
+
+// sentinelConn is a command connection from a sentinel to an instance or to
+// another sentinel, dialed again after any error
+type sentinelConn struct {
+	address string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *utils.RESPReader
+}
+
+func (sc *sentinelConn) command(args ...string) (*configuration.RESPValue, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.conn == nil {
+		conn, err := net.DialTimeout("tcp", sc.address, sentinelCommandTimeout)
+		if err != nil {
+			return nil, err
+		}
+		sc.conn, sc.reader = conn, utils.NewRESPReader(conn)
+	}
+
+	sc.conn.SetDeadline(time.Now().Add(sentinelCommandTimeout))
+	err := tcp.WriteValue(sc.conn, utils.NewBulkStringArray(args), utils.RESP2)
+	var reply *configuration.RESPValue
+	if err == nil {
+		reply, err = sc.reader.ReadValue()
+	}
+	if err != nil {
+		sc.conn.Close()
+		sc.conn = nil
+		return nil, err
+	}
+	return reply, nil
+}
+
+// localIP is the address the instance reaches this sentinel at, empty while
+// disconnected
+func (sc *sentinelConn) localIP() string {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.conn == nil {
+		return ""
+	}
+	if addr, ok := sc.conn.LocalAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+func (sc *sentinelConn) close() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.conn != nil {
+		sc.conn.Close()
+		sc.conn = nil
+	}
+}
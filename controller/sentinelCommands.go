@@ -0,0 +1,307 @@
+package controller
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	configuration "github.com/oussamasf/yuji/config"
+	"github.com/oussamasf/yuji/utils"
+)
+
+// sentinelCommandTable replaces commandTable in sentinel mode, a sentinel
+// holds no data
+var sentinelCommandTable map[string]command
+
+func init() {
+	sentinelCommandTable = map[string]command{
+		"hello":    {Arity: -1, Flags: flagNoAuth, Handler: helloCommand},
+		"auth":     {Arity: -2, Flags: flagNoAuth, Handler: authCommand},
+		"ping":     {Arity: -1, Flags: flagPubSub, Handler: pingCommand},
+		"quit":     {Arity: -1, Flags: flagNoAuth | flagPubSub, Handler: quitCommand},
+		"info":     {Arity: -1, Handler: sentinelInfoCommand},
+		"role":     {Arity: 1, Handler: sentinelRoleCommand},
+		"sentinel": {Arity: -2, Handler: sentinelCommand},
+
+		"subscribe":    {Arity: -2, Flags: flagPubSub | flagNoMulti, Handler: subscribeCommand},
+		"unsubscribe":  {Arity: -1, Flags: flagPubSub | flagNoMulti, Handler: unsubscribeCommand},
+		"psubscribe":   {Arity: -2, Flags: flagPubSub | flagNoMulti, Handler: psubscribeCommand},
+		"punsubscribe": {Arity: -1, Flags: flagPubSub | flagNoMulti, Handler: punsubscribeCommand},
+		"publish":      {Arity: 3, Handler: sentinelPublishCommand},
+	}
+}
+
+// ? SENTINEL subcommand [arguments]
+func sentinelCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	subcommand, _ := args[1].Value.(string)
+	subcommand = strings.ToLower(subcommand)
+	params := make([]string, 0, len(args)-2)
+	for _, arg := range args[2:] {
+		param, _ := arg.Value.(string)
+		params = append(params, param)
+	}
+
+	arity := map[string]int{
+		"myid": 0, "masters": 0, "master": 1, "replicas": 1, "slaves": 1, "sentinels": 1,
+		"get-master-addr-by-name": 1, "is-master-down-by-addr": 4, "monitor": 4, "remove": 1, "failover": 1,
+	}
+	expected, ok := arity[subcommand]
+	if !ok {
+		return utils.NewError(fmt.Sprintf("ERR Unknown sentinel subcommand '%s'", subcommand))
+	}
+	if len(params) != expected {
+		return utils.NewError(fmt.Sprintf("ERR wrong number of arguments for 'sentinel|%s' command", subcommand))
+	}
+
+	sentinelMu.Lock()
+	defer sentinelMu.Unlock()
+
+	switch subcommand {
+	case "myid":
+		return utils.NewBulkString(sentinel.myID)
+
+	case "masters":
+		masters := []configuration.RESPValue{}
+		for _, name := range sortedMasterNames() {
+			m := sentinel.masters[name]
+			masters = append(masters, sentinelInstanceFields(m, m.instance))
+		}
+		return utils.NewArray(masters...)
+
+	case "monitor":
+		if err := monitorMaster(params[0], params[1], params[2], params[3]); err != nil {
+			return utils.NewError("ERR " + err.Error())
+		}
+		return utils.NewSimpleString(utils.OK)
+
+	case "is-master-down-by-addr":
+		return isMasterDownByAddr(params[0], params[1], params[2], params[3])
+	}
+
+	//? The other subcommands take the name of a master
+	m := sentinel.masters[params[0]]
+	if m == nil {
+		if subcommand == "get-master-addr-by-name" {
+			return utils.NewNullArray()
+		}
+		return utils.NewError("ERR No such master with that name")
+	}
+
+	switch subcommand {
+	case "master":
+		return sentinelInstanceFields(m, m.instance)
+
+	case "replicas", "slaves":
+		replicas := []configuration.RESPValue{}
+		for _, address := range sortedKeys(m.replicas) {
+			replicas = append(replicas, sentinelInstanceFields(m, m.replicas[address]))
+		}
+		return utils.NewArray(replicas...)
+
+	case "sentinels":
+		peers := []configuration.RESPValue{}
+		for _, id := range sortedKeys(m.sentinels) {
+			peer := m.sentinels[id]
+			peers = append(peers, sentinelFields(
+				"name", peer.id,
+				"ip", peer.host,
+				"port", peer.port,
+				"runid", peer.id,
+				"flags", "sentinel",
+				"last-hello-message", strconv.FormatInt(time.Since(peer.lastHello).Milliseconds(), 10),
+				"voted-leader", orDefault(peer.leader, "?"),
+				"voted-leader-epoch", strconv.FormatInt(peer.leaderEpoch, 10),
+			))
+		}
+		return utils.NewArray(peers...)
+
+	case "get-master-addr-by-name":
+		//? Clients are sent to the promoted replica as soon as it took the role
+		master := m.instance
+		if m.failoverState == sentinelFailoverReconfReplicas && m.promoted != nil {
+			master = m.promoted
+		}
+		return utils.NewBulkStringArray([]string{master.host, master.port})
+
+	case "remove":
+		removeMaster(m)
+		return utils.NewSimpleString(utils.OK)
+
+	case "failover":
+		if m.failoverState != sentinelFailoverNone {
+			return utils.NewError("INPROG Failover already in progress")
+		}
+		if selectPromotedReplica(m) == nil {
+			return utils.NewError("NOGOODSLAVE No suitable replica to promote")
+		}
+		startSentinelFailover(m)
+		m.failoverForced = true
+		return utils.NewSimpleString(utils.OK)
+	}
+	return utils.NewError(fmt.Sprintf("ERR Unknown sentinel subcommand '%s'", subcommand))
+}
+
+// isMasterDownByAddr tells another sentinel whether this one sees the master
+// down and, when it asks with its ID, gives it the vote for epoch. The caller
+// holds sentinelMu.
+func isMasterDownByAddr(host string, port string, epochArg string, runID string) configuration.RESPValue {
+	epoch, err := strconv.ParseInt(epochArg, 10, 64)
+	if err != nil {
+		return utils.NewError("ERR value is not an integer or out of range")
+	}
+
+	var m *sentinelMaster
+	for _, master := range sentinel.masters {
+		if master.instance.address() == net.JoinHostPort(host, port) {
+			m = master
+		}
+	}
+
+	down := int64(0)
+	leader, leaderEpoch := "*", int64(0)
+	if m != nil {
+		if !m.instance.sdownSince.IsZero() {
+			down = 1
+		}
+		if runID != "*" {
+			leader, leaderEpoch = voteLeader(m, epoch, runID)
+		}
+	}
+	return utils.NewArray(utils.NewInteger(down), utils.NewBulkString(leader), utils.NewInteger(leaderEpoch))
+}
+
+// sentinelInstanceFields describes a master or replica for SENTINEL MASTER(S)
+// and REPLICAS. The caller holds sentinelMu.
+func sentinelInstanceFields(m *sentinelMaster, inst *sentinelInstance) configuration.RESPValue {
+	flags := []string{"slave"}
+	if inst == m.instance {
+		flags[0] = "master"
+	}
+	if !inst.sdownSince.IsZero() {
+		flags = append(flags, "s_down")
+	}
+	if inst == m.instance && !m.odownSince.IsZero() {
+		flags = append(flags, "o_down")
+	}
+	if inst == m.instance && m.failoverState != sentinelFailoverNone {
+		flags = append(flags, "failover_in_progress")
+	}
+	if inst == m.promoted {
+		flags = append(flags, "promoted")
+	}
+
+	fields := []string{
+		"name", inst.address(),
+		"ip", inst.host,
+		"port", inst.port,
+		"flags", strings.Join(flags, ","),
+		"last-ok-ping-reply", strconv.FormatInt(time.Since(inst.lastPong).Milliseconds(), 10),
+		"role-reported", orDefault(inst.role, "?"),
+	}
+	if inst == m.instance {
+		fields[1] = m.name
+		fields = append(fields,
+			"num-slaves", strconv.Itoa(len(m.replicas)),
+			"num-other-sentinels", strconv.Itoa(len(m.sentinels)),
+			"quorum", strconv.Itoa(m.quorum),
+			"config-epoch", strconv.FormatInt(m.configEpoch, 10),
+			"down-after-milliseconds", strconv.FormatInt(m.downAfter.Milliseconds(), 10),
+			"failover-timeout", strconv.FormatInt(m.failoverTimeout.Milliseconds(), 10),
+			"failover-state", m.failoverState,
+		)
+	} else {
+		linkStatus := "err"
+		if inst.masterLinkUp {
+			linkStatus = "ok"
+		}
+		fields = append(fields,
+			"master-link-status", linkStatus,
+			"master-host", orDefault(inst.masterHost, "?"),
+			"master-port", orDefault(inst.masterPort, "0"),
+			"slave-repl-offset", strconv.FormatInt(inst.replOffset, 10),
+		)
+	}
+	return sentinelFields(fields...)
+}
+
+// sentinelFields builds the field/value reply Redis Sentinel uses, a map for
+// RESP3 clients and a flat array for RESP2 ones
+func sentinelFields(pairs ...string) configuration.RESPValue {
+	values := make([]configuration.RESPValue, 0, len(pairs))
+	for _, item := range pairs {
+		values = append(values, utils.NewBulkString(item))
+	}
+	return utils.NewMap(values...)
+}
+
+func orDefault(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// sortedMasterNames lists the monitored masters in a stable order. The caller
+// holds sentinelMu.
+func sortedMasterNames() []string {
+	return sortedKeys(sentinel.masters)
+}
+
+func sortedKeys[V any](items map[string]V) []string {
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ? INFO [section], the sentinel flavour
+func sentinelInfoCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	sentinelMu.Lock()
+	defer sentinelMu.Unlock()
+
+	lines := []string{
+		"# Server",
+		"redis_mode:sentinel",
+		"tcp_port:" + sentinel.port,
+		"",
+		"# Sentinel",
+		fmt.Sprintf("sentinel_masters:%d", len(sentinel.masters)),
+	}
+	for i, name := range sortedMasterNames() {
+		m := sentinel.masters[name]
+		status := "ok"
+		if !m.odownSince.IsZero() {
+			status = "odown"
+		} else if !m.instance.sdownSince.IsZero() {
+			status = "sdown"
+		}
+		lines = append(lines, fmt.Sprintf("master%d:name=%s,status=%s,address=%s,slaves=%d,sentinels=%d",
+			i, m.name, status, m.instance.address(), len(m.replicas), len(m.sentinels)+1))
+	}
+	return utils.NewBulkString(strings.Join(lines, "\r\n"))
+}
+
+// ? ROLE, a sentinel lists the masters it monitors
+func sentinelRoleCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	sentinelMu.Lock()
+	defer sentinelMu.Unlock()
+
+	return utils.NewArray(utils.NewBulkString("sentinel"), utils.NewBulkStringArray(sortedMasterNames()))
+}
+
+// ? PUBLISH channel message, a sentinel only takes hellos
+func sentinelPublishCommand(c *Client, args []configuration.RESPValue) configuration.RESPValue {
+	channel, _ := args[1].Value.(string)
+	message, _ := args[2].Value.(string)
+	if channel != sentinelHelloChannel {
+		return utils.NewError("ERR Only HELLO messages are accepted by Sentinel instances.")
+	}
+
+	processHello(message)
+	return utils.NewInteger(1)
+}
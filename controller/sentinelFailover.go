@@ -0,0 +1,315 @@
+package controller
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	configuration "github.com/oussamasf/yuji/config"
+)
+
+// ? Steps of a failover, named as in Redis Sentinel
+const (
+	sentinelFailoverNone               = "none"
+	sentinelFailoverWaitStart          = "wait_start"
+	sentinelFailoverSelectReplica      = "select_slave"
+	sentinelFailoverSendReplicaofNoOne = "send_slaveof_noone"
+	sentinelFailoverWaitPromotion      = "wait_promotion"
+	sentinelFailoverReconfReplicas     = "reconf_slaves"
+)
+
+// sentinelMasterLoop detects failures of the master and its replicas, and
+// runs the failover of the master once it is objectively down
+func sentinelMasterLoop(m *sentinelMaster) {
+	ticker := time.NewTicker(sentinelTickPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+
+		sentinelMu.Lock()
+		checkSubjectivelyDown(m, m.instance)
+		for _, replica := range m.replicas {
+			checkSubjectivelyDown(m, replica)
+		}
+		checkObjectivelyDown(m)
+
+		if !m.instance.sdownSince.IsZero() && time.Since(m.lastAsk) >= sentinelAskPeriod {
+			m.lastAsk = time.Now()
+			askOtherSentinels(m)
+		}
+		if m.failoverState == sentinelFailoverNone && !m.odownSince.IsZero() && time.Since(m.failoverStart) >= 2*m.failoverTimeout {
+			startSentinelFailover(m)
+		}
+		sentinelFailoverStep(m)
+		sentinelMu.Unlock()
+	}
+}
+
+// checkSubjectivelyDown flags an instance SDOWN when a PING went unanswered
+// for down-after-milliseconds. Measuring from the last reply instead would
+// count the time waiting for the next ping. The caller holds sentinelMu.
+func checkSubjectivelyDown(m *sentinelMaster, inst *sentinelInstance) {
+	down := !inst.pingSent.IsZero() && time.Since(inst.pingSent) > m.downAfter
+	switch {
+	case down && inst.sdownSince.IsZero():
+		inst.sdownSince = time.Now()
+		sentinelEvent("+sdown", m.describe(inst))
+	case !down && !inst.sdownSince.IsZero():
+		inst.sdownSince = time.Time{}
+		sentinelEvent("-sdown", m.describe(inst))
+	}
+}
+
+// checkObjectivelyDown flags the master ODOWN once quorum sentinels, this one
+// included, see it SDOWN. The caller holds sentinelMu.
+func checkObjectivelyDown(m *sentinelMaster) {
+	votes := 0
+	if !m.instance.sdownSince.IsZero() {
+		votes = 1
+		for _, peer := range m.sentinels {
+			//? Replies expire, the other sentinel may have changed its mind
+			if peer.masterDown && time.Since(peer.masterDownReplied) < 5*sentinelAskPeriod {
+				votes++
+			}
+		}
+	}
+
+	odown := votes > 0 && votes >= m.quorum
+	switch {
+	case odown && m.odownSince.IsZero():
+		m.odownSince = time.Now()
+		sentinelEvent("+odown", fmt.Sprintf("%s #quorum %d/%d", m.describe(m.instance), votes, m.quorum))
+	case !odown && !m.odownSince.IsZero():
+		m.odownSince = time.Time{}
+		sentinelEvent("-odown", m.describe(m.instance))
+	}
+}
+
+// askOtherSentinels asks every other sentinel whether it sees the master
+// down. During a failover the request also asks for their vote. The caller
+// holds sentinelMu.
+func askOtherSentinels(m *sentinelMaster) {
+	runID := "*"
+	if m.failoverState != sentinelFailoverNone {
+		runID = sentinel.myID
+	}
+	host, port, epoch := m.instance.host, m.instance.port, strconv.FormatInt(sentinel.currentEpoch, 10)
+
+	for _, peer := range m.sentinels {
+		if peer.asking {
+			continue
+		}
+		peer.asking = true
+
+		go func(peer *sentinelPeer) {
+			reply, err := peer.link.command("SENTINEL", "is-master-down-by-addr", host, port, epoch, runID)
+
+			sentinelMu.Lock()
+			defer sentinelMu.Unlock()
+
+			peer.asking = false
+			if err != nil {
+				return
+			}
+			items, _ := reply.Value.([]configuration.RESPValue)
+			if reply.Type != '*' || len(items) != 3 {
+				return
+			}
+			down, _ := items[0].Value.(int64)
+			leader, _ := items[1].Value.(string)
+			leaderEpoch, _ := items[2].Value.(int64)
+
+			peer.masterDown = down == 1
+			peer.masterDownReplied = time.Now()
+			if leader != "" && leader != "*" {
+				peer.leader, peer.leaderEpoch = leader, leaderEpoch
+			}
+		}(peer)
+	}
+}
+
+// startSentinelFailover opens a new epoch in which this sentinel tries to be
+// elected to run the failover. The caller holds sentinelMu.
+func startSentinelFailover(m *sentinelMaster) {
+	sentinel.currentEpoch++
+	sentinelEvent("+new-epoch", strconv.FormatInt(sentinel.currentEpoch, 10))
+
+	m.failoverEpoch = sentinel.currentEpoch
+	m.failoverState = sentinelFailoverWaitStart
+	m.failoverStart = time.Now().Add(time.Duration(rand.Int63n(int64(sentinelMaxDesync))))
+	m.failoverStateChange = time.Now()
+	sentinelEvent("+try-failover", m.describe(m.instance))
+}
+
+// voteLeader gives the vote of this sentinel for epoch to runID, unless it
+// already voted in that epoch, and returns who it voted for. The caller holds
+// sentinelMu.
+func voteLeader(m *sentinelMaster, epoch int64, runID string) (string, int64) {
+	updateCurrentEpoch(epoch)
+
+	if m.leaderEpoch < epoch && sentinel.currentEpoch <= epoch {
+		m.leader, m.leaderEpoch = runID, sentinel.currentEpoch
+		sentinelEvent("+vote-for-leader", fmt.Sprintf("%s %d", runID, m.leaderEpoch))
+
+		//? Leave the elected sentinel time to do its job before trying
+		if runID != sentinel.myID {
+			m.failoverStart = time.Now().Add(time.Duration(rand.Int63n(int64(sentinelMaxDesync))))
+		}
+	}
+	return m.leader, m.leaderEpoch
+}
+
+// failoverLeader counts the votes of epoch, this sentinel votes for the most
+// voted one or for itself. The leader needs the majority of the sentinels and
+// at least quorum votes. The caller holds sentinelMu.
+func failoverLeader(m *sentinelMaster, epoch int64) string {
+	votes := map[string]int{}
+	for _, peer := range m.sentinels {
+		if peer.leader != "" && peer.leaderEpoch == epoch {
+			votes[peer.leader]++
+		}
+	}
+
+	candidate := sentinel.myID
+	if winner, _ := mostVoted(votes); winner != "" {
+		candidate = winner
+	}
+	if leader, leaderEpoch := voteLeader(m, epoch, candidate); leaderEpoch == epoch {
+		votes[leader]++
+	}
+
+	winner, count := mostVoted(votes)
+	voters := len(m.sentinels) + 1
+	if count < voters/2+1 || count < m.quorum {
+		return ""
+	}
+	return winner
+}
+
+func mostVoted(votes map[string]int) (string, int) {
+	winner, count := "", 0
+	for id, n := range votes {
+		if n > count || (n == count && id > winner) {
+			winner, count = id, n
+		}
+	}
+	return winner, count
+}
+
+// sentinelFailoverStep moves the failover forward. The caller holds
+// sentinelMu.
+func sentinelFailoverStep(m *sentinelMaster) {
+	switch m.failoverState {
+	case sentinelFailoverWaitStart:
+		if !m.failoverForced && failoverLeader(m, m.failoverEpoch) != sentinel.myID {
+			if time.Since(m.failoverStart) > min(sentinelElectionTimeout, m.failoverTimeout) {
+				sentinelEvent("-failover-abort-not-elected", m.describe(m.instance))
+				abortSentinelFailover(m)
+			}
+			return
+		}
+		sentinelEvent("+elected-leader", m.describe(m.instance))
+		setFailoverState(m, sentinelFailoverSelectReplica)
+
+	case sentinelFailoverSelectReplica:
+		replica := selectPromotedReplica(m)
+		if replica == nil {
+			sentinelEvent("-failover-abort-no-good-slave", m.describe(m.instance))
+			abortSentinelFailover(m)
+			return
+		}
+		sentinelEvent("+selected-slave", m.describe(replica))
+		m.promoted = replica
+		setFailoverState(m, sentinelFailoverSendReplicaofNoOne)
+
+	case sentinelFailoverSendReplicaofNoOne:
+		//? INFO tells once the replica took the role, otherwise the failover
+		//? times out
+		go m.promoted.link.command("REPLICAOF", "NO", "ONE")
+		setFailoverState(m, sentinelFailoverWaitPromotion)
+
+	case sentinelFailoverWaitPromotion:
+		if time.Since(m.failoverStateChange) > m.failoverTimeout {
+			sentinelEvent("-failover-abort-slave-timeout", m.describe(m.promoted))
+			abortSentinelFailover(m)
+		}
+
+	case sentinelFailoverReconfReplicas:
+		reconfigureReplicas(m)
+	}
+}
+
+func setFailoverState(m *sentinelMaster, state string) {
+	m.failoverState = state
+	m.failoverStateChange = time.Now()
+	sentinelEvent("+failover-state-"+state, m.describe(m.instance))
+}
+
+func abortSentinelFailover(m *sentinelMaster) {
+	m.failoverState = sentinelFailoverNone
+	m.failoverForced = false
+	m.promoted = nil
+}
+
+// selectPromotedReplica picks the reachable replica with the most data. The
+// caller holds sentinelMu.
+func selectPromotedReplica(m *sentinelMaster) *sentinelInstance {
+	//? INFO is refreshed more often once the master is down
+	infoValidity := 3 * sentinelInfoPeriod
+	if !m.instance.sdownSince.IsZero() {
+		infoValidity = 5 * sentinelFailoverInfoPeriod
+	}
+
+	var best *sentinelInstance
+	for _, replica := range m.replicas {
+		switch {
+		case !replica.sdownSince.IsZero(),
+			replica.role != "slave",
+			time.Since(replica.lastPong) > 5*sentinelPingPeriod,
+			time.Since(replica.infoRefresh) > infoValidity:
+			continue
+		}
+		if best == nil || replica.replOffset > best.replOffset ||
+			(replica.replOffset == best.replOffset && replica.address() < best.address()) {
+			best = replica
+		}
+	}
+	return best
+}
+
+// reconfigureReplicas points the other replicas to the promoted one, then
+// makes it the master once they all follow it, or when the failover times out.
+// The caller holds sentinelMu.
+func reconfigureReplicas(m *sentinelMaster) {
+	promoted := m.promoted
+	done := true
+
+	for _, replica := range m.replicas {
+		if replica == promoted || !replica.sdownSince.IsZero() {
+			continue
+		}
+		if replica.lastReconf.Before(m.failoverStateChange) {
+			replica.lastReconf = time.Now()
+			go replica.link.command("REPLICAOF", promoted.host, promoted.port)
+			sentinelEvent("+slave-reconf-sent", m.describe(replica))
+		}
+		if replica.role != "slave" || replica.masterHost != promoted.host || replica.masterPort != promoted.port || !replica.masterLinkUp {
+			done = false
+		}
+	}
+
+	if !done && time.Since(m.failoverStateChange) <= m.failoverTimeout {
+		return
+	}
+	if !done {
+		sentinelEvent("-failover-end-for-timeout", m.describe(m.instance))
+	}
+	sentinelEvent("+failover-end", m.describe(m.instance))
+	switchMaster(m, promoted.host, promoted.port)
+}
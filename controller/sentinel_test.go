@@ -0,0 +1,249 @@
+package controller
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oussamasf/yuji/utils"
+)
+
+// newPipeSentinelConn connects a sentinel link to an in-memory peer that
+// answers each command with what reply returns, or drops the connection when
+// it returns nothing
+func newPipeSentinelConn(t *testing.T, reply func(args []string) string) *sentinelConn {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+
+	go func() {
+		reader := utils.NewRESPReader(remote)
+		for {
+			command, err := reader.ReadCommand()
+			if err != nil {
+				return
+			}
+			args := make([]string, len(command))
+			for i, arg := range command {
+				args[i], _ = arg.Value.(string)
+			}
+			response := reply(args)
+			if response == "" {
+				remote.Close()
+				return
+			}
+			if _, err := remote.Write([]byte(response)); err != nil {
+				return
+			}
+		}
+	}()
+	return &sentinelConn{address: "pipe", conn: local, reader: utils.NewRESPReader(local)}
+}
+
+// isMasterDownReply is what a sentinel answers to SENTINEL
+// is-master-down-by-addr
+func isMasterDownReply(down int, leader string, epoch int64) string {
+	return fmt.Sprintf("*3\r\n:%d\r\n$%d\r\n%s\r\n:%d\r\n", down, len(leader), leader, epoch)
+}
+
+// useTestSentinel runs a test with a sentinel of its own, restored once the
+// test is done
+func useTestSentinel(t *testing.T, myID string, epoch int64) {
+	sentinelMu.Lock()
+	saved := sentinel
+	sentinel = sentinelState{myID: myID, currentEpoch: epoch, masters: map[string]*sentinelMaster{}}
+	sentinelMu.Unlock()
+
+	t.Cleanup(func() {
+		sentinelMu.Lock()
+		sentinel = saved
+		sentinelMu.Unlock()
+	})
+}
+
+func newTestSentinelMaster(quorum int, link *sentinelConn, peers []*sentinelConn) *sentinelMaster {
+	instance := newSentinelInstance("127.0.0.1", "6379")
+	if link != nil {
+		instance.link = link
+	}
+	m := &sentinelMaster{
+		name:            "mymaster",
+		quorum:          quorum,
+		downAfter:       30 * time.Second,
+		failoverTimeout: 180 * time.Second,
+		instance:        instance,
+		replicas:        map[string]*sentinelInstance{},
+		sentinels:       map[string]*sentinelPeer{},
+		stop:            make(chan struct{}),
+		failoverState:   sentinelFailoverNone,
+	}
+	for i, link := range peers {
+		id := fmt.Sprintf("peer%d", i)
+		m.sentinels[id] = &sentinelPeer{id: id, link: link}
+	}
+	return m
+}
+
+// waitForPeerReplies waits until every sentinel asked by askOtherSentinels
+// replied or failed
+func waitForPeerReplies(t *testing.T, m *sentinelMaster) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		sentinelMu.Lock()
+		asking := false
+		for _, peer := range m.sentinels {
+			asking = asking || peer.asking
+		}
+		sentinelMu.Unlock()
+
+		if !asking {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sentinels didn't reply to is-master-down-by-addr")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSentinelDownDetection(t *testing.T) {
+	tests := []struct {
+		name      string
+		pingReply string
+		//? Whether each other sentinel sees the master down
+		peersDown []int
+		quorum    int
+		wantSDOWN bool
+		wantODOWN bool
+	}{
+		{name: "pong", pingReply: "+PONG\r\n", peersDown: []int{1, 1}, quorum: 2},
+		{name: "busy loading", pingReply: "-LOADING Redis is loading the dataset in memory\r\n", quorum: 1},
+		{name: "cut from its master", pingReply: "-MASTERDOWN Link with MASTER is down\r\n", quorum: 1},
+		{name: "error, alone with quorum 1", pingReply: "-ERR unknown command\r\n", quorum: 1, wantSDOWN: true, wantODOWN: true},
+		{name: "unexpected reply", pingReply: "+OK\r\n", peersDown: []int{0, 0}, quorum: 2, wantSDOWN: true},
+		{name: "quorum reached", pingReply: "-ERR unknown command\r\n", peersDown: []int{1, 0}, quorum: 2, wantSDOWN: true, wantODOWN: true},
+		{name: "quorum missed", pingReply: "-ERR unknown command\r\n", peersDown: []int{1, 0}, quorum: 3, wantSDOWN: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestSentinel(t, "me", 0)
+
+			infoAsked := make(chan struct{}, 1)
+			link := newPipeSentinelConn(t, func(args []string) string {
+				if strings.EqualFold(args[0], "PING") {
+					return tt.pingReply
+				}
+				select {
+				case infoAsked <- struct{}{}:
+				default:
+				}
+				return "$-1\r\n"
+			})
+			var peers []*sentinelConn
+			for _, down := range tt.peersDown {
+				peers = append(peers, newPipeSentinelConn(t, func(args []string) string {
+					return isMasterDownReply(down, "*", 0)
+				}))
+			}
+			m := newTestSentinelMaster(tt.quorum, link, peers)
+			m.downAfter = 20 * time.Millisecond
+
+			//? INFO follows the PING, its reply was handled once INFO is asked
+			go monitorInstance(m, m.instance)
+			select {
+			case <-infoAsked:
+			case <-time.After(2 * time.Second):
+				t.Fatalf("the sentinel didn't monitor the master")
+			}
+			close(m.instance.stop)
+			//? An unanswered PING is only SDOWN once down-after-milliseconds passed
+			time.Sleep(2 * m.downAfter)
+
+			sentinelMu.Lock()
+			checkSubjectivelyDown(m, m.instance)
+			sdown := !m.instance.sdownSince.IsZero()
+			if sdown {
+				askOtherSentinels(m)
+			}
+			sentinelMu.Unlock()
+			waitForPeerReplies(t, m)
+
+			sentinelMu.Lock()
+			defer sentinelMu.Unlock()
+			checkObjectivelyDown(m)
+			if odown := !m.odownSince.IsZero(); sdown != tt.wantSDOWN || odown != tt.wantODOWN {
+				t.Fatalf("SDOWN %v ODOWN %v, want SDOWN %v ODOWN %v", sdown, odown, tt.wantSDOWN, tt.wantODOWN)
+			}
+		})
+	}
+}
+
+func TestSentinelLeaderElection(t *testing.T) {
+	const epoch = 5
+
+	type vote struct {
+		leader string
+		epoch  int64
+	}
+	tests := []struct {
+		name   string
+		quorum int
+		//? Vote each other sentinel replies with, an empty leader drops the
+		//? connection instead
+		votes []vote
+		//? Who this sentinel already voted for in the epoch
+		votedFor   string
+		wantLeader string
+	}{
+		{name: "elected by everyone", quorum: 2, votes: []vote{{"me", epoch}, {"me", epoch}}, wantLeader: "me"},
+		{name: "alone", quorum: 1, wantLeader: "me"},
+		{name: "another sentinel elected", quorum: 2, votes: []vote{{"other", epoch}, {"other", epoch}}, wantLeader: "other"},
+		{name: "split votes follow the most voted", quorum: 2, votes: []vote{{"me", epoch}, {"other", epoch}}, wantLeader: "other"},
+		{name: "majority without a silent sentinel", quorum: 2, votes: []vote{{"me", epoch}, {}}, wantLeader: "me"},
+		{name: "quorum above the votes", quorum: 3, votes: []vote{{"me", epoch}, {}}},
+		{name: "votes of an older epoch", quorum: 2, votes: []vote{{"me", epoch - 1}, {"me", epoch - 1}}},
+		{name: "already voted for another", quorum: 2, votes: []vote{{"*", 0}, {"*", 0}}, votedFor: "other"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestSentinel(t, "me", epoch)
+
+			var peers []*sentinelConn
+			for _, v := range tt.votes {
+				peers = append(peers, newPipeSentinelConn(t, func(args []string) string {
+					//? The request carries the epoch and ID of the candidate
+					if len(args) != 6 || args[4] != fmt.Sprint(epoch) || args[5] != "me" {
+						return "-ERR unexpected request\r\n"
+					}
+					if v.leader == "" {
+						return ""
+					}
+					return isMasterDownReply(1, v.leader, v.epoch)
+				}))
+			}
+			m := newTestSentinelMaster(tt.quorum, nil, peers)
+			m.failoverState = sentinelFailoverWaitStart
+			m.failoverEpoch = epoch
+			if tt.votedFor != "" {
+				m.leader, m.leaderEpoch = tt.votedFor, epoch
+			}
+
+			sentinelMu.Lock()
+			askOtherSentinels(m)
+			sentinelMu.Unlock()
+			waitForPeerReplies(t, m)
+
+			sentinelMu.Lock()
+			defer sentinelMu.Unlock()
+			if leader := failoverLeader(m, epoch); leader != tt.wantLeader {
+				t.Fatalf("failoverLeader() = %q, want %q", leader, tt.wantLeader)
+			}
+		})
+	}
+}
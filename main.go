@@ -4,15 +4,50 @@ import (
 	"flag"
 	"fmt"
 	"net"
+	"os"
 	"strings"
 
 	configuration "github.com/oussamasf/yuji/config"
 	"github.com/oussamasf/yuji/controller"
 )
 
+// configFlag is a startup flag applied through the config parameter of the
+// same name, so it is validated the way CONFIG SET validates it
+type configFlag struct {
+	name  string
+	value string
+	usage string
+}
+
+var configFlags = []configFlag{
+	{"save", "3600 1 300 100 60 10000", "Save points: <seconds> <changes> pairs, empty to disable"},
+	{"appendonly", "no", "Log every write to an append only file, replayed at startup (yes or no)"},
+	{"appendfsync", "everysec", "When the append only file is fsynced: always, everysec or no"},
+	{"aof-load-truncated", "yes", "Load an append only file whose last command is incomplete (yes or no)"},
+	{"aof-use-rdb-preamble", "yes", "Write the base of a rewritten append only file as an RDB (yes or no)"},
+	{"auto-aof-rewrite-percentage", "100", "Rewrite the append only file once it grew by this percentage, 0 disables"},
+	{"auto-aof-rewrite-min-size", "64mb", "Smallest append only file rewritten automatically"},
+	{"replica-read-only", "yes", "Refuse writes from clients while being a replica (yes or no)"},
+	{"repl-diskless-sync", "no", "Send full syncs to replicas without going through the disk (yes or no)"},
+	{"repl-diskless-sync-delay", "5", "Seconds to wait for more replicas before a diskless sync"},
+	{"repl-timeout", "60", "Seconds before a silent replication link is considered dead"},
+	{"repl-backlog-size", "1mb", "Size of the replication backlog"},
+	{"client-output-buffer-limit", "replica 256mb 64mb 60", "Output buffer limits of replicas: replica <hard> <soft> <soft seconds>"},
+	{"sentinel-down-after-milliseconds", "30000", "Milliseconds without reply before a sentinel considers an instance down"},
+	{"sentinel-failover-timeout", "180000", "Milliseconds a sentinel gives a failover before aborting it"},
+	{"notify-keyspace-events", "", "Keyspace event classes to publish, e.g. KEA"},
+}
+
+// fatal reports a startup error and exits
+func fatal(args ...any) {
+	fmt.Fprintln(os.Stderr, args...)
+	os.Exit(1)
+}
+
 func main() {
 	var r string
 	var RSlice []string
+	var sentinelMonitor string
 
 	//? Config object to hold all the configuration variables
 	config := &configuration.AppSettings{
@@ -25,31 +60,55 @@ func main() {
 	flag.StringVar(&config.ReplicaAddress, "replicaof", "", "replica of")
 	flag.StringVar(&config.Dir, "dir", "data", "Directory to store RDB file")
 	flag.StringVar(&config.DBFileName, "dbfilename", "dump.rdb", "RDB file name")
+	flag.StringVar(&config.RequirePass, "requirepass", "", "Password clients must AUTH with")
+	flag.StringVar(&config.AppendFilename, "appendfilename", "appendonly.aof", "Append only file name")
+	flag.StringVar(&config.AppendDirname, "appenddirname", "appendonlydir", "Directory, inside dir, holding the append only files and their manifest")
+	flag.BoolVar(&config.Sentinel, "sentinel", false, "Run as a sentinel monitoring masters instead of serving data")
+	flag.StringVar(&sentinelMonitor, "sentinel-monitor", "", "Master a sentinel monitors: <name> <host> <port> <quorum>")
+
+	configValues := make([]*string, len(configFlags))
+	for i, f := range configFlags {
+		configValues[i] = flag.String(f.name, f.value, f.usage)
+	}
 
 	flag.Parse()
 
+	for i, f := range configFlags {
+		if err := controller.SetConfigParameter(config, f.name, *configValues[i]); err != nil {
+			//? INVALID_REPL_TIMEOUT for repl-timeout
+			fatal("INVALID_"+strings.ToUpper(strings.ReplaceAll(f.name, "-", "_"))+":", err)
+		}
+	}
+
+	if config.Sentinel {
+		if config.ReplicaAddress != "" {
+			fatal("SENTINEL_CANNOT_BE_A_REPLICA")
+		}
+		if err := controller.StartSentinel(config, sentinelMonitor); err != nil {
+			fatal("INVALID_SENTINEL_MONITOR:", err)
+		}
+	} else if err := controller.LoadDataset(config); err != nil {
+		fatal("ERROR_LOADING_DATASET:", err)
+	}
+
 	if config.ReplicaAddress != "" {
 		r = strings.TrimSpace(config.ReplicaAddress)
 		RSlice = strings.Split(r, ":")
 
 		if len(RSlice) != 2 {
-			fmt.Println("INVALID_REPLICA_ARGUMENT")
-			return
+			fatal("INVALID_REPLICA_ARGUMENT")
 		}
 		masterHost, masterPort := RSlice[0], RSlice[1]
 		if masterPort == config.Port {
-			fmt.Println("PORT_OF_REPLICA_SHOULD_BE_DIFFERENT_FROM_MASTER")
-			return
+			fatal("PORT_OF_REPLICA_SHOULD_BE_DIFFERENT_FROM_MASTER")
 		}
 
-		config.IsSlave = true
-		go controller.HandleReplicaConnection(masterHost, masterPort, config.Port, config.RedisMap)
+		controller.ReplicaOf(config, masterHost, masterPort)
 	}
 
 	listener, err := net.Listen("tcp", ":"+config.Port)
 	if err != nil {
-		fmt.Println("Error listening:", err)
-		return
+		fatal("Error listening:", err)
 	}
 	defer listener.Close()
 	fmt.Println("Server is listening on " + ":" + config.Port)
@@ -17,6 +17,7 @@ for part in "${cmd_parts[@]}"; do
     resp_command+="\$${part_length}\r\n${part}\r\n"
 done
 
-echo ${resp_command}
+# Emit real CRLFs, the server no longer rewrites literal "\r\n" sequences
+printf '%b' "${resp_command}"
 
 
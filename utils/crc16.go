@@ -0,0 +1,33 @@
+package utils
+
+import "strings"
+
+// Number of hash slots the keyspace is divided into, as in Redis Cluster
+const HashSlots = 16384
+
+// CRC16 implements the CCITT XMODEM variant Redis Cluster uses for slots.
+func CRC16(data string) uint16 {
+	var crc uint16
+	for i := 0; i < len(data); i++ {
+		crc ^= uint16(data[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// KeyHashSlot maps a key, or a shard channel, to its hash slot. When the key
+// holds a non empty {hash tag} only the tag is hashed.
+func KeyHashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start != -1 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(CRC16(key) % HashSlots)
+}
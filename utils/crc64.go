@@ -0,0 +1,29 @@
+package utils
+
+// Reflected form of the Jones polynomial used by Redis for RDB checksums
+const crc64JonesPoly = 0x95AC9329AC4BC9B5
+
+var crc64Table = func() [256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		crc := uint64(i)
+		for bit := 0; bit < 8; bit++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ crc64JonesPoly
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// CRC64 continues the checksum crc over data, without the initial and final
+// inversion Go's hash/crc64 applies, as Redis does.
+func CRC64(crc uint64, data []byte) uint64 {
+	for _, b := range data {
+		crc = crc64Table[byte(crc)^b] ^ crc>>8
+	}
+	return crc
+}
@@ -0,0 +1,327 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+
+	configuration "github.com/oussamasf/yuji/config"
+)
+
+// DecodeRDB parses a dump produced by WriteRDB, or by Redis as long as it only
+// holds strings, and returns the keyspace of database 0. Expiry times are kept
+// as they are, dropping already expired keys is up to the caller.
+func DecodeRDB(data []byte) (map[string]configuration.ICache, error) {
+	if len(data) < 9 || string(data[:5]) != "REDIS" {
+		return nil, fmt.Errorf("wrong signature trying to load DB")
+	}
+	version, err := strconv.Atoi(string(data[5:9]))
+	if err != nil || version < 1 || version > RDBVersion {
+		return nil, fmt.Errorf("can't handle RDB format version %s", data[5:9])
+	}
+
+	r := &rdbReader{data: data, pos: 9}
+	cache := make(map[string]configuration.ICache)
+	expireAt := ""
+	db := uint64(0)
+
+	for {
+		opcode, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case RDBOpcodeEOF:
+			//? Version 5 added the checksum, a zero one means it was disabled
+			if version >= 5 {
+				end := r.pos
+				expected, err := r.readUint64()
+				if err != nil {
+					return nil, err
+				}
+				if expected != 0 && expected != CRC64(0, data[:end]) {
+					return nil, fmt.Errorf("wrong RDB checksum")
+				}
+			}
+			return cache, nil
+
+		case RDBOpcodeSelectDB:
+			if db, err = r.readLength(); err != nil {
+				return nil, err
+			}
+
+		case RDBOpcodeResizeDB:
+			if _, err := r.readLength(); err != nil {
+				return nil, err
+			}
+			if _, err := r.readLength(); err != nil {
+				return nil, err
+			}
+
+		case RDBOpcodeAux:
+			if _, err := r.readString(); err != nil {
+				return nil, err
+			}
+			if _, err := r.readString(); err != nil {
+				return nil, err
+			}
+
+		case RDBOpcodeSlotInfo:
+			for i := 0; i < 3; i++ {
+				if _, err := r.readLength(); err != nil {
+					return nil, err
+				}
+			}
+
+		case RDBOpcodeExpireTimeM:
+			ms, err := r.readUint64()
+			if err != nil {
+				return nil, err
+			}
+			expireAt = strconv.FormatInt(int64(ms), 10)
+
+		case RDBOpcodeExpireTime:
+			seconds, err := r.readBytes(4)
+			if err != nil {
+				return nil, err
+			}
+			expireAt = strconv.FormatInt(int64(binary.LittleEndian.Uint32(seconds))*1000, 10)
+
+		case RDBTypeString, RDBTypeYujiStream:
+			key, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+
+			value := configuration.ICache{ExpirationMap: expireAt}
+			if opcode == RDBTypeString {
+				value.Type = configuration.String
+				value.Data, err = r.readString()
+			} else {
+				value.Type = configuration.Stream
+				value.StreamData, err = r.readStream()
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			//? There is a single database, the others are read and dropped
+			if db == 0 {
+				cache[key] = value
+			}
+			expireAt = ""
+
+		default:
+			return nil, fmt.Errorf("unsupported RDB type or opcode 0x%02x at offset %d", opcode, r.pos-1)
+		}
+	}
+}
+
+type rdbReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *rdbReader) readByte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, fmt.Errorf("unexpected end of RDB: %w", io.ErrUnexpectedEOF)
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *rdbReader) readBytes(n uint64) ([]byte, error) {
+	if n > uint64(len(r.data)-r.pos) {
+		return nil, fmt.Errorf("unexpected end of RDB: %w", io.ErrUnexpectedEOF)
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b, nil
+}
+
+func (r *rdbReader) readUint64() (uint64, error) {
+	b, err := r.readBytes(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+// readLengthOrEncoding returns either a length or, when encoded is true, the
+// special string encoding stored in the low 6 bits
+func (r *rdbReader) readLengthOrEncoding() (length uint64, encoded bool, err error) {
+	first, err := r.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch first >> 6 {
+	case 0:
+		return uint64(first & 0x3F), false, nil
+	case 1:
+		next, err := r.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(first&0x3F)<<8 | uint64(next), false, nil
+	case 3:
+		return uint64(first & 0x3F), true, nil
+	}
+
+	switch first {
+	case 0x80:
+		b, err := r.readBytes(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(b)), false, nil
+	case 0x81:
+		b, err := r.readBytes(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(b), false, nil
+	}
+	return 0, false, fmt.Errorf("unknown length encoding 0x%02x in RDB", first)
+}
+
+func (r *rdbReader) readLength() (uint64, error) {
+	length, encoded, err := r.readLengthOrEncoding()
+	if err == nil && encoded {
+		err = fmt.Errorf("unexpected string encoding where a length was expected in RDB")
+	}
+	return length, err
+}
+
+func (r *rdbReader) readString() (string, error) {
+	length, encoded, err := r.readLengthOrEncoding()
+	if err != nil {
+		return "", err
+	}
+	if !encoded {
+		b, err := r.readBytes(length)
+		return string(b), err
+	}
+
+	//? Integers saved as strings, and LZF compressed strings
+	switch length {
+	case 0:
+		b, err := r.readBytes(1)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int8(b[0]))), nil
+	case 1:
+		b, err := r.readBytes(2)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(b)))), nil
+	case 2:
+		b, err := r.readBytes(4)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(b)))), nil
+	case 3:
+		compressedLen, err := r.readLength()
+		if err != nil {
+			return "", err
+		}
+		rawLen, err := r.readLength()
+		if err != nil {
+			return "", err
+		}
+		compressed, err := r.readBytes(compressedLen)
+		if err != nil {
+			return "", err
+		}
+		raw, err := lzfDecompress(compressed, rawLen)
+		return string(raw), err
+	}
+	return "", fmt.Errorf("unknown string encoding %d in RDB", length)
+}
+
+func (r *rdbReader) readStream() (configuration.IStream, error) {
+	stream := configuration.IStream{}
+
+	count, err := r.readLength()
+	if err != nil {
+		return stream, err
+	}
+	for i := uint64(0); i < count; i++ {
+		entry := configuration.StreamEntry{Values: make(map[string]string)}
+		if entry.ID, err = r.readString(); err != nil {
+			return stream, err
+		}
+
+		fields, err := r.readLength()
+		if err != nil {
+			return stream, err
+		}
+		for j := uint64(0); j < fields; j++ {
+			field, err := r.readString()
+			if err != nil {
+				return stream, err
+			}
+			if entry.Values[field], err = r.readString(); err != nil {
+				return stream, err
+			}
+		}
+		stream.Entries = append(stream.Entries, entry)
+	}
+
+	stream.LastID, err = r.readString()
+	return stream, err
+}
+
+// lzfDecompress expands the LZF format Redis uses for long strings
+func lzfDecompress(in []byte, rawLen uint64) ([]byte, error) {
+	//? A back reference of 3 bytes expands to at most 264, the announced
+	//? length is only trusted that far
+	out := bytes.NewBuffer(make([]byte, 0, min(rawLen, uint64(len(in))*88)))
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+
+		//? Literal run of ctrl+1 bytes
+		if ctrl < 1<<5 {
+			if i+ctrl+1 > len(in) {
+				return nil, fmt.Errorf("invalid LZF data in RDB")
+			}
+			out.Write(in[i : i+ctrl+1])
+			i += ctrl + 1
+			continue
+		}
+
+		//? Back reference
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(in) {
+				return nil, fmt.Errorf("invalid LZF data in RDB")
+			}
+			length += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, fmt.Errorf("invalid LZF data in RDB")
+		}
+		ref := out.Len() - (ctrl&0x1F)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, fmt.Errorf("invalid LZF data in RDB")
+		}
+		for j := 0; j < length+2; j++ {
+			out.WriteByte(out.Bytes()[ref+j])
+		}
+	}
+
+	if uint64(out.Len()) != rawLen {
+		return nil, fmt.Errorf("invalid LZF data in RDB")
+	}
+	return out.Bytes(), nil
+}
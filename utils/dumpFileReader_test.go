@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	configuration "github.com/oussamasf/yuji/config"
+)
+
+// rawRDB frames body as a version 11 dump, with a zero checksum meaning it
+// isn't checked
+func rawRDB(body ...byte) []byte {
+	data := append([]byte("REDIS0011"), body...)
+	return append(data, RDBOpcodeEOF, 0, 0, 0, 0, 0, 0, 0, 0)
+}
+
+func TestDecodeRDB(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    map[string]configuration.ICache
+		wantErr bool
+	}{
+		{
+			name: "plain string",
+			data: rawRDB(RDBOpcodeSelectDB, 0, RDBTypeString, 1, 'k', 2, 'v', '1'),
+			want: map[string]configuration.ICache{"k": {Type: configuration.String, Data: "v1"}},
+		},
+		{
+			name: "integer encoded strings",
+			data: rawRDB(
+				RDBTypeString, 1, 'a', 0xC0, 0xFB,
+				RDBTypeString, 1, 'b', 0xC1, 0x39, 0x30,
+				RDBTypeString, 1, 'c', 0xC2, 0x00, 0x00, 0x00, 0x80,
+			),
+			want: map[string]configuration.ICache{
+				"a": {Type: configuration.String, Data: "-5"},
+				"b": {Type: configuration.String, Data: "12345"},
+				"c": {Type: configuration.String, Data: "-2147483648"},
+			},
+		},
+		{
+			name: "lzf string",
+			data: rawRDB(RDBTypeString, 1, 'k', 0xC3, 6, 9, 0x02, 'a', 'b', 'c', 0x80, 0x02),
+			want: map[string]configuration.ICache{"k": {Type: configuration.String, Data: "abcabcabc"}},
+		},
+		{
+			name: "expire in milliseconds",
+			data: rawRDB(RDBOpcodeExpireTimeM, 0xE8, 0x03, 0, 0, 0, 0, 0, 0, RDBTypeString, 1, 'k', 1, 'v'),
+			want: map[string]configuration.ICache{"k": {Type: configuration.String, Data: "v", ExpirationMap: "1000"}},
+		},
+		{
+			name: "expire in seconds",
+			data: rawRDB(RDBOpcodeExpireTime, 2, 0, 0, 0, RDBTypeString, 1, 'k', 1, 'v'),
+			want: map[string]configuration.ICache{"k": {Type: configuration.String, Data: "v", ExpirationMap: "2000"}},
+		},
+		{
+			name: "aux fields and other databases skipped",
+			data: rawRDB(
+				RDBOpcodeAux, 1, 'x', 1, 'y',
+				RDBOpcodeSelectDB, 0, RDBOpcodeResizeDB, 1, 0, RDBTypeString, 1, 'a', 1, '0',
+				RDBOpcodeSelectDB, 1, RDBTypeString, 1, 'b', 1, '1',
+			),
+			want: map[string]configuration.ICache{"a": {Type: configuration.String, Data: "0"}},
+		},
+		{name: "wrong signature", data: []byte("RADIS0011\xff"), wantErr: true},
+		{name: "newer version", data: []byte("REDIS0099\xff"), wantErr: true},
+		{name: "truncated", data: []byte("REDIS0011\x00\x01k\x05ab"), wantErr: true},
+		{name: "missing eof", data: []byte("REDIS0011"), wantErr: true},
+		{name: "unknown type", data: rawRDB(0x0E, 1, 'k'), wantErr: true},
+		{name: "invalid lzf", data: rawRDB(RDBTypeString, 1, 'k', 0xC3, 2, 9, 0x20, 0x05), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeRDB(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("DecodeRDB() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DecodeRDB() error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("DecodeRDB() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeRDBChecksum(t *testing.T) {
+	data := EncodeRDB(map[string]configuration.ICache{"k": {Type: configuration.String, Data: "v"}})
+	if _, err := DecodeRDB(data); err != nil {
+		t.Fatalf("DecodeRDB() error: %v", err)
+	}
+
+	data[len(data)-1] ^= 0xFF
+	if _, err := DecodeRDB(data); err == nil {
+		t.Fatalf("DecodeRDB() accepted a wrong checksum")
+	}
+}
+
+func TestRDBRoundTrip(t *testing.T) {
+	cache := map[string]configuration.ICache{
+		"empty":  {Type: configuration.String, Data: ""},
+		"binary": {Type: configuration.String, Data: "a\r\n\x00b"},
+		"long":   {Type: configuration.String, Data: string(bytes.Repeat([]byte("x"), 20000))},
+		"ttl":    {Type: configuration.String, Data: "v", ExpirationMap: "1700000000000"},
+		"stream": {Type: configuration.Stream, StreamData: configuration.IStream{
+			Entries: []configuration.StreamEntry{
+				{ID: "1-1", Values: map[string]string{"f": "1", "g": "2"}},
+				{ID: "2-0", Values: map[string]string{}},
+			},
+			LastID: "2-0",
+		}},
+	}
+
+	got, err := DecodeRDB(EncodeRDB(cache))
+	if err != nil {
+		t.Fatalf("DecodeRDB() error: %v", err)
+	}
+	if !reflect.DeepEqual(got, cache) {
+		t.Fatalf("DecodeRDB(EncodeRDB()) = %+v, want %+v", got, cache)
+	}
+}
+
+func TestRDBLengthEncoding(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        []byte
+		wantLength  uint64
+		wantEncoded bool
+		wantErr     bool
+	}{
+		{name: "6 bits", data: []byte{0x0A}, wantLength: 10},
+		{name: "14 bits", data: []byte{0x41, 0x00}, wantLength: 256},
+		{name: "32 bits", data: []byte{0x80, 0x00, 0x01, 0x00, 0x00}, wantLength: 65536},
+		{name: "64 bits", data: []byte{0x81, 0, 0, 0, 1, 0, 0, 0, 0}, wantLength: 1 << 32},
+		{name: "special encoding", data: []byte{0xC3}, wantLength: 3, wantEncoded: true},
+		{name: "unknown", data: []byte{0x82}, wantErr: true},
+		{name: "truncated 14 bits", data: []byte{0x41}, wantErr: true},
+		{name: "truncated 32 bits", data: []byte{0x80, 0x00}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &rdbReader{data: tt.data}
+			length, encoded, err := r.readLengthOrEncoding()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("readLengthOrEncoding(%x) = %d, want an error", tt.data, length)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readLengthOrEncoding(%x) error: %v", tt.data, err)
+			}
+			if length != tt.wantLength || encoded != tt.wantEncoded {
+				t.Fatalf("readLengthOrEncoding(%x) = %d, %v, want %d, %v", tt.data, length, encoded, tt.wantLength, tt.wantEncoded)
+			}
+		})
+	}
+
+	//? What writeLength produces reads back the same
+	for _, length := range []uint64{0, 63, 64, 16383, 16384, 0xFFFFFFFF, 1 << 40} {
+		var buf bytes.Buffer
+		writeLength(&buf, length)
+		r := &rdbReader{data: buf.Bytes()}
+		if got, err := r.readLength(); err != nil || got != length || r.pos != buf.Len() {
+			t.Fatalf("readLength(writeLength(%d)) = %d, %v", length, got, err)
+		}
+	}
+}
+
+func TestLZFDecompress(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []byte
+		rawLen  uint64
+		want    string
+		wantErr bool
+	}{
+		{name: "literal", in: []byte{0x02, 'a', 'b', 'c'}, rawLen: 3, want: "abc"},
+		{name: "overlapping reference", in: []byte{0x02, 'a', 'b', 'c', 0x80, 0x02}, rawLen: 9, want: "abcabcabc"},
+		{name: "long reference", in: []byte{0x00, 'a', 0xE0, 0x03, 0x00}, rawLen: 13, want: "aaaaaaaaaaaaa"},
+		{name: "literal past the end", in: []byte{0x05, 'a'}, rawLen: 6, wantErr: true},
+		{name: "reference before the start", in: []byte{0x00, 'a', 0x20, 0x05}, rawLen: 4, wantErr: true},
+		{name: "missing offset", in: []byte{0x00, 'a', 0x20}, rawLen: 4, wantErr: true},
+		{name: "wrong raw length", in: []byte{0x02, 'a', 'b', 'c'}, rawLen: 4, wantErr: true},
+		{name: "huge raw length", in: []byte{0x00, 'a'}, rawLen: 1 << 62, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lzfDecompress(tt.in, tt.rawLen)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("lzfDecompress(%x) = %q, want an error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("lzfDecompress(%x) error: %v", tt.in, err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("lzfDecompress(%x) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
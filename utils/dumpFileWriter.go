@@ -1,85 +1,229 @@
 package utils
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
-	"encoding/hex"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"time"
 
 	configuration "github.com/oussamasf/yuji/config"
 )
 
-func ReadRDBFile(config *configuration.AppSettings) string {
+// Constants for RDB format
+const (
+	RDBVersion           = 11
+	RDBOpcodeSlotInfo    = 0xF4
+	RDBOpcodeAux         = 0xFA // Auxiliary field
+	RDBOpcodeResizeDB    = 0xFB // Hash table sizes
+	RDBOpcodeExpireTimeM = 0xFC // Expire time in milliseconds
+	RDBOpcodeExpireTime  = 0xFD // Expire time in seconds
+	RDBOpcodeSelectDB    = 0xFE // DB selection opcode
+	RDBOpcodeEOF         = 0xFF // EOF opcode
+	RDBTypeString        = 0x00 // String encoding type
+	//? Streams are stored with yuji's own encoding, Redis uses listpacks which
+	//? this server doesn't implement, so the type code is outside Redis's range
+	RDBTypeYujiStream = 0xC8
+)
+
+// ReadRDBFile returns the raw content of the dump file, or the dump of an
+// empty keyspace when no file was saved yet.
+func ReadRDBFile(config *configuration.AppSettings) ([]byte, error) {
 	filePath := filepath.Join(config.Dir, config.DBFileName)
 	data, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return EncodeRDB(map[string]configuration.ICache{}), nil
+	}
 	if err != nil {
-		log.Fatalf("Error reading RDB file: %v", err)
+		return nil, fmt.Errorf("failed to read RDB file: %v", err)
 	}
 
-	return hex.EncodeToString(data)
+	return data, nil
 }
 
+// EncodeRDB serializes the keyspace in the RDB format.
+func EncodeRDB(cache map[string]configuration.ICache) []byte {
+	var buf bytes.Buffer
+	WriteRDB(&buf, cache)
+	return buf.Bytes()
+}
+
+// SaveRDBFile saves the keyspace as the dump file, see SaveRDBSnapshot.
 func SaveRDBFile(config *configuration.AppSettings) error {
-	if _, err := os.Stat(config.Dir); os.IsNotExist(err) {
-		if err := os.MkdirAll(config.Dir, 0755); err != nil {
-			return err
-		}
+	temp := fmt.Sprintf("temp-%d.rdb", os.Getpid())
+	return saveRDB(config.Dir, config.DBFileName, temp, config.RedisMap)
+}
+
+// SaveRDBSnapshot saves a copy of the keyspace as the dump file fileName in
+// dir from the background, through a temporary file of its own so it never
+// collides with SaveRDBFile.
+func SaveRDBSnapshot(dir string, fileName string, cache map[string]configuration.ICache) error {
+	temp := fmt.Sprintf("temp-bg-%d.rdb", os.Getpid())
+	return saveRDB(dir, fileName, temp, cache)
+}
+
+// saveRDB writes and fsyncs the dump to a temporary file, then renames it over
+// the previous one: a crash at any point leaves either dump intact.
+func saveRDB(dir string, fileName string, temp string, cache map[string]configuration.ICache) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
 	}
 
-	fullPath := filepath.Join(config.Dir, config.DBFileName)
+	tempPath := filepath.Join(dir, temp)
+	if err := WriteSyncedFile(tempPath, func(w io.Writer) error { return WriteRDB(w, cache) }); err != nil {
+		return fmt.Errorf("failed to write %s: %v", tempPath, err)
+	}
+	if err := RenameSynced(tempPath, filepath.Join(dir, fileName)); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to rename %s to %s: %v", temp, fileName, err)
+	}
+	return nil
+}
 
-	file, err := os.Create(fullPath)
-	if err != nil {
-		return fmt.Errorf("failed to create file: %v", err)
+// RemoveTempRDBFiles discards the dumps a crash left half written in dir and
+// returns their names.
+func RemoveTempRDBFiles(dir string) []string {
+	paths, _ := filepath.Glob(filepath.Join(dir, "temp-*.rdb"))
+	removed := []string{}
+	for _, path := range paths {
+		if os.Remove(path) == nil {
+			removed = append(removed, filepath.Base(path))
+		}
 	}
-	defer file.Close()
+	return removed
+}
+
+// WriteRDB writes the keyspace as a complete RDB: header, auxiliary fields,
+// database 0, EOF opcode and CRC64 checksum.
+func WriteRDB(w io.Writer, cache map[string]configuration.ICache) error {
+	out := bufio.NewWriter(w)
+	file := &checksumWriter{writer: out}
+
+	file.Write([]byte(fmt.Sprintf("REDIS%04d", RDBVersion)))
+
+	writeAux(file, "redis-ver", "7.2.0")
+	writeAux(file, "redis-bits", strconv.Itoa(strconv.IntSize))
+	writeAux(file, "ctime", strconv.FormatInt(time.Now().Unix(), 10))
 
 	//? Write database subsection start
-	file.Write([]byte{0xFE, 0x00})
+	file.Write([]byte{RDBOpcodeSelectDB})
+	writeLength(file, 0)
+
+	keys := make([]string, 0, len(cache))
+	expires := 0
+	for key, value := range cache {
+		keys = append(keys, key)
+		if value.ExpirationMap != "" {
+			expires++
+		}
+	}
+	sort.Strings(keys)
 
 	//? Write hash table sizes
-	file.Write([]byte{0xFB})
-	writeSize(file, uint64(len(config.RedisMap)))
-	writeSize(file, uint64(len(config.RedisMap)))
+	file.Write([]byte{RDBOpcodeResizeDB})
+	writeLength(file, uint64(len(keys)))
+	writeLength(file, uint64(expires))
 
 	//? Write key-value pairs
-	for key, value := range config.RedisMap {
-		//? Write string type flag
-		file.Write([]byte{0x00})
+	for _, key := range keys {
+		value := cache[key]
 
-		writeString(file, key)
+		//? Write expire if exists, as an absolute unix time in milliseconds
+		if expireMs, err := strconv.ParseInt(value.ExpirationMap, 10, 64); err == nil {
+			file.Write([]byte{RDBOpcodeExpireTimeM})
+			binary.Write(file, binary.LittleEndian, uint64(expireMs))
+		}
 
+		if value.Type == configuration.Stream {
+			file.Write([]byte{RDBTypeYujiStream})
+			writeString(file, key)
+			writeStream(file, value.StreamData)
+			continue
+		}
+
+		//? Write string type flag
+		file.Write([]byte{RDBTypeString})
+		writeString(file, key)
 		writeString(file, value.Data)
+	}
+
+	file.Write([]byte{RDBOpcodeEOF})
+	checksum := file.checksum
+	binary.Write(file, binary.LittleEndian, checksum)
+
+	if file.err != nil {
+		return file.err
+	}
+	return out.Flush()
+}
+
+func writeAux(file io.Writer, key string, value string) {
+	file.Write([]byte{RDBOpcodeAux})
+	writeString(file, key)
+	writeString(file, value)
+}
 
-		//? Write expire if exists
-		expireMs, err := strconv.ParseInt(config.RedisMap[key].ExpirationMap, 10, 64)
-
-		if err == nil {
-			expirationTime := time.Unix(0, expireMs*int64(time.Millisecond))
-			now := time.Now()
-			if expirationTime.Sub(now) > 1000*time.Hour {
-				file.Write([]byte{0xFC})
-				binary.Write(file, binary.LittleEndian, uint64(expirationTime.UnixNano()/1e6))
-			} else {
-				file.Write([]byte{0xFD})
-				binary.Write(file, binary.LittleEndian, uint32(expirationTime.Unix()))
-			}
+func writeStream(file io.Writer, stream configuration.IStream) {
+	writeLength(file, uint64(len(stream.Entries)))
+	for _, entry := range stream.Entries {
+		writeString(file, entry.ID)
+
+		fields := make([]string, 0, len(entry.Values))
+		for field := range entry.Values {
+			fields = append(fields, field)
 		}
+		sort.Strings(fields)
 
+		writeLength(file, uint64(len(fields)))
+		for _, field := range fields {
+			writeString(file, field)
+			writeString(file, entry.Values[field])
+		}
 	}
+	writeString(file, stream.LastID)
+}
 
-	return nil
+// writeLength uses the RDB length encoding: 6, 14, 32 or 64 bits depending on
+// the value, flagged by the two most significant bits of the first byte
+func writeLength(file io.Writer, length uint64) {
+	switch {
+	case length < 1<<6:
+		file.Write([]byte{byte(length)})
+	case length < 1<<14:
+		file.Write([]byte{byte(length>>8) | 0x40, byte(length)})
+	case length <= 0xFFFFFFFF:
+		file.Write([]byte{0x80})
+		binary.Write(file, binary.BigEndian, uint32(length))
+	default:
+		file.Write([]byte{0x81})
+		binary.Write(file, binary.BigEndian, length)
+	}
 }
 
-func writeSize(file *os.File, size uint64) {
-	binary.Write(file, binary.BigEndian, size)
+func writeString(file io.Writer, s string) {
+	writeLength(file, uint64(len(s)))
+	io.WriteString(file, s)
 }
 
-func writeString(file *os.File, s string) {
-	writeSize(file, uint64(len(s)))
-	file.Write([]byte(s))
+// checksumWriter keeps the CRC64 of everything written and the first error,
+// so the encoder doesn't have to check every single write
+type checksumWriter struct {
+	writer   io.Writer
+	checksum uint64
+	err      error
+}
+
+func (w *checksumWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.checksum = CRC64(w.checksum, p)
+	n, err := w.writer.Write(p)
+	w.err = err
+	return n, err
 }
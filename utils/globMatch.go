@@ -0,0 +1,98 @@
+package utils
+
+// GlobMatch reports whether s matches a Redis glob-style pattern: * matches
+// any sequence, ? any single byte, [abc], [^abc] and [a-z] match classes and
+// a backslash escapes the next byte. Unlike path.Match, '/' is not special.
+func GlobMatch(pattern string, s string) bool {
+	p, i := 0, 0
+
+	for p < len(pattern) {
+		switch pattern[p] {
+		case '*':
+			//? Collapse consecutive stars, a trailing one matches everything
+			for p+1 < len(pattern) && pattern[p+1] == '*' {
+				p++
+			}
+			if p+1 == len(pattern) {
+				return true
+			}
+			for j := i; j <= len(s); j++ {
+				if GlobMatch(pattern[p+1:], s[j:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if i >= len(s) {
+				return false
+			}
+			i++
+		case '[':
+			if i >= len(s) {
+				return false
+			}
+			matched, next := matchClass(pattern, p+1, s[i])
+			if !matched {
+				return false
+			}
+			p = next
+			i++
+		case '\\':
+			if p+1 < len(pattern) {
+				p++
+			}
+			fallthrough
+		default:
+			if i >= len(s) || pattern[p] != s[i] {
+				return false
+			}
+			i++
+		}
+		p++
+	}
+
+	return i == len(s)
+}
+
+// matchClass matches ch against the class starting right after '[' and
+// returns the index of the closing ']'
+func matchClass(pattern string, p int, ch byte) (bool, int) {
+	not := false
+	if p < len(pattern) && pattern[p] == '^' {
+		not = true
+		p++
+	}
+
+	matched := false
+	for p < len(pattern) && pattern[p] != ']' {
+		switch {
+		case pattern[p] == '\\' && p+1 < len(pattern):
+			p++
+			if pattern[p] == ch {
+				matched = true
+			}
+		case p+2 < len(pattern) && pattern[p+1] == '-' && pattern[p+2] != ']':
+			start, end := pattern[p], pattern[p+2]
+			if start > end {
+				start, end = end, start
+			}
+			if ch >= start && ch <= end {
+				matched = true
+			}
+			p += 2
+		case pattern[p] == ch:
+			matched = true
+		}
+		p++
+	}
+
+	//? An unterminated class stops at the end of the pattern, like Redis does
+	if p >= len(pattern) {
+		p = len(pattern) - 1
+	}
+
+	if not {
+		matched = !matched
+	}
+	return matched, p
+}
@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseInline splits an inline command line, the format telnet users type,
+// into its arguments. Arguments are separated by spaces and can be quoted:
+// double quotes understand the usual escape sequences (\n, \r, \t, \b, \a,
+// \\, \" and \xHH) while single quotes only understand \'.
+func ParseInline(line string) ([]string, error) {
+	line = strings.TrimRight(line, "\r\n")
+	args := []string{}
+	i := 0
+
+	for {
+		//? Skip blanks between arguments
+		for i < len(line) && isInlineSpace(line[i]) {
+			i++
+		}
+		if i >= len(line) {
+			return args, nil
+		}
+
+		var current strings.Builder
+		inDoubleQuotes, inSingleQuotes := false, false
+		done := false
+
+		for !done {
+			if i >= len(line) {
+				if inDoubleQuotes || inSingleQuotes {
+					return nil, fmt.Errorf("unbalanced quotes in request")
+				}
+				break
+			}
+
+			ch := line[i]
+			switch {
+			case inDoubleQuotes:
+				if ch == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHexDigit(line[i+2]) && isHexDigit(line[i+3]) {
+					b, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					current.WriteByte(byte(b))
+					i += 3
+				} else if ch == '\\' && i+1 < len(line) {
+					i++
+					current.WriteByte(unescapeInline(line[i]))
+				} else if ch == '"' {
+					//? A closing quote must be followed by a space or the end of the line
+					if i+1 < len(line) && !isInlineSpace(line[i+1]) {
+						return nil, fmt.Errorf("unbalanced quotes in request")
+					}
+					done = true
+				} else {
+					current.WriteByte(ch)
+				}
+			case inSingleQuotes:
+				if ch == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					current.WriteByte('\'')
+				} else if ch == '\'' {
+					if i+1 < len(line) && !isInlineSpace(line[i+1]) {
+						return nil, fmt.Errorf("unbalanced quotes in request")
+					}
+					done = true
+				} else {
+					current.WriteByte(ch)
+				}
+			default:
+				switch {
+				case isInlineSpace(ch):
+					done = true
+				case ch == '"':
+					inDoubleQuotes = true
+				case ch == '\'':
+					inSingleQuotes = true
+				default:
+					current.WriteByte(ch)
+				}
+			}
+			i++
+		}
+
+		args = append(args, current.String())
+	}
+}
+
+func isInlineSpace(ch byte) bool {
+	return ch == ' ' || ch == '\t' || ch == '\r' || ch == '\n'
+}
+
+func isHexDigit(ch byte) bool {
+	return (ch >= '0' && ch <= '9') || (ch >= 'a' && ch <= 'f') || (ch >= 'A' && ch <= 'F')
+}
+
+func unescapeInline(ch byte) byte {
+	switch ch {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	default:
+		return ch
+	}
+}
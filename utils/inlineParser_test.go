@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseInline(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty", line: "", want: []string{}},
+		{name: "blank", line: "  \t \r\n", want: []string{}},
+		{name: "plain", line: "SET key value\r\n", want: []string{"SET", "key", "value"}},
+		{name: "extra spaces", line: "  GET   key  ", want: []string{"GET", "key"}},
+		{name: "double quotes", line: `SET "my key" "a value"`, want: []string{"SET", "my key", "a value"}},
+		{name: "escapes", line: `SET k "a\r\nb\t\"c\"\\"`, want: []string{"SET", "k", "a\r\nb\t\"c\"\\"}},
+		{name: "hex escape", line: `SET k "\x00\xff\x41"`, want: []string{"SET", "k", "\x00\xffA"}},
+		{name: "incomplete hex escape", line: `SET k "\x4"`, want: []string{"SET", "k", "x4"}},
+		{name: "single quotes", line: `SET k 'it\'s "raw" \n'`, want: []string{"SET", "k", `it's "raw" \n`}},
+		{name: "empty quoted", line: `SET k ""`, want: []string{"SET", "k", ""}},
+		{name: "unbalanced double", line: `SET k "value`, wantErr: true},
+		{name: "unbalanced single", line: `SET k 'value`, wantErr: true},
+		{name: "text after closing quote", line: `SET k "a"b`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseInline(tt.line)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseInline(%q) = %q, want an error", tt.line, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseInline(%q) error: %v", tt.line, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ParseInline(%q) = %q, want %q", tt.line, got, tt.want)
+			}
+		})
+	}
+}
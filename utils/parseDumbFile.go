@@ -4,14 +4,6 @@ import (
 	"fmt"
 )
 
-// Constants for RDB format
-const (
-	RDBOpcodeSelectDB = 0xFE // DB selection opcode
-	RDBOpcodeEOF      = 0xFF // EOF opcode
-	RDBOpcodeResizeDB = 0xFC // Resize DB opcode
-	RDBTypeString     = 0x00 // String encoding type
-)
-
 // extractString reads a length-prefixed string from the data
 func extractKeys(data []byte) ([]string, error) {
 	var keys []string
@@ -2,108 +2,458 @@ package utils
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"math/big"
 	"strconv"
 	"strings"
 
 	configuration "github.com/oussamasf/yuji/config"
 )
 
+const (
+	//? Same limits Redis applies with proto-max-bulk-len and its inline
+	//? buffer, which bounds every line: inline commands, headers and simple
+	//? strings
+	maxBulkLength = 512 * 1024 * 1024
+	maxLineLength = 64 * 1024
+	maxMultibulk  = 1024 * 1024
+	//? Clients that didn't authenticate yet only get to send small commands,
+	//? like AUTH and HELLO, as in Redis
+	maxUnauthenticatedMultibulk = 10
+	maxUnauthenticatedBulk      = 16 * 1024
+	//? Aggregates are preallocated up to this many elements, the rest grows
+	//? as the elements actually arrive
+	maxPreallocatedElements = 1024
+)
+
+// ProtocolError means the peer sent something that isn't valid RESP, the
+// stream can't be trusted past that point and the connection should be closed.
+type ProtocolError struct {
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.Message
+}
+
+// RESPReader reads RESP values and commands from a stream. Bulk strings are
+// read by length so keys and values can hold any byte, CRLF and NUL included.
+type RESPReader struct {
+	reader *bufio.Reader
+	//? Bytes consumed so far, replication offsets are computed from it
+	consumed int64
+	//? Copy of the bytes read, kept only once Record was called
+	recorded []byte
+	record   bool
+	//? Applies the limits of unauthenticated clients
+	unauthenticated bool
+}
+
+func NewRESPReader(r io.Reader) *RESPReader {
+	return &RESPReader{reader: bufio.NewReader(r)}
+}
+
+// Consumed returns the number of bytes read off the stream so far.
+func (r *RESPReader) Consumed() int64 {
+	return r.consumed
+}
+
+// Record keeps a copy of the bytes read from now on, replicas use it to
+// forward the exact stream received from their master.
+func (r *RESPReader) Record() {
+	r.record = true
+}
+
+// Recorded returns the bytes read since the previous call.
+func (r *RESPReader) Recorded() []byte {
+	recorded := r.recorded
+	r.recorded = nil
+	return recorded
+}
+
+// SetAuthenticated tells whether the client sending the stream authenticated,
+// commands are limited in size until it did.
+func (r *RESPReader) SetAuthenticated(authenticated bool) {
+	r.unauthenticated = !authenticated
+}
+
+// Buffered returns the number of bytes already received but not read yet.
+func (r *RESPReader) Buffered() int {
+	return r.reader.Buffered()
+}
+
 func Parser(input string) (*configuration.RESPValue, error) {
-	reader := bufio.NewReader(strings.NewReader(input))
-	return parseRESPValue(reader)
+	return NewRESPReader(strings.NewReader(input)).ReadValue()
+}
+
+// ReadCommand reads the next command, either a RESP array of bulk strings or
+// an inline command line. A blank inline line returns no arguments.
+func (r *RESPReader) ReadCommand() ([]configuration.RESPValue, error) {
+	first, err := r.reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if first[0] != '*' {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		inlineArgs, err := ParseInline(line)
+		if err != nil {
+			return nil, &ProtocolError{Message: err.Error()}
+		}
+		args := make([]configuration.RESPValue, 0, len(inlineArgs))
+		for _, arg := range inlineArgs {
+			args = append(args, NewBulkString(arg))
+		}
+		return args, nil
+	}
+
+	r.readByte()
+	return r.readCommandArray()
+}
+
+// readCommandArray reads the elements of a command array. They can only be
+// bulk strings, anything else is refused before it is read so a command is
+// never nested.
+func (r *RESPReader) readCommandArray() ([]configuration.RESPValue, error) {
+	length, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	//? An empty or null array is no command, like a blank inline line
+	if length == 0 || length == -1 {
+		return nil, nil
+	}
+	if length < 0 || length > maxMultibulk {
+		return nil, &ProtocolError{Message: "invalid multibulk length"}
+	}
+	if r.unauthenticated && length > maxUnauthenticatedMultibulk {
+		return nil, &ProtocolError{Message: "unauthenticated multibulk length"}
+	}
+
+	args := make([]configuration.RESPValue, 0, min(length, maxPreallocatedElements))
+	for len(args) < length {
+		dataType, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if dataType != '$' {
+			return nil, &ProtocolError{Message: fmt.Sprintf("expected '$', got '%c'", dataType)}
+		}
+		arg, err := r.parseBulkString()
+		if err != nil {
+			return nil, err
+		}
+		if arg.Value == nil {
+			return nil, &ProtocolError{Message: "invalid bulk length"}
+		}
+		args = append(args, *arg)
+	}
+	return args, nil
 }
 
-func parseRESPValue(reader *bufio.Reader) (*configuration.RESPValue, error) {
-	dataType, err := reader.ReadByte()
+// ReadValue reads a single RESP2 or RESP3 value.
+func (r *RESPReader) ReadValue() (*configuration.RESPValue, error) {
+	dataType, err := r.readByte()
 	if err != nil {
 		return nil, err
 	}
 
 	switch dataType {
 	case '+':
-		return parseSimpleString(reader)
+		return r.parseSimpleString()
 	case '-':
-		return parseError(reader)
+		return r.parseError()
 	case ':':
-		return parseInteger(reader)
+		return r.parseInteger()
 	case '$':
-		return parseBulkString(reader)
-	case '*':
-		return parseArray(reader)
+		return r.parseBulkString()
+	case '*', '~', '>':
+		return r.parseAggregate(dataType, 1)
+	case '%':
+		return r.parseAggregate(dataType, 2)
+	case '|':
+		return r.parseAttribute()
+	case ',':
+		return r.parseDouble()
+	case '#':
+		return r.parseBoolean()
+	case '(':
+		return r.parseBigNumber()
+	case '_':
+		return r.parseNull()
+	case '=':
+		return r.parseVerbatimString()
 	default:
-		return nil, fmt.Errorf("unknown data type: %c", dataType)
+		return nil, &ProtocolError{Message: fmt.Sprintf("unknown data type: %c", dataType)}
 	}
 }
 
-func parseSimpleString(reader *bufio.Reader) (*configuration.RESPValue, error) {
-	line, err := reader.ReadString('\n')
+// ReadBulkPayload reads a "$<length>\r\n" header followed by exactly length
+// bytes with no trailing CRLF, the framing used for the RDB sent on full sync.
+func (r *RESPReader) ReadBulkPayload() ([]byte, error) {
+	dataType, err := r.readByte()
 	if err != nil {
 		return nil, err
 	}
-	return &configuration.RESPValue{Type: '+', Value: strings.TrimRight(line, "\r\n")}, nil
-}
+	if dataType != '$' {
+		return nil, &ProtocolError{Message: fmt.Sprintf("expected '$', got '%c'", dataType)}
+	}
 
-func parseError(reader *bufio.Reader) (*configuration.RESPValue, error) {
-	line, err := reader.ReadString('\n')
+	//? Diskless transfers don't know the length up front: "$EOF:<40 bytes mark>"
+	//? and the payload ends with the same mark
+	line, err := r.readLine()
 	if err != nil {
 		return nil, err
 	}
-	return &configuration.RESPValue{Type: '-', Value: strings.TrimRight(line, "\r\n")}, nil
+	if mark, ok := strings.CutPrefix(line, "EOF:"); ok {
+		if len(mark) != EOFMarkLength {
+			return nil, &ProtocolError{Message: "invalid EOF mark"}
+		}
+		return r.readUntilMark([]byte(mark))
+	}
+
+	length, err := strconv.Atoi(line)
+	if err != nil {
+		return nil, &ProtocolError{Message: "invalid length"}
+	}
+	if length < 0 || length > maxBulkLength {
+		return nil, &ProtocolError{Message: "invalid bulk length"}
+	}
+	return r.readFull(length)
+}
+
+// readUntilMark reads up to and including mark, which isn't returned
+func (r *RESPReader) readUntilMark(mark []byte) ([]byte, error) {
+	var data []byte
+	last := mark[len(mark)-1]
+	for {
+		b, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, b)
+		if b == last && bytes.HasSuffix(data, mark) {
+			return data[:len(data)-len(mark)], nil
+		}
+		if len(data) > maxBulkLength+len(mark) {
+			return nil, &ProtocolError{Message: "invalid bulk length"}
+		}
+	}
 }
 
-func parseInteger(reader *bufio.Reader) (*configuration.RESPValue, error) {
-	line, err := reader.ReadString('\n')
+func (r *RESPReader) parseSimpleString() (*configuration.RESPValue, error) {
+	line, err := r.readLine()
 	if err != nil {
 		return nil, err
 	}
-	value, err := strconv.ParseInt(strings.TrimRight(line, "\r\n"), 10, 64)
+	return &configuration.RESPValue{Type: '+', Value: line}, nil
+}
+
+func (r *RESPReader) parseError() (*configuration.RESPValue, error) {
+	line, err := r.readLine()
 	if err != nil {
 		return nil, err
 	}
-	return &configuration.RESPValue{Type: ':', Value: value}, nil
+	return &configuration.RESPValue{Type: '-', Value: line}, nil
 }
 
-func parseBulkString(reader *bufio.Reader) (*configuration.RESPValue, error) {
-	lenStr, err := reader.ReadString('\n')
+func (r *RESPReader) parseInteger() (*configuration.RESPValue, error) {
+	line, err := r.readLine()
 	if err != nil {
 		return nil, err
 	}
-	length, err := strconv.Atoi(strings.TrimRight(lenStr, "\r\n"))
+	value, err := strconv.ParseInt(line, 10, 64)
+	if err != nil {
+		return nil, &ProtocolError{Message: "invalid integer"}
+	}
+	return &configuration.RESPValue{Type: ':', Value: value}, nil
+}
+
+func (r *RESPReader) parseBulkString() (*configuration.RESPValue, error) {
+	length, err := r.readLength()
 	if err != nil {
 		return nil, err
 	}
 	if length == -1 {
 		return &configuration.RESPValue{Type: '$', Value: nil}, nil
 	}
-	data := make([]byte, length+2) // +2 for \r\n
-	_, err = io.ReadFull(reader, data)
+	if length < 0 || length > maxBulkLength {
+		return nil, &ProtocolError{Message: "invalid bulk length"}
+	}
+	if r.unauthenticated && length > maxUnauthenticatedBulk {
+		return nil, &ProtocolError{Message: "unauthenticated bulk length"}
+	}
+	data, err := r.readFull(length + 2) // +2 for \r\n
 	if err != nil {
 		return nil, err
 	}
+	if data[length] != '\r' || data[length+1] != '\n' {
+		return nil, &ProtocolError{Message: "bulk string is not terminated by CRLF"}
+	}
 	return &configuration.RESPValue{Type: '$', Value: string(data[:length])}, nil
 }
 
-func parseArray(reader *bufio.Reader) (*configuration.RESPValue, error) {
-	lenStr, err := reader.ReadString('\n')
-	if err != nil {
-		return nil, err
-	}
-	length, err := strconv.Atoi(strings.TrimRight(lenStr, "\r\n"))
+// parseAggregate reads arrays, sets and pushes, and maps whose announced
+// length counts pairs, every element is kept in a flat slice
+func (r *RESPReader) parseAggregate(dataType byte, elementsPerEntry int) (*configuration.RESPValue, error) {
+	length, err := r.readLength()
 	if err != nil {
 		return nil, err
 	}
 	if length == -1 {
-		return &configuration.RESPValue{Type: '*', Value: nil}, nil
+		return &configuration.RESPValue{Type: dataType, Value: nil}, nil
+	}
+	if length < 0 || length > maxMultibulk {
+		return nil, &ProtocolError{Message: "invalid multibulk length"}
 	}
-	array := make([]configuration.RESPValue, length)
-	for i := 0; i < length; i++ {
-		value, err := parseRESPValue(reader)
+	count := length * elementsPerEntry
+	array := make([]configuration.RESPValue, 0, min(count, maxPreallocatedElements))
+	for len(array) < count {
+		value, err := r.ReadValue()
 		if err != nil {
 			return nil, err
 		}
-		array[i] = *value
+		array = append(array, *value)
+	}
+	return &configuration.RESPValue{Type: dataType, Value: array}, nil
+}
+
+// parseAttribute reads an attribute map and attaches it to the value that follows
+func (r *RESPReader) parseAttribute() (*configuration.RESPValue, error) {
+	attributes, err := r.parseAggregate('|', 2)
+	if err != nil {
+		return nil, err
+	}
+	value, err := r.ReadValue()
+	if err != nil {
+		return nil, err
+	}
+	value.Attributes, _ = attributes.Value.([]configuration.RESPValue)
+	return value, nil
+}
+
+func (r *RESPReader) parseDouble() (*configuration.RESPValue, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	value, err := strconv.ParseFloat(line, 64)
+	if err != nil {
+		return nil, &ProtocolError{Message: "invalid double"}
+	}
+	return &configuration.RESPValue{Type: ',', Value: value}, nil
+}
+
+func (r *RESPReader) parseBoolean() (*configuration.RESPValue, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	switch line {
+	case "t":
+		return &configuration.RESPValue{Type: '#', Value: true}, nil
+	case "f":
+		return &configuration.RESPValue{Type: '#', Value: false}, nil
+	default:
+		return nil, &ProtocolError{Message: "invalid boolean: " + line}
+	}
+}
+
+func (r *RESPReader) parseBigNumber() (*configuration.RESPValue, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := new(big.Int).SetString(line, 10); !ok {
+		return nil, &ProtocolError{Message: "invalid big number: " + line}
+	}
+	return &configuration.RESPValue{Type: '(', Value: line}, nil
+}
+
+func (r *RESPReader) parseNull() (*configuration.RESPValue, error) {
+	if _, err := r.readLine(); err != nil {
+		return nil, err
+	}
+	return &configuration.RESPValue{Type: '_', Value: nil}, nil
+}
+
+// parseVerbatimString keeps the "txt:" format prefix as part of the value
+func (r *RESPReader) parseVerbatimString() (*configuration.RESPValue, error) {
+	value, err := r.parseBulkString()
+	if err != nil {
+		return nil, err
+	}
+	value.Type = '='
+	return value, nil
+}
+
+func (r *RESPReader) readByte() (byte, error) {
+	b, err := r.reader.ReadByte()
+	if err == nil {
+		r.consumed++
+		if r.record {
+			r.recorded = append(r.recorded, b)
+		}
+	}
+	return b, err
+}
+
+// readLine reads up to the next LF and strips the line terminator, lines are
+// at most maxLineLength long
+func (r *RESPReader) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.reader.ReadSlice('\n')
+		r.consumed += int64(len(chunk))
+		if r.record {
+			r.recorded = append(r.recorded, chunk...)
+		}
+		line = append(line, chunk...)
+		if len(line) > maxLineLength+2 {
+			return "", &ProtocolError{Message: "too big line"}
+		}
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return "", err
+		}
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+func (r *RESPReader) readLength() (int, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return 0, err
+	}
+	length, err := strconv.Atoi(line)
+	if err != nil {
+		return 0, &ProtocolError{Message: "invalid length"}
+	}
+	return length, nil
+}
+
+// readFull reads exactly length bytes. The buffer grows with the data that
+// arrives rather than being allocated from the announced length.
+func (r *RESPReader) readFull(length int) ([]byte, error) {
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, r.reader, int64(length))
+	r.consumed += n
+	data := buf.Bytes()
+	if r.record {
+		r.recorded = append(r.recorded, data...)
+	}
+	if err == io.EOF && n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
 	}
-	return &configuration.RESPValue{Type: '*', Value: array}, nil
+	return data, nil
 }
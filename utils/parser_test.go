@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadCommand(t *testing.T) {
+	tests := []struct {
+		name            string
+		input           string
+		unauthenticated bool
+		want            []string
+		wantProtocolErr bool
+	}{
+		{name: "array", input: "*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n", want: []string{"GET", "key"}},
+		{name: "crlf inside bulk", input: "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$6\r\na\r\nb\r\n\r\n", want: []string{"SET", "k", "a\r\nb\r\n"}},
+		{name: "nul inside bulk", input: "*2\r\n$3\r\nGET\r\n$3\r\na\x00b\r\n", want: []string{"GET", "a\x00b"}},
+		{name: "empty bulk", input: "*2\r\n$3\r\nGET\r\n$0\r\n\r\n", want: []string{"GET", ""}},
+		{name: "inline", input: "SET k \"v 1\"\r\n", want: []string{"SET", "k", "v 1"}},
+		{name: "blank inline", input: "\r\n", want: []string{}},
+		{name: "bulk without crlf", input: "*1\r\n$3\r\nGETX\r\n", wantProtocolErr: true},
+		{name: "invalid bulk length", input: "*1\r\n$abc\r\n", wantProtocolErr: true},
+		{name: "negative multibulk length", input: "*-2\r\n", wantProtocolErr: true},
+		{name: "integer in command", input: "*1\r\n:1\r\n", wantProtocolErr: true},
+		{name: "nested array", input: strings.Repeat("*1\r\n", 100000), wantProtocolErr: true},
+		{name: "null bulk in command", input: "*1\r\n$-1\r\n", wantProtocolErr: true},
+		{name: "empty array", input: "*0\r\n", want: []string{}},
+		{name: "too big inline", input: strings.Repeat("a", 70000) + "\r\n", wantProtocolErr: true},
+		{name: "too big header", input: "*" + strings.Repeat("1", 70000) + "\r\n", wantProtocolErr: true},
+		{name: "unbalanced inline quotes", input: "SET k \"v\r\n", wantProtocolErr: true},
+		{name: "unauthenticated small command", input: "*2\r\n$4\r\nAUTH\r\n$2\r\npw\r\n", unauthenticated: true, want: []string{"AUTH", "pw"}},
+		{name: "unauthenticated multibulk", input: "*11\r\n", unauthenticated: true, wantProtocolErr: true},
+		{name: "unauthenticated bulk", input: "*1\r\n$16385\r\n", unauthenticated: true, wantProtocolErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := NewRESPReader(strings.NewReader(tt.input))
+			reader.SetAuthenticated(!tt.unauthenticated)
+
+			args, err := reader.ReadCommand()
+			if tt.wantProtocolErr {
+				var protocolErr *ProtocolError
+				if !errors.As(err, &protocolErr) {
+					t.Fatalf("ReadCommand(%q) error = %v, want a protocol error", tt.input, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadCommand(%q) error: %v", tt.input, err)
+			}
+
+			got := []string{}
+			for _, arg := range args {
+				value, _ := arg.Value.(string)
+				got = append(got, value)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ReadCommand(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+			if reader.Consumed() != int64(len(tt.input)) {
+				t.Fatalf("Consumed() = %d, want %d", reader.Consumed(), len(tt.input))
+			}
+		})
+	}
+}
+
+func TestReadCommandTruncated(t *testing.T) {
+	//? A bulk announced longer than what arrives isn't allocated up front
+	reader := NewRESPReader(strings.NewReader("*1\r\n$536870000\r\nab"))
+	if _, err := reader.ReadCommand(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("ReadCommand error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestReadValueTooBigLine(t *testing.T) {
+	_, err := Parser("+" + strings.Repeat("a", 70000) + "\r\n")
+	var protocolErr *ProtocolError
+	if !errors.As(err, &protocolErr) {
+		t.Fatalf("Parser() error = %v, want a protocol error", err)
+	}
+}
+
+func TestReadValue(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		wantType  byte
+		wantValue any
+	}{
+		{name: "simple string", input: "+OK\r\n", wantType: '+', wantValue: "OK"},
+		{name: "error", input: "-ERR bad\r\n", wantType: '-', wantValue: "ERR bad"},
+		{name: "integer", input: ":-42\r\n", wantType: ':', wantValue: int64(-42)},
+		{name: "null bulk", input: "$-1\r\n", wantType: '$', wantValue: nil},
+		{name: "double", input: ",1.5\r\n", wantType: ',', wantValue: 1.5},
+		{name: "boolean", input: "#t\r\n", wantType: '#', wantValue: true},
+		{name: "big number", input: "(12345678901234567890\r\n", wantType: '(', wantValue: "12345678901234567890"},
+		{name: "verbatim", input: "=8\r\ntxt:a\r\nb\r\n", wantType: '=', wantValue: "txt:a\r\nb"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := Parser(tt.input)
+			if err != nil {
+				t.Fatalf("Parser(%q) error: %v", tt.input, err)
+			}
+			if value.Type != tt.wantType || !reflect.DeepEqual(value.Value, tt.wantValue) {
+				t.Fatalf("Parser(%q) = %c %#v, want %c %#v", tt.input, value.Type, value.Value, tt.wantType, tt.wantValue)
+			}
+		})
+	}
+}
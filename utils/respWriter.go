@@ -0,0 +1,258 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	configuration "github.com/oussamasf/yuji/config"
+)
+
+//? Reply values reuse configuration.RESPValue, the Type byte is the RESP
+//? prefix and Value holds a string, an int64, a float64, a bool or a
+//? []RESPValue. A nil Value on a bulk string or an array is the null reply,
+//? maps and attributes are stored as flat key/value pairs.
+
+// Protocol versions a client can negotiate with HELLO
+const (
+	RESP2 = 2
+	RESP3 = 3
+)
+
+func NewSimpleString(s string) configuration.RESPValue {
+	return configuration.RESPValue{Type: '+', Value: s}
+}
+
+func NewError(msg string) configuration.RESPValue {
+	return configuration.RESPValue{Type: '-', Value: msg}
+}
+
+func NewInteger(n int64) configuration.RESPValue {
+	return configuration.RESPValue{Type: ':', Value: n}
+}
+
+func NewBulkString(s string) configuration.RESPValue {
+	return configuration.RESPValue{Type: '$', Value: s}
+}
+
+func NewNullBulkString() configuration.RESPValue {
+	return configuration.RESPValue{Type: '$', Value: nil}
+}
+
+func NewArray(values ...configuration.RESPValue) configuration.RESPValue {
+	if values == nil {
+		values = []configuration.RESPValue{}
+	}
+	return configuration.RESPValue{Type: '*', Value: values}
+}
+
+func NewNullArray() configuration.RESPValue {
+	return configuration.RESPValue{Type: '*', Value: nil}
+}
+
+// NewBulkStringArray builds an array reply out of plain strings.
+func NewBulkStringArray(arr []string) configuration.RESPValue {
+	values := make([]configuration.RESPValue, 0, len(arr))
+	for _, item := range arr {
+		values = append(values, NewBulkString(item))
+	}
+	return NewArray(values...)
+}
+
+// NewMap takes flat key/value pairs, RESP2 clients receive them as an array.
+func NewMap(pairs ...configuration.RESPValue) configuration.RESPValue {
+	if pairs == nil {
+		pairs = []configuration.RESPValue{}
+	}
+	return configuration.RESPValue{Type: '%', Value: pairs}
+}
+
+func NewSet(values ...configuration.RESPValue) configuration.RESPValue {
+	if values == nil {
+		values = []configuration.RESPValue{}
+	}
+	return configuration.RESPValue{Type: '~', Value: values}
+}
+
+func NewPush(values ...configuration.RESPValue) configuration.RESPValue {
+	if values == nil {
+		values = []configuration.RESPValue{}
+	}
+	return configuration.RESPValue{Type: '>', Value: values}
+}
+
+func NewDouble(f float64) configuration.RESPValue {
+	return configuration.RESPValue{Type: ',', Value: f}
+}
+
+func NewBoolean(b bool) configuration.RESPValue {
+	return configuration.RESPValue{Type: '#', Value: b}
+}
+
+// NewBigNumber takes the decimal representation of the number.
+func NewBigNumber(n string) configuration.RESPValue {
+	return configuration.RESPValue{Type: '(', Value: n}
+}
+
+func NewNull() configuration.RESPValue {
+	return configuration.RESPValue{Type: '_', Value: nil}
+}
+
+// NewVerbatimString takes a three letters format such as "txt" or "mkd".
+func NewVerbatimString(format string, s string) configuration.RESPValue {
+	return configuration.RESPValue{Type: '=', Value: format + ":" + s}
+}
+
+// EncodeValue serializes a reply value for a client speaking the given
+// protocol, RESP3 only types are downgraded the way Redis does for RESP2.
+func EncodeValue(v configuration.RESPValue, protocol int) []byte {
+	var buf bytes.Buffer
+	writeValue(&buf, v, protocol)
+	return buf.Bytes()
+}
+
+// Length of the random mark delimiting a payload sent with EOF framing
+const EOFMarkLength = 40
+
+// EncodeBulkPayload frames raw bytes as "$<length>\r\n<bytes>" without the
+// trailing CRLF, the way the RDB is sent to replicas on full sync.
+func EncodeBulkPayload(data []byte) []byte {
+	payload := make([]byte, 0, len(data)+16)
+	payload = append(payload, '$')
+	payload = strconv.AppendInt(payload, int64(len(data)), 10)
+	payload = append(payload, '\r', '\n')
+	return append(payload, data...)
+}
+
+// ? Simple strings and errors end at the first CRLF, any inside the payload
+// ? would start a reply of its own, so they are replaced by spaces like Redis
+var lineSafe = strings.NewReplacer("\r", " ", "\n", " ")
+
+func writeValue(buf *bytes.Buffer, v configuration.RESPValue, protocol int) {
+	if protocol >= RESP3 && len(v.Attributes) > 0 {
+		writeAggregate(buf, '|', v.Attributes, len(v.Attributes)/2, protocol)
+	}
+
+	switch v.Type {
+	case '+', '-':
+		buf.WriteByte(v.Type)
+		buf.WriteString(lineSafe.Replace(fmt.Sprint(v.Value)))
+		buf.WriteString("\r\n")
+	case ':':
+		buf.WriteByte(':')
+		switch n := v.Value.(type) {
+		case int64:
+			buf.WriteString(strconv.FormatInt(n, 10))
+		case int:
+			buf.WriteString(strconv.Itoa(n))
+		default:
+			buf.WriteString(fmt.Sprint(n))
+		}
+		buf.WriteString("\r\n")
+	case '$':
+		s, ok := v.Value.(string)
+		if !ok {
+			writeNull(buf, '$', protocol)
+			return
+		}
+		writeBulkString(buf, s)
+	case '*', '~', '>':
+		values, ok := v.Value.([]configuration.RESPValue)
+		if !ok {
+			writeNull(buf, '*', protocol)
+			return
+		}
+		prefix := v.Type
+		if protocol < RESP3 {
+			prefix = '*'
+		}
+		writeAggregate(buf, prefix, values, len(values), protocol)
+	case '%':
+		pairs, _ := v.Value.([]configuration.RESPValue)
+		if protocol < RESP3 {
+			writeAggregate(buf, '*', pairs, len(pairs), protocol)
+			return
+		}
+		writeAggregate(buf, '%', pairs, len(pairs)/2, protocol)
+	case ',':
+		f, _ := v.Value.(float64)
+		if protocol < RESP3 {
+			writeBulkString(buf, formatDouble(f))
+			return
+		}
+		buf.WriteString("," + formatDouble(f) + "\r\n")
+	case '#':
+		b, _ := v.Value.(bool)
+		if protocol < RESP3 {
+			if b {
+				buf.WriteString(":1\r\n")
+			} else {
+				buf.WriteString(":0\r\n")
+			}
+			return
+		}
+		if b {
+			buf.WriteString("#t\r\n")
+		} else {
+			buf.WriteString("#f\r\n")
+		}
+	case '(':
+		n := fmt.Sprint(v.Value)
+		if protocol < RESP3 {
+			writeBulkString(buf, n)
+			return
+		}
+		buf.WriteString("(" + n + "\r\n")
+	case '_':
+		writeNull(buf, '$', protocol)
+	case '=':
+		s, _ := v.Value.(string)
+		if protocol < RESP3 {
+			//? RESP2 has no verbatim strings, drop the "txt:" format prefix
+			if len(s) >= 4 && s[3] == ':' {
+				s = s[4:]
+			}
+			writeBulkString(buf, s)
+			return
+		}
+		buf.WriteString("=" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+	}
+}
+
+func writeAggregate(buf *bytes.Buffer, prefix byte, values []configuration.RESPValue, length int, protocol int) {
+	buf.WriteByte(prefix)
+	buf.WriteString(strconv.Itoa(length) + "\r\n")
+	for _, value := range values {
+		writeValue(buf, value, protocol)
+	}
+}
+
+func writeBulkString(buf *bytes.Buffer, s string) {
+	buf.WriteString("$" + strconv.Itoa(len(s)) + "\r\n")
+	buf.WriteString(s)
+	buf.WriteString("\r\n")
+}
+
+// writeNull writes the RESP3 null, or the RESP2 null bulk string or null array
+func writeNull(buf *bytes.Buffer, resp2Type byte, protocol int) {
+	if protocol >= RESP3 {
+		buf.WriteString("_\r\n")
+		return
+	}
+	buf.WriteByte(resp2Type)
+	buf.WriteString("-1\r\n")
+}
+
+func formatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// WriteSyncedFile creates path with what write produces and fsyncs it, the
+// file is removed when anything fails.
+func WriteSyncedFile(path string, write func(w io.Writer) error) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(file)
+	err = write(out)
+	if err == nil {
+		err = out.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// RenameSynced moves oldPath over newPath and fsyncs the directory, so the
+// rename itself survives a crash.
+func RenameSynced(oldPath string, newPath string) error {
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	return SyncDir(filepath.Dir(newPath))
+}
+
+// SyncDir fsyncs a directory, making the files created or renamed in it
+// durable.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}